@@ -0,0 +1,295 @@
+package connpool
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shell909090/goproxy/tunnel"
+)
+
+const (
+	STATE_INTERVAL = 60
+)
+
+var (
+	ErrTooManyStreams = errors.New("too many streams.")
+)
+
+// Quota of a user, 0 means unlimited.
+type Quota struct {
+	Daily   uint64 // bytes per day
+	Monthly uint64 // bytes per month
+	Rate    int    // bytes per second, read and write together
+	Streams int    // concurrent streams
+}
+
+// Usage is what persisted in state file.
+type Usage struct {
+	Day        string
+	Month      string
+	DayBytes   uint64
+	MonthBytes uint64
+	TotalBytes uint64
+}
+
+// Account of a user, shared by all tunnels of the user.
+// use lock to protect: Usage, quota, streams, tokens, last.
+type Account struct {
+	Username string
+	lock     sync.Mutex
+	Usage
+	quota   Quota
+	streams int
+	tokens  float64
+	last    time.Time
+	// replaced in tests.
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func NewAccount(username string) (acct *Account) {
+	return &Account{
+		Username: username,
+		last:     time.Now(),
+		now:      time.Now,
+		sleep:    time.Sleep,
+	}
+}
+
+// call with acct.lock.
+func (acct *Account) rollover(now time.Time) {
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	if acct.Day != day {
+		acct.Day = day
+		acct.DayBytes = 0
+	}
+	if acct.Month != month {
+		acct.Month = month
+		acct.MonthBytes = 0
+	}
+}
+
+// call with acct.lock.
+func (acct *Account) exhausted() bool {
+	switch {
+	case acct.quota.Daily > 0 && acct.DayBytes >= acct.quota.Daily:
+	case acct.quota.Monthly > 0 && acct.MonthBytes >= acct.quota.Monthly:
+	default:
+		return false
+	}
+	return true
+}
+
+func (acct *Account) Open() (err error) {
+	acct.lock.Lock()
+	defer acct.lock.Unlock()
+	acct.rollover(acct.now())
+	if acct.exhausted() {
+		return tunnel.ErrQuotaExceeded
+	}
+	if acct.quota.Streams > 0 && acct.streams >= acct.quota.Streams {
+		return ErrTooManyStreams
+	}
+	acct.streams++
+	return
+}
+
+func (acct *Account) Close() {
+	acct.lock.Lock()
+	defer acct.lock.Unlock()
+	acct.streams--
+}
+
+// Transfer counts n bytes, and sleeps if they are over rate. Tokens of one
+// second could be saved for burst.
+func (acct *Account) Transfer(n int) (err error) {
+	var wait time.Duration
+	func() {
+		acct.lock.Lock()
+		defer acct.lock.Unlock()
+		now := acct.now()
+		acct.rollover(now)
+		if acct.exhausted() {
+			err = tunnel.ErrQuotaExceeded
+			return
+		}
+		acct.DayBytes += uint64(n)
+		acct.MonthBytes += uint64(n)
+		acct.TotalBytes += uint64(n)
+
+		if acct.quota.Rate <= 0 {
+			return
+		}
+		rate := float64(acct.quota.Rate)
+		acct.tokens += now.Sub(acct.last).Seconds() * rate
+		if acct.tokens > rate {
+			acct.tokens = rate
+		}
+		acct.last = now
+		acct.tokens -= float64(n)
+		if acct.tokens < 0 {
+			wait = time.Duration(-acct.tokens / rate * float64(time.Second))
+		}
+	}()
+	if wait > 0 {
+		acct.sleep(wait)
+	}
+	return
+}
+
+func (acct *Account) setQuota(quota Quota) {
+	acct.lock.Lock()
+	defer acct.lock.Unlock()
+	acct.quota = quota
+}
+
+type AccountInfo struct {
+	Username string
+	Streams  int
+	Quota    Quota
+	Usage
+}
+
+func (acct *Account) info() AccountInfo {
+	acct.lock.Lock()
+	defer acct.lock.Unlock()
+	acct.rollover(time.Now())
+	return AccountInfo{
+		Username: acct.Username,
+		Streams:  acct.streams,
+		Quota:    acct.quota,
+		Usage:    acct.Usage,
+	}
+}
+
+// Accounting keeps accounts by username, and saves usages to statefile.
+// use lock to protect: accounts, quotas, statefile.
+type Accounting struct {
+	lock      sync.Mutex
+	accounts  map[string]*Account
+	quotas    map[string]Quota
+	statefile string
+}
+
+func NewAccounting() (acc *Accounting) {
+	return &Accounting{
+		accounts: make(map[string]*Account),
+	}
+}
+
+func (acc *Accounting) Get(username string) (acct *Account) {
+	acc.lock.Lock()
+	defer acc.lock.Unlock()
+	acct, ok := acc.accounts[username]
+	if !ok {
+		acct = NewAccount(username)
+		acct.quota = acc.quotas[username]
+		acc.accounts[username] = acct
+	}
+	return
+}
+
+// SetQuotas replaces quotas, users not in it are unlimited.
+func (acc *Accounting) SetQuotas(quotas map[string]Quota) {
+	acc.lock.Lock()
+	defer acc.lock.Unlock()
+	acc.quotas = quotas
+	for username, acct := range acc.accounts {
+		acct.setQuota(quotas[username])
+	}
+}
+
+// Load usages from statefile, and save to it every STATE_INTERVAL.
+// Not existed statefile is fine, it will be created. Loaded again, only
+// statefile is replaced, saving isn't started twice.
+func (acc *Accounting) Load(statefile string) (err error) {
+	usages := make(map[string]Usage)
+	data, err := ioutil.ReadFile(statefile)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return
+	default:
+		err = json.Unmarshal(data, &usages)
+		if err != nil {
+			return
+		}
+	}
+
+	acc.lock.Lock()
+	started := acc.statefile != ""
+	acc.statefile = statefile
+	acc.lock.Unlock()
+	for username, usage := range usages {
+		acct := acc.Get(username)
+		acct.lock.Lock()
+		acct.Usage = usage
+		acct.lock.Unlock()
+	}
+
+	if !started {
+		go acc.loop()
+	}
+	return nil
+}
+
+func (acc *Accounting) loop() {
+	for {
+		time.Sleep(STATE_INTERVAL * time.Second)
+		err := acc.Save()
+		if err != nil {
+			logger.Error(err.Error())
+		}
+	}
+}
+
+// Save usages to statefile, write to temp file and rename, so a crash
+// won't leave half of it.
+func (acc *Accounting) Save() (err error) {
+	usages := make(map[string]Usage)
+	for _, ai := range acc.GetAccounts() {
+		usages[ai.Username] = ai.Usage
+	}
+	data, err := json.MarshalIndent(usages, "", "\t")
+	if err != nil {
+		return
+	}
+
+	acc.lock.Lock()
+	statefile := acc.statefile
+	acc.lock.Unlock()
+	if statefile == "" {
+		return
+	}
+
+	tmpfile := statefile + ".tmp"
+	err = ioutil.WriteFile(tmpfile, data, 0600)
+	if err != nil {
+		return
+	}
+	return os.Rename(tmpfile, statefile)
+}
+
+func (acc *Accounting) GetAccounts() (ais []AccountInfo) {
+	// used by manager
+	acc.lock.Lock()
+	accts := make([]*Account, 0, len(acc.accounts))
+	for _, acct := range acc.accounts {
+		accts = append(accts, acct)
+	}
+	acc.lock.Unlock()
+
+	ais = []AccountInfo{}
+	for _, acct := range accts {
+		ais = append(ais, acct.info())
+	}
+	sort.Slice(ais, func(i, j int) bool {
+		return ais[i].Username < ais[j].Username
+	})
+	return
+}
@@ -0,0 +1,121 @@
+package connpool
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shell909090/goproxy/tunnel"
+)
+
+func TestAccountQuota(t *testing.T) {
+	acc := NewAccounting()
+	acc.SetQuotas(map[string]Quota{"user": {Daily: 100, Streams: 1}})
+	acct := acc.Get("user")
+
+	if err := acct.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := acct.Open(); err != ErrTooManyStreams {
+		t.Fatalf("second stream should be refused: %v.", err)
+	}
+
+	if err := acct.Transfer(100); err != nil {
+		t.Fatal(err)
+	}
+	if err := acct.Transfer(1); err != tunnel.ErrQuotaExceeded {
+		t.Fatalf("transfer should be refused: %v.", err)
+	}
+	acct.Close()
+	if err := acct.Open(); err != tunnel.ErrQuotaExceeded {
+		t.Fatalf("open should be refused: %v.", err)
+	}
+
+	// next day.
+	acct.Day = "1970-01-01"
+	if err := acct.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if acct.MonthBytes != 100 || acct.DayBytes != 0 {
+		t.Fatalf("usage wrong after day passed: %+v.", acct.Usage)
+	}
+
+	// unlimited user.
+	if err := acc.Get("other").Transfer(1 << 30); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeClock moves only when slept.
+type fakeClock struct {
+	now   time.Time
+	slept time.Duration
+}
+
+func (fc *fakeClock) Now() time.Time {
+	return fc.now
+}
+
+func (fc *fakeClock) Sleep(d time.Duration) {
+	fc.now = fc.now.Add(d)
+	fc.slept += d
+}
+
+func TestAccountRate(t *testing.T) {
+	fc := &fakeClock{now: time.Now()}
+	acct := NewAccount("user")
+	acct.now, acct.sleep, acct.last = fc.Now, fc.Sleep, fc.now
+	acct.setQuota(Quota{Rate: 10000})
+
+	// no tokens at first, 2000 bytes take 0.2s.
+	for i := 0; i < 20; i++ {
+		acct.Transfer(100)
+	}
+	if fc.slept < 199*time.Millisecond || fc.slept > 201*time.Millisecond {
+		t.Fatalf("rate not limited: %s.", fc.slept)
+	}
+
+	// tokens of one second saved for burst, no more.
+	fc.Sleep(10 * time.Second)
+	fc.slept = 0
+	acct.Transfer(10000)
+	if fc.slept != 0 {
+		t.Fatalf("burst should pass: %s.", fc.slept)
+	}
+	acct.Transfer(1000)
+	if fc.slept < 99*time.Millisecond || fc.slept > 101*time.Millisecond {
+		t.Fatalf("burst over one second should wait: %s.", fc.slept)
+	}
+}
+
+func TestAccountState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	statefile := filepath.Join(dir, "state.json")
+
+	acc := NewAccounting()
+	err = acc.Load(statefile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc.Get("user").Transfer(1234)
+	err = acc.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acc = NewAccounting()
+	err = acc.Load(statefile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ais := acc.GetAccounts()
+	if len(ais) != 1 || ais[0].Username != "user" || ais[0].TotalBytes != 1234 {
+		t.Fatalf("state not loaded: %+v.", ais)
+	}
+}
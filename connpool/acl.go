@@ -0,0 +1,263 @@
+package connpool
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/shell909090/goproxy/netutil"
+	"github.com/shell909090/goproxy/tunnel"
+)
+
+var (
+	// the same as tunnel, so client gets ERR_DENIED, not connect failed.
+	ErrDenied = tunnel.ErrDenied
+)
+
+// targets denied unless allowed by rules before them.
+var DefaultDenied = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// AclRule matches targets, empty fields match anything. Rules are checked
+// in order, the first matched one decides. Target not matched is allowed,
+// after DefaultDenied.
+type AclRule struct {
+	Action  string   // allow or deny
+	Users   []string // usernames
+	Cidrs   []string // like 10.0.0.0/8
+	Domains []string // suffix, example.com matches www.example.com
+	Ports   string   // like 80,443,8000-9000
+}
+
+type portRange struct {
+	low, high int
+}
+
+type aclRule struct {
+	allow   bool
+	users   map[string]struct{}
+	nets    []*net.IPNet
+	domains []string
+	ports   []portRange
+}
+
+func parsePorts(s string) (ports []portRange, err error) {
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		var r portRange
+		pair := strings.SplitN(p, "-", 2)
+		r.low, err = strconv.Atoi(pair[0])
+		if err != nil {
+			return
+		}
+		r.high = r.low
+		if len(pair) == 2 {
+			r.high, err = strconv.Atoi(pair[1])
+			if err != nil {
+				return
+			}
+		}
+		if r.low < 0 || r.high > 65535 || r.low > r.high {
+			return nil, fmt.Errorf("port range error: %s.", p)
+		}
+		ports = append(ports, r)
+	}
+	return
+}
+
+func parseRule(rule *AclRule) (r *aclRule, err error) {
+	r = &aclRule{}
+	switch strings.ToLower(rule.Action) {
+	case "allow":
+		r.allow = true
+	case "deny":
+	default:
+		return nil, fmt.Errorf("unknown acl action: %s.", rule.Action)
+	}
+
+	if len(rule.Users) > 0 {
+		r.users = make(map[string]struct{}, len(rule.Users))
+		for _, u := range rule.Users {
+			r.users[u] = struct{}{}
+		}
+	}
+	for _, cidr := range rule.Cidrs {
+		var ipnet *net.IPNet
+		_, ipnet, err = net.ParseCIDR(cidr)
+		if err != nil {
+			return
+		}
+		r.nets = append(r.nets, ipnet)
+	}
+	for _, domain := range rule.Domains {
+		r.domains = append(r.domains, strings.ToLower(strings.Trim(domain, ".")))
+	}
+	r.ports, err = parsePorts(rule.Ports)
+	return
+}
+
+// host is the domain, empty if target is an ip.
+func (r *aclRule) match(username, host string, ip net.IP, port int) bool {
+	if r.users != nil {
+		if _, ok := r.users[username]; !ok {
+			return false
+		}
+	}
+
+	if len(r.ports) > 0 {
+		matched := false
+		for _, pr := range r.ports {
+			if port >= pr.low && port <= pr.high {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(r.nets) == 0 && len(r.domains) == 0 {
+		return true
+	}
+	for _, ipnet := range r.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	for _, domain := range r.domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL checks targets of streams on server.
+// use lock to protect: rules.
+type ACL struct {
+	lock   sync.RWMutex
+	rules  []*aclRule
+	Lookup func(host string) ([]net.IP, error)
+}
+
+func NewACL() (acl *ACL) {
+	acl = &ACL{Lookup: net.LookupIP}
+	acl.SetRules(nil)
+	return
+}
+
+// SetRules replaces rules, DefaultDenied are appended after them.
+func (acl *ACL) SetRules(rules []AclRule) (err error) {
+	var parsed []*aclRule
+	for i := range rules {
+		var r *aclRule
+		r, err = parseRule(&rules[i])
+		if err != nil {
+			return
+		}
+		parsed = append(parsed, r)
+	}
+	r, err := parseRule(&AclRule{Action: "deny", Cidrs: DefaultDenied})
+	if err != nil {
+		panic(err.Error())
+	}
+	parsed = append(parsed, r)
+
+	acl.lock.Lock()
+	defer acl.lock.Unlock()
+	acl.rules = parsed
+	return
+}
+
+func (acl *ACL) allow(username, host string, ip net.IP, port int) bool {
+	acl.lock.RLock()
+	defer acl.lock.RUnlock()
+	for _, r := range acl.rules {
+		if r.match(username, host, ip, port) {
+			return r.allow
+		}
+	}
+	return true
+}
+
+// dialNetwork is the family really dialed by tunnel, tcp4 if forceipv4.
+func dialNetwork(network string) string {
+	if network == "tcp" && netutil.DefaultTcpDialer == netutil.DefaultTcp4Dialer {
+		return "tcp4"
+	}
+	return network
+}
+
+// Check target of user. Domain is resolved, and all addresses of it
+// should be allowed. Addresses of the family dialed are returned, in the
+// order resolved.
+func (acl *ACL) Check(username, network, address string) (dialaddrs []string, err error) {
+	hostname, portstr, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	port, err := strconv.Atoi(portstr)
+	if err != nil {
+		return
+	}
+
+	if ip := net.ParseIP(hostname); ip != nil {
+		if !acl.allow(username, "", ip, port) {
+			return nil, ErrDenied
+		}
+		return []string{address}, nil
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(hostname, "."))
+	ips, err := acl.Lookup(hostname)
+	if err != nil {
+		return
+	}
+	network = dialNetwork(network)
+	for _, ip := range ips {
+		if !acl.allow(username, host, ip, port) {
+			return nil, ErrDenied
+		}
+		switch {
+		case strings.HasSuffix(network, "4") && ip.To4() == nil:
+		case strings.HasSuffix(network, "6") && ip.To4() != nil:
+		default:
+			dialaddrs = append(dialaddrs, net.JoinHostPort(ip.String(), portstr))
+		}
+	}
+	if len(dialaddrs) == 0 {
+		return nil, fmt.Errorf("no address of %s for %s.", hostname, network)
+	}
+	return
+}
+
+// For returns the checker of user.
+func (acl *ACL) For(username string) *UserACL {
+	return &UserACL{acl: acl, username: username}
+}
+
+type UserACL struct {
+	acl      *ACL
+	username string
+}
+
+func (u *UserACL) Check(network, address string) (dialaddrs []string, err error) {
+	return u.acl.Check(u.username, network, address)
+}
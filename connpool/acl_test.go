@@ -0,0 +1,81 @@
+package connpool
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+func TestACL(t *testing.T) {
+	acl := NewACL()
+	acl.Lookup = func(host string) ([]net.IP, error) {
+		switch host {
+		case "rebind.example.com":
+			return []net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("127.0.0.1")}, nil
+		case "intra.example.com":
+			return []net.IP{net.ParseIP("10.1.2.3")}, nil
+		}
+		return []net.IP{net.ParseIP("::2"), net.ParseIP("1.2.3.4")}, nil
+	}
+	err := acl.SetRules([]AclRule{
+		{Action: "allow", Users: []string{"admin"}, Cidrs: []string{"10.0.0.0/8"}},
+		{Action: "allow", Domains: []string{"intra.example.com"}, Ports: "443"},
+		{Action: "deny", Ports: "25,6000-7000"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		username, network, address string
+		dialaddrs                  []string
+	}{
+		{"user", "tcp", "1.2.3.4:80", []string{"1.2.3.4:80"}},
+		{"user", "tcp4", "www.example.com:80", []string{"1.2.3.4:80"}},
+		{"user", "tcp6", "www.example.com:80", []string{"[::2]:80"}},
+		{"user", "tcp", "www.example.com:80", []string{"[::2]:80", "1.2.3.4:80"}},
+		{"admin", "tcp", "10.0.0.1:22", []string{"10.0.0.1:22"}},
+		{"user", "tcp", "intra.example.com:443", []string{"10.1.2.3:443"}},
+	} {
+		dialaddrs, err := acl.Check(c.username, c.network, c.address)
+		if err != nil || !reflect.DeepEqual(dialaddrs, c.dialaddrs) {
+			t.Fatalf("%s to %s should be allowed as %v: %v %v.",
+				c.username, c.address, c.dialaddrs, dialaddrs, err)
+		}
+	}
+
+	// forceipv4 dials tcp4 only.
+	netutil.DefaultTcpDialer = netutil.DefaultTcp4Dialer
+	dialaddrs, err := acl.Check("user", "tcp", "www.example.com:80")
+	netutil.DefaultTcpDialer = &netutil.TcpDialer{}
+	if err != nil || !reflect.DeepEqual(dialaddrs, []string{"1.2.3.4:80"}) {
+		t.Fatalf("forceipv4 should dial ipv4 only: %v %v.", dialaddrs, err)
+	}
+
+	for _, c := range []struct {
+		username, address string
+	}{
+		{"user", "127.0.0.1:80"},
+		{"user", "[::1]:80"},
+		{"user", "[::ffff:192.168.1.1]:80"},
+		{"user", "169.254.169.254:80"},
+		{"user", "10.0.0.1:22"},
+		{"user", "rebind.example.com:80"},
+		{"user", "intra.example.com:80"},
+		{"user", "1.2.3.4:25"},
+		{"admin", "1.2.3.4:6379"},
+		{"user", "1.2.3.4:6500"},
+	} {
+		_, err := acl.Check(c.username, "tcp", c.address)
+		if err != ErrDenied {
+			t.Fatalf("%s to %s should be denied: %v.", c.username, c.address, err)
+		}
+	}
+
+	err = acl.SetRules([]AclRule{{Action: "allow", Ports: "70000"}})
+	if err == nil {
+		t.Fatal("wrong port should be refused.")
+	}
+}
@@ -0,0 +1,304 @@
+package connpool
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	mydns "github.com/shell909090/goproxy/dns"
+	"github.com/shell909090/goproxy/tunnel"
+)
+
+var (
+	ErrNoTunnel     = errors.New("tunnel not found.")
+	ErrNoStream     = errors.New("stream not found.")
+	ErrNoUpstream   = errors.New("upstream not found.")
+	ErrNeedPost     = errors.New("method should be POST.")
+	ErrBadParameter = errors.New("bad parameter.")
+)
+
+type StreamInfo struct {
+	Id       uint16
+	Target   string
+	Status   string
+	Priority string
+	Sent     uint64
+	Recvd    uint64
+	Age      float64 // seconds
+}
+
+type TunnelInfo struct {
+	Name     string
+	Uptime   float64 // seconds
+	RTT      float64 // milliseconds
+	Sent     uint64
+	Recvd    uint64
+	Draining bool
+	Streams  []StreamInfo
+}
+
+type UpstreamInfo struct {
+	Server string
+	Weight int
+	RTT    float64 // milliseconds
+	Rate   string
+	Status string
+}
+
+type FilterInfo struct {
+	Enabled bool
+	Filters int
+	Host    string `json:",omitempty"`
+	Direct  bool
+}
+
+type DnsInfo struct {
+	Debug  bool
+	Cached int
+	Host   string   `json:",omitempty"`
+	Addrs  []string `json:",omitempty"`
+}
+
+// Filter is the one in front of dialer, ipfilter.Router mostly.
+type Filter interface {
+	SetEnabled(on bool)
+	IsEnabled() bool
+	GetSize() int
+	Lookup(hostname string) (direct bool, err error)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"Error": err.Error()})
+}
+
+// checkPost returns false and writes error if method isn't POST.
+func checkPost(w http.ResponseWriter, req *http.Request) bool {
+	if req.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, ErrNeedPost)
+		return false
+	}
+	return true
+}
+
+func describeTunnel(tun tunnel.Tunnel) (ti TunnelInfo) {
+	ti.Name = tun.String()
+	ti.Uptime = tun.Uptime().Seconds()
+	ti.RTT = tun.RTT().Seconds() * 1000
+	ti.Sent, ti.Recvd = tun.GetBytes()
+	ti.Draining = tun.IsDraining()
+	ti.Streams = []StreamInfo{}
+	for _, c := range tun.GetConnections() {
+		si := StreamInfo{
+			Id:       c.GetStreamId(),
+			Target:   c.GetTarget(),
+			Status:   c.GetStatusString(),
+			Priority: c.GetPriorityString(),
+			Age:      c.Age().Seconds(),
+		}
+		si.Sent, si.Recvd = c.GetBytes()
+		ti.Streams = append(ti.Streams, si)
+	}
+	return
+}
+
+// Find returns tunnel by its name.
+func (pool *Pool) Find(name string) (tun tunnel.Tunnel) {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+	for t, _ := range pool.tunpool {
+		if t.String() == name {
+			return t
+		}
+	}
+	return nil
+}
+
+func (pool *Pool) HandlerAPITunnels(w http.ResponseWriter, req *http.Request) {
+	tis := []TunnelInfo{}
+	for _, tun := range pool.GetTunnels() {
+		tis = append(tis, describeTunnel(tun))
+	}
+	writeJSON(w, tis)
+	return
+}
+
+func (pool *Pool) HandlerAPITunnelClose(w http.ResponseWriter, req *http.Request) {
+	if !checkPost(w, req) {
+		return
+	}
+	tun := pool.Find(req.FormValue("tunnel"))
+	if tun == nil {
+		writeError(w, http.StatusNotFound, ErrNoTunnel)
+		return
+	}
+
+	logger.Noticef("close tunnel %s by admin.", tun.String())
+	err := tun.Close()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, describeTunnel(tun))
+	return
+}
+
+// HandlerAPIStreamReset resets one stream, and peer is told with MSG_RST.
+func (pool *Pool) HandlerAPIStreamReset(w http.ResponseWriter, req *http.Request) {
+	if !checkPost(w, req) {
+		return
+	}
+	tun := pool.Find(req.FormValue("tunnel"))
+	if tun == nil {
+		writeError(w, http.StatusNotFound, ErrNoTunnel)
+		return
+	}
+	id, err := strconv.ParseUint(req.FormValue("id"), 10, 16)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrBadParameter)
+		return
+	}
+	c := tun.GetConnection(uint16(id))
+	if c == nil {
+		writeError(w, http.StatusNotFound, ErrNoStream)
+		return
+	}
+
+	err = c.Abort()
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, describeTunnel(tun))
+	return
+}
+
+// HandlerAPIDns shows dns state and looks up host if given.
+// POST with debug=true/false toggles logging of dns results.
+func HandlerAPIDns(w http.ResponseWriter, req *http.Request) {
+	if debug := req.FormValue("debug"); debug != "" {
+		if !checkPost(w, req) {
+			return
+		}
+		on, err := strconv.ParseBool(debug)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, ErrBadParameter)
+			return
+		}
+		mydns.SetDebug(on)
+	}
+
+	info := DnsInfo{
+		Debug:  mydns.IsDebug(),
+		Cached: mydns.DefaultCache.GetSize(),
+		Host:   req.FormValue("host"),
+	}
+	if info.Host != "" {
+		addrs, err := mydns.DefaultResolver.LookupIP(info.Host)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+		for _, addr := range addrs {
+			info.Addrs = append(info.Addrs, addr.String())
+		}
+	}
+	writeJSON(w, info)
+	return
+}
+
+// HandlerAPIFilter shows filter state and tells where host goes if given.
+// POST with enabled=true/false turns filter on or off.
+func HandlerAPIFilter(filter Filter) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if enabled := req.FormValue("enabled"); enabled != "" {
+			if !checkPost(w, req) {
+				return
+			}
+			on, err := strconv.ParseBool(enabled)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, ErrBadParameter)
+				return
+			}
+			filter.SetEnabled(on)
+		}
+
+		info := FilterInfo{
+			Enabled: filter.IsEnabled(),
+			Filters: filter.GetSize(),
+			Host:    req.FormValue("host"),
+		}
+		if info.Host != "" {
+			var err error
+			info.Direct, err = filter.Lookup(info.Host)
+			if err != nil {
+				writeError(w, http.StatusBadGateway, err)
+				return
+			}
+		}
+		writeJSON(w, info)
+		return
+	}
+}
+
+func (dialer *Dialer) HandlerAPIUpstreams(w http.ResponseWriter, req *http.Request) {
+	uis := []UpstreamInfo{}
+	for _, up := range dialer.GetUpstreams() {
+		uis = append(uis, UpstreamInfo{
+			Server: up.String(),
+			Weight: up.Weight,
+			RTT:    up.GetRTT().Seconds() * 1000,
+			Rate:   up.GetRate(),
+			Status: up.GetStatusString(),
+		})
+	}
+	writeJSON(w, uis)
+	return
+}
+
+// HandlerAPITunnelCreate creates a tunnel to server, which could be
+// user@addr or just addr. Open circuit breaker of it is ignored, but
+// when half open, only one trial at a time, others get ErrProbing.
+func (dialer *Dialer) HandlerAPITunnelCreate(w http.ResponseWriter, req *http.Request) {
+	if !checkPost(w, req) {
+		return
+	}
+	server := req.FormValue("server")
+	var up *Upstream
+	for _, u := range dialer.GetUpstreams() {
+		if u.String() == server || strings.HasSuffix(u.String(), "@"+server) {
+			up = u
+			break
+		}
+	}
+	if up == nil {
+		writeError(w, http.StatusNotFound, ErrNoUpstream)
+		return
+	}
+
+	logger.Noticef("create tunnel to %s by admin.", up.String())
+	tun, err := up.Create()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	dialer.addTunnel(tun, up)
+	writeJSON(w, describeTunnel(tun))
+	return
+}
+
+func (server *Server) HandlerAPIAccounts(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, server.Accounting.GetAccounts())
+	return
+}
@@ -0,0 +1,61 @@
+package connpool
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+type testFilter struct {
+	enabled bool
+}
+
+func (f *testFilter) SetEnabled(on bool) { f.enabled = on }
+func (f *testFilter) IsEnabled() bool    { return f.enabled }
+func (f *testFilter) GetSize() int       { return 1 }
+func (f *testFilter) Lookup(hostname string) (bool, error) {
+	return f.enabled && hostname == "direct.example.com", nil
+}
+
+func TestAPIFilter(t *testing.T) {
+	filter := &testFilter{enabled: true}
+	handler := HandlerAPIFilter(filter)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/api/filter?enabled=false", nil))
+	if w.Code != 405 || !filter.enabled {
+		t.Fatalf("toggle by GET should be refused: %d.", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/api/filter?host=direct.example.com", nil))
+	var info FilterInfo
+	err := json.Unmarshal(w.Body.Bytes(), &info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Enabled || info.Filters != 1 || !info.Direct {
+		t.Fatalf("filter info wrong: %+v.", info)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/api/filter?enabled=false", nil))
+	if w.Code != 200 || filter.enabled {
+		t.Fatalf("filter should be disabled: %d.", w.Code)
+	}
+}
+
+func TestAPITunnelsEmpty(t *testing.T) {
+	pool := NewPool()
+	w := httptest.NewRecorder()
+	pool.HandlerAPITunnels(w, httptest.NewRequest("GET", "/api/tunnels", nil))
+	if w.Body.String() != "[]\n" {
+		t.Fatalf("empty pool should be empty list: %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	pool.HandlerAPITunnelClose(w, httptest.NewRequest("POST", "/api/tunnels/close?tunnel=x", nil))
+	if w.Code != 404 {
+		t.Fatalf("close unknown tunnel should be 404: %d.", w.Code)
+	}
+}
@@ -3,6 +3,8 @@ package connpool
 import (
 	"math/rand"
 	"net"
+	"net/http"
+	"sort"
 	"sync"
 	"time"
 
@@ -10,41 +12,101 @@ import (
 	"github.com/shell909090/goproxy/tunnel"
 )
 
+type owner struct {
+	up     *Upstream
+	bytes  uint64
+	jitter float64
+}
+
+// use ulock to protect: MinSess, MaxConn, strategy, upstreams, owners,
+// maxage, maxbytes.
 type Dialer struct {
 	*Pool
-	MinSess  int
-	MaxConn  int
-	lock     sync.Mutex
-	creators []*tunnel.DialerCreator
+	MinSess   int
+	MaxConn   int
+	lock      sync.Mutex
+	ulock     sync.RWMutex
+	strategy  int
+	upstreams []*Upstream
+	owners    map[tunnel.Tunnel]*owner
+	maxage    time.Duration
+	maxbytes  uint64
 }
 
 func NewDialer(MinSess, MaxConn int) (dialer *Dialer) {
-	if MinSess == 0 {
-		MinSess = 0
-	}
-	if MaxConn == 0 {
-		MaxConn = 64
-	}
 	dialer = &Dialer{
-		Pool:    NewPool(),
-		MinSess: MinSess,
-		MaxConn: MaxConn,
+		Pool:   NewPool(),
+		owners: make(map[tunnel.Tunnel]*owner),
 	}
+	dialer.SetLimits(MinSess, MaxConn)
 	go dialer.loop()
 	return
 }
 
+// SetLimits sets tunnels kept at least, and streams in a tunnel more than
+// which a new one is created. 0 maxconn means 64.
+func (dialer *Dialer) SetLimits(minsess, maxconn int) {
+	if maxconn == 0 {
+		maxconn = 64
+	}
+	dialer.ulock.Lock()
+	defer dialer.ulock.Unlock()
+	dialer.MinSess = minsess
+	dialer.MaxConn = maxconn
+}
+
 func (dialer *Dialer) AddDialerCreator(orig *tunnel.DialerCreator) {
-	dialer.lock.Lock()
-	defer dialer.lock.Unlock()
-	dialer.creators = append(dialer.creators, orig)
+	dialer.ulock.Lock()
+	defer dialer.ulock.Unlock()
+	dialer.upstreams = append(dialer.upstreams, NewUpstream(orig, 1))
+}
+
+// SetUpstreams replaces all upstreams, used by reload.
+// Health of the same server is kept.
+// Tunnels already created keep running until they closed.
+func (dialer *Dialer) SetUpstreams(ups []*Upstream) {
+	dialer.ulock.Lock()
+	defer dialer.ulock.Unlock()
+	for _, up := range ups {
+		for _, old := range dialer.upstreams {
+			if old.String() == up.String() {
+				up.inherit(old)
+				break
+			}
+		}
+	}
+	dialer.upstreams = ups
+	logger.Noticef("upstreams replaced, %d upstream(s) now.", len(ups))
+}
+
+func (dialer *Dialer) SetStrategy(strategy int) {
+	dialer.ulock.Lock()
+	defer dialer.ulock.Unlock()
+	dialer.strategy = strategy
+}
+
+// SetRotation sets when a tunnel should be replaced, 0 means never.
+func (dialer *Dialer) SetRotation(maxage time.Duration, maxbytes uint64) {
+	dialer.ulock.Lock()
+	defer dialer.ulock.Unlock()
+	dialer.maxage = maxage
+	dialer.maxbytes = maxbytes
+}
+
+func (dialer *Dialer) GetUpstreams() (ups []*Upstream) {
+	// used by manager
+	dialer.ulock.RLock()
+	defer dialer.ulock.RUnlock()
+	return dialer.upstreams
 }
 
 // CAUTION: balance should run after loop begin
 // because creators are added one by one, it will take a while.
 func (dialer *Dialer) loop() {
 	for {
-		time.Sleep(60 * time.Second)
+		time.Sleep(BALANCE_INTERVAL * time.Second)
+		dialer.measure(BALANCE_INTERVAL * time.Second)
+		dialer.rotate()
 		err := dialer.balance()
 		if err != nil {
 			logger.Error(err.Error())
@@ -52,9 +114,77 @@ func (dialer *Dialer) loop() {
 	}
 }
 
+// measure rtt and throughput of upstreams from their tunnels,
+// upstreams without tunnel are probed.
+func (dialer *Dialer) measure(interval time.Duration) {
+	bytes := make(map[*Upstream]uint64)
+	rtts := make(map[*Upstream]time.Duration)
+
+	dialer.ulock.Lock()
+	for tun, o := range dialer.owners {
+		sent, recvd := tun.GetBytes()
+		bytes[o.up] += sent + recvd - o.bytes
+		o.bytes = sent + recvd
+		rtt, ok := rtts[o.up]
+		if !ok || tun.RTT() < rtt {
+			rtts[o.up] = tun.RTT()
+		}
+	}
+	ups := dialer.upstreams
+	dialer.ulock.Unlock()
+
+	for _, up := range ups {
+		rtt, ok := rtts[up]
+		if !ok {
+			if up.Available() {
+				go up.Probe()
+			}
+			continue
+		}
+		up.measured(float64(bytes[up])/interval.Seconds(), rtt)
+	}
+}
+
+// rotate replaces tunnels too old or carried too much. The old one is
+// drained, closed after streams in it finished.
+func (dialer *Dialer) rotate() {
+	var olds []tunnel.Tunnel
+	dialer.ulock.RLock()
+	for tun, o := range dialer.owners {
+		if tun.IsDraining() {
+			continue
+		}
+		maxage := time.Duration(float64(dialer.maxage) * o.jitter)
+		sent, recvd := tun.GetBytes()
+		switch {
+		case dialer.maxage > 0 && tun.Uptime() > maxage:
+		case dialer.maxbytes > 0 && sent+recvd > dialer.maxbytes:
+		default:
+			continue
+		}
+		olds = append(olds, tun)
+	}
+	dialer.ulock.RUnlock()
+
+	for _, tun := range olds {
+		logger.Noticef("rotate tunnel %s.", tun.String())
+		err := dialer.newTunnel(false)
+		if err != nil {
+			// keep old one if no replacement.
+			logger.Error(err.Error())
+			return
+		}
+		tun.Drain()
+	}
+}
+
 func (dialer *Dialer) balance() (err error) {
+	dialer.ulock.RLock()
+	minsess, maxconn := dialer.MinSess, dialer.MaxConn
+	dialer.ulock.RUnlock()
+
 	tsize := dialer.GetSize()
-	if tsize < dialer.MinSess {
+	if tsize < minsess {
 		logger.Info("create tunnel because tsize < minsess.")
 		err = dialer.newTunnel(false)
 		if err != nil {
@@ -63,25 +193,90 @@ func (dialer *Dialer) balance() (err error) {
 	}
 
 	_, fsize := dialer.getMinimum()
-	if fsize > dialer.MaxConn {
+	if fsize > maxconn {
 		logger.Info("create tunnel because fsize > maxconn.")
 		err = dialer.newTunnel(false)
 		if err != nil {
 			return
 		}
 	}
+
+	// fail back to primary when it recovered.
+	dialer.ulock.RLock()
+	sticky := dialer.strategy == SELECT_STICKY && dialer.GetSize() > 0
+	dialer.ulock.RUnlock()
+	if ups := dialer.ranked(); sticky && len(ups) > 0 && dialer.getTunnel(ups[0]) == nil {
+		logger.Infof("create tunnel because primary %s has none.", ups[0].String())
+		err = dialer.newTunnel(false)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// ranked returns available upstreams, the best first.
+func (dialer *Dialer) ranked() (ups []*Upstream) {
+	dialer.ulock.RLock()
+	all := dialer.upstreams
+	strategy := dialer.strategy
+	dialer.ulock.RUnlock()
+
+	scores := make(map[*Upstream]float64, len(all))
+	for i, up := range all {
+		if !up.Available() {
+			continue
+		}
+		ups = append(ups, up)
+		scores[up] = up.score(strategy, i)
+	}
+	sort.SliceStable(ups, func(i, j int) bool {
+		return scores[ups[i]] < scores[ups[j]]
+	})
+	return
+}
+
+// getTunnel returns the tunnel of up with minimum streams.
+func (dialer *Dialer) getTunnel(up *Upstream) (tun tunnel.Tunnel) {
+	size := -1
+	dialer.ulock.RLock()
+	defer dialer.ulock.RUnlock()
+	for t, o := range dialer.owners {
+		if o.up != up || t.IsDraining() {
+			continue
+		}
+		n := t.GetSize()
+		if size == -1 || n < size {
+			tun = t
+			size = n
+		}
+	}
 	return
 }
 
 // Get one or create one.
 func (dialer *Dialer) Get() (tun tunnel.Tunnel, err error) {
-	if dialer.GetSize() == 0 {
+	if tun, _ = dialer.getMinimum(); tun == nil {
 		err = dialer.newTunnel(true)
 		if err != nil {
 			return
 		}
 	}
 
+	dialer.ulock.RLock()
+	strategy := dialer.strategy
+	dialer.ulock.RUnlock()
+
+	if strategy != SELECT_RANDOM {
+		for _, up := range dialer.ranked() {
+			tun = dialer.getTunnel(up)
+			if tun != nil {
+				return
+			}
+		}
+	}
+
+	// tunnels of broken or removed upstreams are still better than nothing.
 	tun, _ = dialer.getMinimum()
 	if tun == nil {
 		err = ErrNoSession
@@ -90,31 +285,38 @@ func (dialer *Dialer) Get() (tun tunnel.Tunnel, err error) {
 	return
 }
 
-// Randomly select a server, try to connect with it. If it is failed, try next.
+// Try servers in order of strategy. If it is failed, try next.
 // Repeat for DIAL_RETRY times.
 // Each time it will take 2 ^ (net.ipv4.tcp_syn_retries + 1) - 1 second(s).
 // eg. net.ipv4.tcp_syn_retries = 4, connect will timeout in 2 ^ (4 + 1) -1 = 31s.
 func (dialer *Dialer) newTunnel(create bool) (err error) {
 	var tun tunnel.Tunnel
+	var up *Upstream
 	dialer.lock.Lock()
-	if create && (dialer.GetSize() != 0) {
+	if t, _ := dialer.getMinimum(); create && t != nil {
 		dialer.lock.Unlock()
 		logger.Debug("create first tunnel but already have one.")
 		return
 	}
 
-	if len(dialer.creators) == 0 {
+	ups := dialer.ranked()
+	if len(ups) == 0 {
 		dialer.lock.Unlock()
 		err = ErrNoCreator
+		if len(dialer.GetUpstreams()) != 0 {
+			err = ErrAllBroken
+		}
 		logger.Error(err.Error())
 		return
 	}
 
-	start := rand.Int()
-	end := start + DIAL_RETRY*len(dialer.creators)
-	for i := start; i < end; i++ {
-		orig := dialer.creators[i%len(dialer.creators)]
-		tun, err = orig.Create()
+	err = ErrAllBroken
+	for i := 0; i < DIAL_RETRY*len(ups); i++ {
+		up = ups[i%len(ups)]
+		if !up.Available() {
+			continue
+		}
+		tun, err = up.Create()
 		if err != nil {
 			logger.Error(err.Error())
 			continue
@@ -127,11 +329,20 @@ func (dialer *Dialer) newTunnel(create bool) (err error) {
 		logger.Critical("can't connect to any server, quit.")
 		return
 	}
-	logger.Notice("session created.")
+	logger.Noticef("session created to %s.", up.String())
+	dialer.addTunnel(tun, up)
+	return
+}
 
+func (dialer *Dialer) addTunnel(tun tunnel.Tunnel, up *Upstream) {
 	dialer.Add(tun)
+	dialer.ulock.Lock()
+	dialer.owners[tun] = &owner{
+		up:     up,
+		jitter: 1 + ROTATE_JITTER*(2*rand.Float64()-1),
+	}
+	dialer.ulock.Unlock()
 	go dialer.sessRun(tun)
-	return
 }
 
 // Don't need to check less session here.
@@ -141,6 +352,10 @@ func (dialer *Dialer) newTunnel(create bool) (err error) {
 // but we can think that as over max_conn line just happened.
 func (dialer *Dialer) sessRun(tun tunnel.Tunnel) {
 	defer func() {
+		dialer.ulock.Lock()
+		delete(dialer.owners, tun)
+		dialer.ulock.Unlock()
+
 		err := dialer.Remove(tun)
 		if err != nil {
 			logger.Error(err.Error())
@@ -163,3 +378,10 @@ func (dialer *Dialer) Dial(network, address string) (net.Conn, error) {
 	}
 	return d.Dial(network, address)
 }
+
+func (dialer *Dialer) Register(mux *http.ServeMux) {
+	dialer.Pool.Register(mux)
+	mux.HandleFunc("/upstreams", dialer.HandlerUpstreams)
+	mux.HandleFunc("/api/upstreams", dialer.HandlerAPIUpstreams)
+	mux.HandleFunc("/api/tunnels/create", dialer.HandlerAPITunnelCreate)
+}
@@ -34,14 +34,15 @@ const (
     </table>
     <table>
       <tr>
-	<th>Sess</th><th>Id</th><th>State</th><th width="50%">Target</th>
+	<th>Sess</th><th>Id</th><th>State</th><th>Window/RTT</th><th width="50%">Target</th>
       </tr>
       {{if .GetSize}}
       {{range $tun := .GetTunnels}}
       <tr>
 	<td>{{$tun.LocalAddr}}</td>
 	<td>{{$tun.GetSize}}</td>
-	<td>{{$tun.Uptime}}</td>
+	<td>{{$tun.Uptime}}{{if $tun.IsDraining}} draining{{end}}</td>
+	<td>{{$tun.RTT}}</td>
 	<td>{{$tun.RemoteAddr}}</td>
       </tr>
       {{range $conn := $tun.GetConnections}}
@@ -49,7 +50,8 @@ const (
 	{{with $conn}}
 	<td></td>
 	<td>{{$conn.GetStreamId}}</td>
-	<td>{{$conn.GetStatusString}}</td>
+	<td>{{$conn.GetStatusString}} {{$conn.GetPriorityString}}</td>
+	<td>{{$conn.GetWindowString}}</td>
 	<td>{{$conn.GetTarget}}</td>
 	{{else}}
 	<td></td>
@@ -63,6 +65,33 @@ const (
       {{end}}
     </table>
   </body>
+</html>`
+	str_upstreams = `
+<!DOCTYPE HTML PUBLIC "-//W3C//DTD HTML 4.01//EN" "http://www.w3.org/TR/html4/strict.dtd">
+<html>
+  <head>
+    <title>upstreams</title>
+    <meta http-equiv="Content-Type" content="text/html; charset=utf-8"/>
+    <meta name="author" content="Shell.Xu">
+  </head>
+  <body>
+    <table>
+      <tr>
+	<th>Server</th><th>Weight</th><th>RTT</th><th>Rate</th><th>State</th>
+      </tr>
+      {{range $up := .GetUpstreams}}
+      <tr>
+	<td>{{$up.String}}</td>
+	<td>{{$up.Weight}}</td>
+	<td>{{$up.GetRTT}}</td>
+	<td>{{$up.GetRate}}</td>
+	<td>{{$up.GetStatusString}}</td>
+      </tr>
+      {{else}}
+      <tr><td>no upstream</td></tr>
+      {{end}}
+    </table>
+  </body>
 </html>`
 	str_addrs = `
 <!DOCTYPE HTML PUBLIC "-//W3C//DTD HTML 4.01//EN" "http://www.w3.org/TR/html4/strict.dtd">
@@ -81,8 +110,9 @@ const (
 )
 
 var (
-	tmpl_sess *template.Template
-	tmpl_addr *template.Template
+	tmpl_sess      *template.Template
+	tmpl_upstreams *template.Template
+	tmpl_addr      *template.Template
 )
 
 func init() {
@@ -92,6 +122,11 @@ func init() {
 		panic(err)
 	}
 
+	tmpl_upstreams, err = template.New("upstreams").Parse(str_upstreams)
+	if err != nil {
+		panic(err)
+	}
+
 	tmpl_addr, err = template.New("address").Parse(str_addrs)
 	if err != nil {
 		panic(err)
@@ -106,6 +141,14 @@ func (pool *Pool) HandlerMain(w http.ResponseWriter, req *http.Request) {
 	return
 }
 
+func (dialer *Dialer) HandlerUpstreams(w http.ResponseWriter, req *http.Request) {
+	err := tmpl_upstreams.Execute(w, dialer)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+	return
+}
+
 func HandlerLookup(w http.ResponseWriter, req *http.Request) {
 	q := req.URL.Query()
 	hosts, ok := q["host"]
@@ -2,12 +2,14 @@ package connpool
 
 import (
 	"errors"
+	"io"
 	"net/http"
 	"net/http/pprof"
 	"sort"
 	"sync"
 
 	logging "github.com/op/go-logging"
+	"github.com/shell909090/goproxy/metrics"
 	"github.com/shell909090/goproxy/tunnel"
 )
 
@@ -15,12 +17,19 @@ const (
 	BALANCE_INTERVAL = 60
 	DIAL_RETRY       = 2
 	AUTH_TIMEOUT     = 10
+	BREAKER_FAILS    = 3
+	BREAKER_TIMEOUT  = 60
+	BREAKER_MAX      = 600
+	// max age of tunnels vary in +-ROTATE_JITTER.
+	ROTATE_JITTER = 0.1
 )
 
 var (
 	ErrNoSession       = errors.New("session in pool but can't pick one.")
 	ErrSessionNotFound = errors.New("session not found.")
 	ErrNoCreator       = errors.New("can't create tunnel with no creator.")
+	ErrAllBroken       = errors.New("all upstreams are broken.")
+	ErrProbing         = errors.New("upstream half open, and being tried.")
 )
 
 var (
@@ -54,11 +63,15 @@ func (pool *Pool) GetSize() int {
 	return len(pool.tunpool)
 }
 
+// getMinimum returns the tunnel with minimum streams, draining ones skipped.
 func (pool *Pool) getMinimum() (tun tunnel.Tunnel, size int) {
 	size = -1
 	pool.lock.RLock()
 	defer pool.lock.RUnlock()
 	for t, _ := range pool.tunpool {
+		if t.IsDraining() {
+			continue
+		}
 		n := t.GetSize()
 		if size == -1 || n < size {
 			tun = t
@@ -109,9 +122,42 @@ func (pool *Pool) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/", pool.HandlerMain)
 	mux.HandleFunc("/lookup", HandlerLookup)
 	mux.HandleFunc("/cutoff", pool.HandlerCutoff)
+	mux.HandleFunc("/metrics", metrics.Handler(pool.collect))
+	mux.HandleFunc("/api/tunnels", pool.HandlerAPITunnels)
+	mux.HandleFunc("/api/tunnels/close", pool.HandlerAPITunnelClose)
+	mux.HandleFunc("/api/streams/reset", pool.HandlerAPIStreamReset)
+	mux.HandleFunc("/api/dns", HandlerAPIDns)
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 }
+
+// collect gauges of tunnels in pool at scrape.
+func (pool *Pool) collect(w io.Writer) {
+	tuns := pool.GetTunnels()
+	metrics.WriteMetric(w, "goproxy_tunnels", "Tunnels in pool.", "gauge",
+		metrics.Sample{Value: float64(len(tuns))})
+
+	var streams, bytes []metrics.Sample
+	for _, t := range tuns {
+		name := t.String()
+		streams = append(streams, metrics.Sample{
+			Labels: []string{"tunnel", name},
+			Value:  float64(t.GetSize()),
+		})
+		sent, recvd := t.GetBytes()
+		bytes = append(bytes, metrics.Sample{
+			Labels: []string{"tunnel", name, "direction", "out"},
+			Value:  float64(sent),
+		}, metrics.Sample{
+			Labels: []string{"tunnel", name, "direction", "in"},
+			Value:  float64(recvd),
+		})
+	}
+	metrics.WriteMetric(w, "goproxy_tunnel_streams", "Streams in tunnel.",
+		"gauge", streams...)
+	metrics.WriteMetric(w, "goproxy_tunnel_bytes_total", "Bytes of tunnel.",
+		"counter", bytes...)
+}
@@ -2,50 +2,70 @@ package connpool
 
 import (
 	"net"
+	"net/http"
+	"sync"
 
+	"github.com/shell909090/goproxy/netutil"
+	"github.com/shell909090/goproxy/passwd"
 	"github.com/shell909090/goproxy/tunnel"
 )
 
 type Server struct {
 	*Pool
 	tunnel.Server
-	auth *map[string]string
+	alock      sync.RWMutex
+	author     passwd.Authenticator
+	Fallback   *netutil.Fallback
+	Accounting *Accounting
+	ACL        *ACL
 }
 
-func NewServer(auth *map[string]string) (server *Server) {
-	if auth != nil && len(*auth) == 0 {
-		auth = nil
-	}
+func NewServer(author passwd.Authenticator) (server *Server) {
 	server = &Server{
-		Pool: NewPool(),
-		auth: auth,
+		Pool:       NewPool(),
+		Accounting: NewAccounting(),
+		ACL:        NewACL(),
 	}
 	server.Server.Handler = server
+	server.SetAuth(author)
 	return
 }
 
+// SetAuth replaces authenticator, nil means no auth.
+// Tunnels already authed are not affected.
+func (server *Server) SetAuth(author passwd.Authenticator) {
+	server.alock.Lock()
+	defer server.alock.Unlock()
+	server.author = author
+}
+
 func (server *Server) AuthPass(username, password string) bool {
-	if server.auth == nil {
+	server.alock.RLock()
+	author := server.author
+	server.alock.RUnlock()
+
+	if author == nil {
 		return true
 	}
-	password1, ok := (*server.auth)[username]
-	if !ok {
-		return false
-	}
-	if password1 != password {
-		return false
-	}
-	return true
+	return author.AuthPass(username, password)
 }
 
 func (server *Server) Handle(conn net.Conn) (err error) {
-	err = tunnel.AuthConn(server, conn)
+	auth, err := tunnel.AuthConn(server, conn, server.Fallback != nil)
 	if err != nil {
 		logger.Error(err.Error())
+		// conn is decrypted already, what read is not for the decoy, and
+		// it has the password. Fallback works only in cryptconn, here
+		// it's just drained.
+		if server.Fallback != nil {
+			netutil.Drain(conn)
+		}
 		return
 	}
 
-	tun := tunnel.NewTunnelServer(conn)
+	tun := tunnel.NewTunnelServer(conn, auth.Flags)
+	tun.SetMeter(server.Accounting.Get(auth.Username))
+	tun.SetChecker(server.ACL.For(auth.Username))
 	server.Pool.Add(tun)
 	defer server.Pool.Remove(tun)
 	tun.Loop()
@@ -53,3 +73,8 @@ func (server *Server) Handle(conn net.Conn) (err error) {
 		tun.String(), conn.RemoteAddr(), conn.LocalAddr())
 	return
 }
+
+func (server *Server) Register(mux *http.ServeMux) {
+	server.Pool.Register(mux)
+	mux.HandleFunc("/api/accounts", server.HandlerAPIAccounts)
+}
@@ -0,0 +1,243 @@
+package connpool
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shell909090/goproxy/metrics"
+	"github.com/shell909090/goproxy/tunnel"
+)
+
+const (
+	SELECT_RANDOM = iota
+	SELECT_RTT
+	SELECT_LOAD
+	SELECT_WEIGHT
+	SELECT_STICKY
+)
+
+var StrategyText = map[int]string{
+	SELECT_RANDOM: "random",
+	SELECT_RTT:    "rtt",
+	SELECT_LOAD:   "load",
+	SELECT_WEIGHT: "weight",
+	SELECT_STICKY: "sticky",
+}
+
+func ParseStrategy(s string) (strategy int, err error) {
+	if s == "" {
+		return SELECT_RANDOM, nil
+	}
+	for st, text := range StrategyText {
+		if strings.ToLower(s) == text {
+			return st, nil
+		}
+	}
+	return SELECT_RANDOM, fmt.Errorf("unknown strategy: %s.", s)
+}
+
+// Upstream is a server with its health. After BREAKER_FAILS failures in a
+// row, it's broken for a while, and the while doubles each time it failed
+// again, up to BREAKER_MAX. After that, one more try is allowed, others
+// wait until it's finished.
+// use lock to protect: rtt, rate, failures, backoff, openUntil, probing.
+type Upstream struct {
+	*tunnel.DialerCreator
+	Weight int
+
+	lock      sync.Mutex
+	rtt       time.Duration
+	rate      float64
+	failures  int
+	backoff   time.Duration
+	openUntil time.Time
+	probing   bool
+}
+
+func NewUpstream(dc *tunnel.DialerCreator, weight int) (up *Upstream) {
+	if weight <= 0 {
+		weight = 1
+	}
+	return &Upstream{
+		DialerCreator: dc,
+		Weight:        weight,
+	}
+}
+
+func (up *Upstream) Available() bool {
+	up.lock.Lock()
+	defer up.lock.Unlock()
+	switch {
+	case up.failures < BREAKER_FAILS:
+		return true
+	case time.Now().Before(up.openUntil):
+		return false
+	default:
+		return !up.probing
+	}
+}
+
+// trial takes the only try when half open, false if it's taken.
+func (up *Upstream) trial() bool {
+	up.lock.Lock()
+	defer up.lock.Unlock()
+	if up.failures < BREAKER_FAILS || time.Now().Before(up.openUntil) {
+		return true
+	}
+	if up.probing {
+		return false
+	}
+	up.probing = true
+	return true
+}
+
+var createSeconds = metrics.NewHistogramVec(
+	"goproxy_tunnel_create_seconds", "Latency of creating tunnels.",
+	nil, "upstream", "result")
+
+// Create a tunnel, and record it as a probe.
+func (up *Upstream) Create() (client *tunnel.Client, err error) {
+	if !up.trial() {
+		return nil, ErrProbing
+	}
+	start := time.Now()
+	client, err = up.DialerCreator.Create()
+	if err != nil {
+		createSeconds.Observe(time.Since(start).Seconds(), up.String(), "failed")
+		up.failure()
+		return
+	}
+	createSeconds.Observe(time.Since(start).Seconds(), up.String(), "ok")
+	up.success(client.RTT())
+	return
+}
+
+func (up *Upstream) Probe() {
+	if !up.trial() {
+		return
+	}
+	rtt, err := up.DialerCreator.Probe()
+	if err != nil {
+		logger.Errorf("probe %s failed: %s.", up.String(), err.Error())
+		up.failure()
+		return
+	}
+	up.success(rtt)
+}
+
+func (up *Upstream) success(rtt time.Duration) {
+	up.lock.Lock()
+	defer up.lock.Unlock()
+	if up.failures >= BREAKER_FAILS {
+		logger.Noticef("upstream %s recovered.", up.String())
+	}
+	up.failures = 0
+	up.backoff = 0
+	up.probing = false
+	up.setRTT(rtt)
+}
+
+// call with up.lock.
+func (up *Upstream) setRTT(rtt time.Duration) {
+	if up.rtt == 0 {
+		up.rtt = rtt
+		return
+	}
+	up.rtt = (7*up.rtt + rtt) / 8
+}
+
+func (up *Upstream) failure() {
+	up.lock.Lock()
+	defer up.lock.Unlock()
+	up.probing = false
+	up.failures++
+	if up.failures < BREAKER_FAILS {
+		return
+	}
+
+	up.backoff *= 2
+	if up.backoff < BREAKER_TIMEOUT*time.Second {
+		up.backoff = BREAKER_TIMEOUT * time.Second
+	}
+	if up.backoff > BREAKER_MAX*time.Second {
+		up.backoff = BREAKER_MAX * time.Second
+	}
+	up.openUntil = time.Now().Add(up.backoff)
+	logger.Warningf("upstream %s failed %d times, broken for %s.",
+		up.String(), up.failures, up.backoff)
+}
+
+// measured from tunnels of this upstream.
+func (up *Upstream) measured(rate float64, rtt time.Duration) {
+	up.lock.Lock()
+	defer up.lock.Unlock()
+	up.rate = rate
+	up.setRTT(rtt)
+}
+
+func (up *Upstream) inherit(old *Upstream) {
+	old.lock.Lock()
+	defer old.lock.Unlock()
+	up.lock.Lock()
+	defer up.lock.Unlock()
+	up.rtt = old.rtt
+	up.rate = old.rate
+	up.failures = old.failures
+	up.backoff = old.backoff
+	up.openUntil = old.openUntil
+}
+
+// score of upstream in strategy, lower is better.
+func (up *Upstream) score(strategy, index int) float64 {
+	up.lock.Lock()
+	defer up.lock.Unlock()
+	switch strategy {
+	case SELECT_RTT:
+		if up.rtt == 0 {
+			// not measured yet, try it after measured ones.
+			return math.MaxFloat64 / 2
+		}
+		return float64(up.rtt)
+	case SELECT_LOAD:
+		return up.rate
+	case SELECT_WEIGHT:
+		// weighted random order, Efraimidis-Spirakis.
+		return -math.Log(1-rand.Float64()) / float64(up.Weight)
+	case SELECT_STICKY:
+		return float64(index)
+	default:
+		return rand.Float64()
+	}
+}
+
+func (up *Upstream) GetRTT() time.Duration {
+	// used by manager
+	up.lock.Lock()
+	defer up.lock.Unlock()
+	return up.rtt
+}
+
+func (up *Upstream) GetRate() string {
+	// used by manager
+	up.lock.Lock()
+	defer up.lock.Unlock()
+	return fmt.Sprintf("%.1fKB/s", up.rate/1024)
+}
+
+func (up *Upstream) GetStatusString() string {
+	// used by manager
+	up.lock.Lock()
+	defer up.lock.Unlock()
+	switch {
+	case up.failures == 0:
+		return "ok"
+	case up.failures < BREAKER_FAILS || time.Now().After(up.openUntil):
+		return fmt.Sprintf("failed %d", up.failures)
+	default:
+		return fmt.Sprintf("broken until %s", up.openUntil.Format("15:04:05"))
+	}
+}
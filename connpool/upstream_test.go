@@ -0,0 +1,100 @@
+package connpool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+	"github.com/shell909090/goproxy/tunnel"
+)
+
+func newTestUpstream(addr string, weight int) *Upstream {
+	dc := tunnel.NewDialerCreator(netutil.DefaultTcpDialer, "tcp4", addr, "", "")
+	return NewUpstream(dc, weight)
+}
+
+func TestBreaker(t *testing.T) {
+	tunnel.SetLogging()
+	up := newTestUpstream("127.0.0.1:1", 1)
+
+	for i := 0; i < BREAKER_FAILS-1; i++ {
+		up.failure()
+	}
+	if !up.Available() {
+		t.Fatal("upstream broken too early.")
+	}
+
+	up.failure()
+	if up.Available() {
+		t.Fatal("upstream should be broken.")
+	}
+
+	// timeout passed, half open.
+	up.openUntil = time.Now().Add(-time.Second)
+	if !up.Available() {
+		t.Fatal("upstream should be half open.")
+	}
+	if !up.trial() || up.trial() || up.Available() {
+		t.Fatal("only one try should be allowed when half open.")
+	}
+	up.failure()
+	if up.Available() || up.backoff != 2*BREAKER_TIMEOUT*time.Second {
+		t.Fatalf("upstream should be broken longer: %s.", up.backoff)
+	}
+
+	up.success(10 * time.Millisecond)
+	if !up.Available() || up.GetRTT() != 10*time.Millisecond {
+		t.Fatal("upstream should recover.")
+	}
+}
+
+func TestRanked(t *testing.T) {
+	tunnel.SetLogging()
+	dialer := &Dialer{
+		Pool:   NewPool(),
+		owners: make(map[tunnel.Tunnel]*owner),
+	}
+	ups := []*Upstream{
+		newTestUpstream("127.0.0.1:1", 1),
+		newTestUpstream("127.0.0.1:2", 1),
+		newTestUpstream("127.0.0.1:3", 100),
+	}
+	ups[0].success(30 * time.Millisecond)
+	ups[1].success(10 * time.Millisecond)
+	ups[2].success(20 * time.Millisecond)
+	dialer.SetUpstreams(ups)
+
+	dialer.SetStrategy(SELECT_RTT)
+	if r := dialer.ranked(); r[0] != ups[1] || r[1] != ups[2] {
+		t.Fatal("rtt strategy should take the fastest.")
+	}
+
+	dialer.SetStrategy(SELECT_STICKY)
+	if dialer.ranked()[0] != ups[0] {
+		t.Fatal("sticky strategy should take the first.")
+	}
+	for i := 0; i < BREAKER_FAILS; i++ {
+		ups[0].failure()
+	}
+	if r := dialer.ranked(); len(r) != 2 || r[0] != ups[1] {
+		t.Fatal("sticky strategy should fail over.")
+	}
+
+	dialer.SetStrategy(SELECT_WEIGHT)
+	count := 0
+	for i := 0; i < 100; i++ {
+		if dialer.ranked()[0] == ups[2] {
+			count++
+		}
+	}
+	if count < 80 {
+		t.Fatalf("weight strategy picked heavy one only %d times.", count)
+	}
+
+	// health kept after reload.
+	newups := []*Upstream{newTestUpstream("127.0.0.1:1", 1)}
+	dialer.SetUpstreams(newups)
+	if newups[0].Available() {
+		t.Fatal("health should be kept after reload.")
+	}
+}
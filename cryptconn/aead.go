@@ -0,0 +1,164 @@
+package cryptconn
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	MAX_RECORD = 0x3fff
+)
+
+var (
+	ErrUnknownMethod = errors.New("unknown crypt method.")
+	ErrRecordAuth    = errors.New("record authentication failed.")
+)
+
+func IsAead(method string) bool {
+	switch method {
+	case "aes-gcm", "chacha20-poly1305":
+		return true
+	}
+	return false
+}
+
+func NewAead(method string, key []byte) (aead cipher.AEAD, err error) {
+	logger.Debugf("Aead Wrapper with %s preparing.", method)
+	switch method {
+	case "aes-gcm":
+		var block cipher.Block
+		block, err = aes.NewCipher(key)
+		if err != nil {
+			return
+		}
+		aead, err = cipher.NewGCM(block)
+	case "chacha20-poly1305":
+		aead, err = chacha20poly1305.New(key)
+	default:
+		err = ErrUnknownMethod
+	}
+	return
+}
+
+// AeadConn splits stream into records. Each record is:
+// sealed 2 bytes length, sealed payload.
+// Each direction has its own session key, nonce starts from zero and
+// increases after each seal.
+type AeadConn struct {
+	net.Conn
+	in     cipher.AEAD
+	out    cipher.AEAD
+	rlock  sync.Mutex
+	rnonce []byte
+	rbuf   []byte
+	rest   []byte
+	wlock  sync.Mutex
+	wnonce []byte
+	wbuf   []byte
+}
+
+func NewAeadConn(conn net.Conn, in, out cipher.AEAD) (ac *AeadConn) {
+	ac = &AeadConn{
+		Conn:   conn,
+		in:     in,
+		out:    out,
+		rnonce: make([]byte, in.NonceSize()),
+		rbuf:   make([]byte, 2+MAX_RECORD+2*in.Overhead()),
+		wnonce: make([]byte, out.NonceSize()),
+		wbuf:   make([]byte, 2+MAX_RECORD+2*out.Overhead()),
+	}
+	return
+}
+
+func increase(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func (ac *AeadConn) open(dst, b []byte) (p []byte, err error) {
+	p, err = ac.in.Open(dst, ac.rnonce, b, nil)
+	if err != nil {
+		return nil, ErrRecordAuth
+	}
+	increase(ac.rnonce)
+	return
+}
+
+func (ac *AeadConn) readRecord() (err error) {
+	overhead := ac.in.Overhead()
+
+	hdr := ac.rbuf[:2+overhead]
+	_, err = io.ReadFull(ac.Conn, hdr)
+	if err != nil {
+		return
+	}
+	hdr, err = ac.open(hdr[:0], hdr)
+	if err != nil {
+		return
+	}
+
+	size := int(binary.BigEndian.Uint16(hdr)) & MAX_RECORD
+	payload := ac.rbuf[2+overhead : 2+overhead+size+overhead]
+	_, err = io.ReadFull(ac.Conn, payload)
+	if err != nil {
+		return
+	}
+	ac.rest, err = ac.open(payload[:0], payload)
+	return
+}
+
+func (ac *AeadConn) Read(b []byte) (n int, err error) {
+	ac.rlock.Lock()
+	defer ac.rlock.Unlock()
+
+	for len(ac.rest) == 0 {
+		err = ac.readRecord()
+		if err != nil {
+			return
+		}
+	}
+
+	n = copy(b, ac.rest)
+	ac.rest = ac.rest[n:]
+	return
+}
+
+func (ac *AeadConn) Write(b []byte) (n int, err error) {
+	ac.wlock.Lock()
+	defer ac.wlock.Unlock()
+
+	overhead := ac.out.Overhead()
+	for len(b) > 0 {
+		size := len(b)
+		if size > MAX_RECORD {
+			size = MAX_RECORD
+		}
+
+		buf := ac.wbuf[:2]
+		binary.BigEndian.PutUint16(buf, uint16(size))
+		buf = ac.out.Seal(buf[:0], ac.wnonce, buf, nil)
+		increase(ac.wnonce)
+
+		buf = ac.out.Seal(buf, ac.wnonce, b[:size], nil)
+		increase(ac.wnonce)
+
+		_, err = ac.Conn.Write(buf[:2+size+2*overhead])
+		if err != nil {
+			return
+		}
+		b = b[size:]
+		n += size
+	}
+	return
+}
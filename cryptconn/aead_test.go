@@ -0,0 +1,284 @@
+package cryptconn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+	"github.com/shell909090/goproxy/tunnel"
+)
+
+type flipConn struct {
+	net.Conn
+	flip bool
+}
+
+func (fc *flipConn) Write(b []byte) (n int, err error) {
+	if !fc.flip {
+		return fc.Conn.Write(b)
+	}
+	p := append([]byte(nil), b...)
+	p[len(p)-1] ^= 0x01
+	return fc.Conn.Write(p)
+}
+
+func randomKey(t *testing.T, n int) string {
+	key := make([]byte, n)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func echoListener(t *testing.T, method, key string) (l *Listener) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err = NewListener(raw, method, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return
+}
+
+func testMethod(t *testing.T, method string, keysize int) {
+	key := randomKey(t, keysize)
+	l := echoListener(t, method, key)
+	defer l.Close()
+
+	d, err := NewDialer(netutil.DefaultTcpDialer, method, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	data := make([]byte, 3*MAX_RECORD+100)
+	rand.Read(data)
+	// legacy modes encrypt in place, keep data untouched.
+	go conn.Write(append([]byte(nil), data...))
+
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatalf("%s: data not match.", method)
+	}
+}
+
+func TestAead(t *testing.T) {
+	tunnel.SetLogging()
+	testMethod(t, "aes-gcm", 16)
+	testMethod(t, "chacha20-poly1305", 32)
+	testMethod(t, "aes", 16)
+}
+
+func TestAeadTamper(t *testing.T) {
+	tunnel.SetLogging()
+	key := randomKey(t, 16)
+	psk, _ := base64.StdEncoding.DecodeString(key)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	ch := make(chan error, 1)
+	go func() {
+		raw, err := listener.Accept()
+		if err != nil {
+			ch <- err
+			return
+		}
+		defer raw.Close()
+		conn, err := ServerHandshake(raw, "aes-gcm", psk, nil)
+		if err != nil {
+			ch <- err
+			return
+		}
+		var buf [100]byte
+		_, err = conn.Read(buf[:])
+		ch <- err
+	}()
+
+	raw, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	fc := &flipConn{Conn: raw}
+	conn, err := ClientHandshake(fc, "aes-gcm", psk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc.flip = true
+	conn.Write([]byte("foobar"))
+
+	if err = <-ch; err != ErrRecordAuth {
+		t.Fatalf("tampered record should be rejected, got %v.", err)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	tunnel.SetLogging()
+	l := echoListener(t, "chacha20-poly1305", randomKey(t, 32))
+	defer l.Close()
+
+	d, err := NewDialer(
+		netutil.DefaultTcpDialer, "chacha20-poly1305", randomKey(t, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Dial("tcp", l.Addr().String())
+	if err == nil {
+		t.Fatalf("dial with wrong key should failed.")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	rf := NewReplayFilter(MAX_SKEW)
+	nonce := []byte("nonce")
+	if !rf.Check(nonce, time.Now()) {
+		t.Fatalf("first hello should pass.")
+	}
+	if rf.Check(nonce, time.Now()) {
+		t.Fatalf("replayed hello should be rejected.")
+	}
+	if rf.Check([]byte("other"), time.Now().Add(-2*MAX_SKEW)) {
+		t.Fatalf("old hello should be rejected.")
+	}
+}
+
+func TestReplayFallback(t *testing.T) {
+	tunnel.SetLogging()
+	key := randomKey(t, 16)
+	psk, _ := base64.StdEncoding.DecodeString(key)
+
+	decoy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoy.Close()
+	ch := make(chan []byte, 1)
+	go func() {
+		conn, err := decoy.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, HELLOSIZE)
+		io.ReadFull(conn, buf)
+		ch <- buf
+	}()
+
+	l := echoListener(t, "aes-gcm", key)
+	defer l.Close()
+	l.Fallback, err = netutil.NewFallback(netutil.FALLBACK_DECOY, decoy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// capture a hello and replay it.
+	rec := &recordWriter{}
+	ClientHandshake(rec, "aes-gcm", psk)
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write(rec.Bytes())
+		if i == 0 {
+			var resp [SALTSIZE + PROOFSIZE]byte
+			_, err = io.ReadFull(conn, resp[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if !bytes.Equal(<-ch, rec.Bytes()) {
+		t.Fatalf("replayed hello should be forwarded to decoy.")
+	}
+}
+
+// a client idle in handshake shouldn't block others.
+func TestAcceptIdle(t *testing.T) {
+	tunnel.SetLogging()
+	for _, method := range []string{"aes", "aes-gcm"} {
+		key := randomKey(t, 16)
+		l := echoListener(t, method, key)
+		defer l.Close()
+
+		idle, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer idle.Close()
+
+		d, err := NewDialer(netutil.DefaultTcpDialer, method, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := d.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		conn.SetDeadline(time.Now().Add(time.Second))
+		_, err = conn.Write([]byte("ping"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf [4]byte
+		_, err = io.ReadFull(conn, buf[:])
+		if err != nil {
+			t.Fatalf("%s blocked by idle client: %s", method, err)
+		}
+	}
+}
+
+type recordWriter struct {
+	net.Conn
+	bytes.Buffer
+}
+
+func (rw *recordWriter) Write(b []byte) (int, error) {
+	return rw.Buffer.Write(b)
+}
+
+func (rw *recordWriter) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (rw *recordWriter) SetDeadline(t time.Time) error {
+	return nil
+}
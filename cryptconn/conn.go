@@ -92,6 +92,10 @@ func XOR(n int, a []byte, b []byte) (r []byte) {
 	return
 }
 
+// Legacy modes (aes/des/tripledes) are deprecated, kept for old clients.
+// They use the key directly, can't reject a wrong key in handshake, and
+// have no replay protection. Aead modes have all of these, see handshake.go.
+
 // It is not safe to do like this. Each time session's security key should be
 // generated and used just for one time. So we can make sure that attacker
 // who recorded everything will never recover data back even he cracked key.
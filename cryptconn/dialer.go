@@ -2,6 +2,7 @@ package cryptconn
 
 import (
 	"crypto/cipher"
+	"encoding/base64"
 	"net"
 
 	"github.com/shell909090/goproxy/netutil"
@@ -9,29 +10,48 @@ import (
 
 type Dialer struct {
 	netutil.Dialer
-	block cipher.Block
+	method string
+	psk    []byte
+	block  cipher.Block
 }
 
 func NewDialer(dialer netutil.Dialer, method string, key string) (d *Dialer, err error) {
 	logger.Infof("Crypt Dialer with %s preparing.", method)
-	c, err := NewBlock(method, key)
-	if err != nil {
-		return
-	}
-
 	d = &Dialer{
 		Dialer: dialer,
-		block:  c,
+		method: method,
+	}
+
+	if IsAead(method) {
+		d.psk, err = base64.StdEncoding.DecodeString(key)
+		if err == nil {
+			err = CheckKey(method, d.psk)
+		}
+	} else {
+		logger.Warningf("%s is deprecated, use aes-gcm or chacha20-poly1305.", method)
+		d.block, err = NewBlock(method, key)
+	}
+	if err != nil {
+		return nil, err
 	}
 	return
 }
 
 func (d *Dialer) Dial(network, addr string) (conn net.Conn, err error) {
 	logger.Infof("Ctypt Dailer connect %s", addr)
-	conn, err = d.Dialer.Dial(network, addr)
+	raw, err := d.Dialer.Dial(network, addr)
 	if err != nil {
 		return
 	}
 
-	return NewClient(conn, d.block)
+	if d.block != nil {
+		return NewClient(raw, d.block)
+	}
+
+	conn, err = ClientHandshake(raw, d.method, d.psk)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return
 }
@@ -0,0 +1,197 @@
+package cryptconn
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	SALTSIZE   = 32
+	PROOFSIZE  = sha256.Size
+	HELLOSIZE  = SALTSIZE + 8 + PROOFSIZE
+	KDF_INFO   = "goproxy cryptconn v1"
+	HELLO_INFO = "goproxy cryptconn hello"
+	PROOF_SRV  = "server"
+	AUTHKEYLEN = 32
+	MAX_SKEW   = 120 * time.Second
+)
+
+var (
+	ErrHandshake = errors.New("handshake failed, key mismatch.")
+	ErrReplay    = errors.New("handshake replayed or clock skewed.")
+	ErrEmptyKey  = errors.New("empty key.")
+)
+
+// PSK handshake for aead modes, client speaks first:
+//
+//  1. client sends hello: salt, timestamp, HMAC(hello key, salt + timestamp).
+//     hello key is derived from psk only.
+//     server verifies it, checks timestamp and salt in replay filter.
+//  2. server sends its salt and HMAC(auth key, "server").
+//  3. HKDF(psk, client salt + server salt) derives auth key,
+//     client write key and server write key.
+//
+// Wrong key is detected in one round trip, and every session has fresh keys.
+// Server sends nothing until client proved it holds the key.
+type SessionKeys struct {
+	auth []byte
+	cli  []byte
+	srv  []byte
+}
+
+func aeadKeySize(method string, psk []byte) int {
+	if method == "chacha20-poly1305" {
+		return chacha20poly1305.KeySize
+	}
+	return len(psk)
+}
+
+func DeriveKeys(method string, psk, csalt, ssalt []byte) (keys *SessionKeys, err error) {
+	salt := make([]byte, 0, len(csalt)+len(ssalt))
+	salt = append(salt, csalt...)
+	salt = append(salt, ssalt...)
+	kdf := hkdf.New(sha256.New, psk, salt, []byte(KDF_INFO))
+
+	size := aeadKeySize(method, psk)
+	keys = &SessionKeys{
+		auth: make([]byte, AUTHKEYLEN),
+		cli:  make([]byte, size),
+		srv:  make([]byte, size),
+	}
+	for _, k := range [][]byte{keys.auth, keys.cli, keys.srv} {
+		_, err = io.ReadFull(kdf, k)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (keys *SessionKeys) Proof(role string) []byte {
+	mac := hmac.New(sha256.New, keys.auth)
+	mac.Write([]byte(role))
+	return mac.Sum(nil)
+}
+
+func helloMAC(psk, b []byte) []byte {
+	key := make([]byte, AUTHKEYLEN)
+	io.ReadFull(hkdf.New(sha256.New, psk, nil, []byte(HELLO_INFO)), key)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return mac.Sum(nil)
+}
+
+func writeFull(conn net.Conn, b []byte) (err error) {
+	n, err := conn.Write(b)
+	if err != nil {
+		return
+	}
+	if n != len(b) {
+		return io.ErrShortWrite
+	}
+	return
+}
+
+func newAeadConn(conn net.Conn, method string, inkey, outkey []byte) (ac *AeadConn, err error) {
+	in, err := NewAead(method, inkey)
+	if err != nil {
+		return
+	}
+	out, err := NewAead(method, outkey)
+	if err != nil {
+		return
+	}
+	ac = NewAeadConn(conn, in, out)
+	return
+}
+
+func ClientHandshake(conn net.Conn, method string, psk []byte) (ac *AeadConn, err error) {
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	hello := make([]byte, SALTSIZE+8, HELLOSIZE)
+	_, err = rand.Read(hello[:SALTSIZE])
+	if err != nil {
+		return
+	}
+	binary.BigEndian.PutUint64(hello[SALTSIZE:], uint64(time.Now().Unix()))
+	hello = append(hello, helloMAC(psk, hello)...)
+
+	err = writeFull(conn, hello)
+	if err != nil {
+		return
+	}
+
+	resp := make([]byte, SALTSIZE+PROOFSIZE)
+	_, err = io.ReadFull(conn, resp)
+	if err != nil {
+		return
+	}
+
+	keys, err := DeriveKeys(method, psk, hello[:SALTSIZE], resp[:SALTSIZE])
+	if err != nil {
+		return
+	}
+	if !hmac.Equal(resp[SALTSIZE:], keys.Proof(PROOF_SRV)) {
+		return nil, ErrHandshake
+	}
+
+	return newAeadConn(conn, method, keys.srv, keys.cli)
+}
+
+// ServerHandshake checks hello with filter if it's not nil.
+func ServerHandshake(conn net.Conn, method string, psk []byte, filter *ReplayFilter) (ac *AeadConn, err error) {
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	hello := make([]byte, HELLOSIZE)
+	_, err = io.ReadFull(conn, hello)
+	if err != nil {
+		return
+	}
+
+	csalt := hello[:SALTSIZE]
+	if !hmac.Equal(hello[SALTSIZE+8:], helloMAC(psk, hello[:SALTSIZE+8])) {
+		logger.Errorf("client %s failed to prove key.", conn.RemoteAddr())
+		return nil, ErrHandshake
+	}
+
+	ts := time.Unix(int64(binary.BigEndian.Uint64(hello[SALTSIZE:])), 0)
+	if filter != nil && !filter.Check(csalt, ts) {
+		logger.Errorf("client %s replayed hello.", conn.RemoteAddr())
+		return nil, ErrReplay
+	}
+
+	ssalt, err := SentIV(conn, SALTSIZE)
+	if err != nil {
+		return
+	}
+	keys, err := DeriveKeys(method, psk, csalt, ssalt)
+	if err != nil {
+		return
+	}
+	err = writeFull(conn, keys.Proof(PROOF_SRV))
+	if err != nil {
+		return
+	}
+
+	return newAeadConn(conn, method, keys.cli, keys.srv)
+}
+
+// CheckKey make sure method and psk could build a cipher.
+func CheckKey(method string, psk []byte) (err error) {
+	if len(psk) == 0 {
+		return ErrEmptyKey
+	}
+	_, err = NewAead(method, make([]byte, aeadKeySize(method, psk)))
+	return
+}
@@ -2,40 +2,129 @@ package cryptconn
 
 import (
 	"crypto/cipher"
+	"encoding/base64"
+	"errors"
 	"net"
+	"sync"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+var (
+	ErrClosed = errors.New("listener closed.")
 )
 
+// Listener does handshakes in goroutines of each connection, so a client
+// idle in handshake won't block others. Connections handshaked are passed
+// to Accept by conns.
 type Listener struct {
 	net.Listener
-	block cipher.Block
+	method   string
+	psk      []byte
+	block    cipher.Block
+	filter   *ReplayFilter
+	Fallback *netutil.Fallback
+	once     sync.Once
+	conns    chan net.Conn
+	errs     chan error
+	done     chan struct{}
+	closed   sync.Once
 }
 
 func NewListener(listener net.Listener, method string, key string) (l *Listener, err error) {
 	logger.Infof("Crypt Listener with %s preparing.", method)
-	c, err := NewBlock(method, key)
-	if err != nil {
-		return
-	}
-
 	l = &Listener{
 		Listener: listener,
-		block:    c,
+		method:   method,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+
+	if IsAead(method) {
+		l.psk, err = base64.StdEncoding.DecodeString(key)
+		if err == nil {
+			err = CheckKey(method, l.psk)
+		}
+		l.filter = NewReplayFilter(MAX_SKEW)
+	} else {
+		logger.Warningf("%s is deprecated, use aes-gcm or chacha20-poly1305.", method)
+		l.block, err = NewBlock(method, key)
+	}
+	if err != nil {
+		return nil, err
 	}
 	return
 }
 
 func (l *Listener) Accept() (conn net.Conn, err error) {
+	l.once.Do(func() { go l.loop() })
+	select {
+	case conn = <-l.conns:
+		return
+	case err = <-l.errs:
+		return
+	case <-l.done:
+		return nil, ErrClosed
+	}
+}
+
+func (l *Listener) Close() (err error) {
+	l.closed.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// loop accepts and starts handshakes. Errors are passed to Accept, a
+// permanent one is returned to every Accept after.
+func (l *Listener) loop() {
 	for {
-		conn, err = l.Listener.Accept()
+		raw, err := l.Listener.Accept()
+		if err == nil {
+			go l.handshake(raw)
+			continue
+		}
+
+		for {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				break
+			}
+		}
+	}
+}
+
+func (l *Listener) handshake(raw net.Conn) {
+	var conn net.Conn
+	var err error
+	if l.block != nil {
+		conn, err = NewServer(raw, l.block)
 		if err != nil {
+			logger.Error(err.Error())
+			raw.Close()
 			return
 		}
-
-		conn, err = NewServer(conn, l.block)
-		if err == nil {
+	} else {
+		rconn := netutil.NewRecordConn(raw)
+		conn, err = ServerHandshake(rconn, l.method, l.psk, l.filter)
+		if err != nil {
+			logger.Error(err.Error())
+			if l.Fallback != nil {
+				l.Fallback.Handle(raw, rconn.Recorded())
+				return
+			}
+			raw.Close()
 			return
 		}
-		logger.Error(err.Error())
+		rconn.StopRecord()
+	}
+
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
 	}
-	return
 }
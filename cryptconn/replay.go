@@ -0,0 +1,52 @@
+package cryptconn
+
+import (
+	"sync"
+	"time"
+)
+
+// ReplayFilter remembers nonces seen in the last window.
+// Nonces with timestamp out of window are rejected by caller, so anything
+// older than 2 windows can be forgotten.
+type ReplayFilter struct {
+	lock   sync.Mutex
+	window time.Duration
+	seen   map[string]time.Time
+	purged time.Time
+}
+
+func NewReplayFilter(window time.Duration) (rf *ReplayFilter) {
+	rf = &ReplayFilter{
+		window: window,
+		seen:   make(map[string]time.Time, 0),
+		purged: time.Now(),
+	}
+	return
+}
+
+// Check returns false if ts out of window, or nonce been seen.
+func (rf *ReplayFilter) Check(nonce []byte, ts time.Time) bool {
+	now := time.Now()
+	if ts.Before(now.Add(-rf.window)) || ts.After(now.Add(rf.window)) {
+		return false
+	}
+
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+
+	if now.Sub(rf.purged) > rf.window {
+		for k, t := range rf.seen {
+			if now.Sub(t) > 2*rf.window {
+				delete(rf.seen, k)
+			}
+		}
+		rf.purged = now
+	}
+
+	key := string(nonce)
+	if _, ok := rf.seen[key]; ok {
+		return false
+	}
+	rf.seen[key] = now
+	return true
+}
@@ -0,0 +1,295 @@
+package dns
+
+import (
+	"container/list"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/shell909090/goproxy/metrics"
+)
+
+const (
+	CACHE_SIZE = 4096
+	// ttl longer than this is cut, in seconds.
+	CACHE_MAX_TTL = 86400
+	// negative answers are cached no longer than this, rfc 2308.
+	CACHE_MAX_NEGATIVE_TTL = 10800
+	// expired answers could be served in this time, when refreshing, rfc 8767.
+	CACHE_STALE_TTL = 3600
+	// ttl of stale answers.
+	CACHE_STALE_ANSWER_TTL = 30
+	// hits an answer got before prefetched.
+	CACHE_PREFETCH_HITS = 3
+)
+
+var (
+	ErrNoResolver = errors.New("no exchanger to resolve.")
+)
+
+var cacheCount = metrics.NewCounterVec(
+	"goproxy_dns_cache_total", "DNS cache lookups by result.", "result")
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type cacheEntry struct {
+	key        cacheKey
+	resp       *dns.Msg
+	stored     time.Time
+	expire     time.Time
+	hits       int
+	refreshing bool
+}
+
+// Cache is an Exchanger caching answers of another one by ttl. Negative
+// answers with SOA are cached too. Popular answers are refreshed before
+// expired, and expired ones are served while refreshing.
+// use lock to protect: entries, lru, fields of entries.
+type Cache struct {
+	Resolver
+	exchanger Exchanger
+	lock      sync.Mutex
+	entries   map[cacheKey]*list.Element
+	lru       *list.List
+}
+
+// NewCache creates cache of exchanger. Nil means DefaultResolver, which is
+// looked up at every query, so it could be replaced after.
+func NewCache(exchanger Exchanger) (c *Cache) {
+	c = &Cache{
+		exchanger: exchanger,
+		entries:   make(map[cacheKey]*list.Element),
+		lru:       list.New(),
+	}
+	c.Resolver = &WrapExchanger{Exchanger: c}
+	return
+}
+
+// DefaultCache is shared by filters and dns server.
+var DefaultCache = NewCache(nil)
+
+func (c *Cache) getExchanger() (exhg Exchanger, err error) {
+	if c.exchanger != nil {
+		return c.exchanger, nil
+	}
+	exhg, ok := DefaultResolver.(Exchanger)
+	if !ok {
+		return nil, ErrNoResolver
+	}
+	return
+}
+
+// cacheable returns ttl of answer in seconds, 0 means not cacheable.
+func cacheable(resp *dns.Msg) (ttl uint32) {
+	if resp.Truncated {
+		return 0
+	}
+	switch {
+	case resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0:
+		ttl = CACHE_MAX_TTL
+		for _, rr := range resp.Answer {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+	case resp.Rcode == dns.RcodeSuccess, resp.Rcode == dns.RcodeNameError:
+		// NODATA or NXDOMAIN, the ttl is the smaller one of SOA and its
+		// minimum. Without SOA it shouldn't be cached.
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl = soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+				if ttl > CACHE_MAX_NEGATIVE_TTL {
+					ttl = CACHE_MAX_NEGATIVE_TTL
+				}
+				break
+			}
+		}
+	}
+	return
+}
+
+// hasSubnet tells whether quiz has edns client subnet, answer of it
+// is only for that subnet, so it isn't cached.
+func hasSubnet(quiz *dns.Msg) bool {
+	opt := quiz.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// reply makes answer of quiz from cached one, ttl of records are set to
+// what left, or ttl if not 0.
+func reply(quiz, cached *dns.Msg, elapsed, ttl uint32) (resp *dns.Msg) {
+	resp = cached.Copy()
+	resp.Id = quiz.Id
+	resp.Question = quiz.Question
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			switch {
+			case hdr.Rrtype == dns.TypeOPT:
+			case ttl != 0:
+				hdr.Ttl = ttl
+			case hdr.Ttl > elapsed:
+				hdr.Ttl -= elapsed
+			default:
+				hdr.Ttl = 0
+			}
+		}
+	}
+	return
+}
+
+func (c *Cache) Exchange(quiz *dns.Msg) (resp *dns.Msg, err error) {
+	if len(quiz.Question) != 1 || hasSubnet(quiz) {
+		exhg, err := c.getExchanger()
+		if err != nil {
+			return nil, err
+		}
+		return exhg.Exchange(quiz)
+	}
+
+	q := quiz.Question[0]
+	key := cacheKey{strings.ToLower(q.Name), q.Qtype, q.Qclass}
+	now := time.Now()
+
+	var cached *dns.Msg
+	var elapsed uint32
+	var refresh, stale bool
+	c.lock.Lock()
+	if elem, ok := c.entries[key]; ok {
+		e := elem.Value.(*cacheEntry)
+		switch {
+		case now.Before(e.expire):
+			cached = e.resp
+			elapsed = uint32(now.Sub(e.stored) / time.Second)
+			e.hits++
+			// refresh popular ones in the last tenth of ttl.
+			left := e.expire.Sub(now)
+			if e.hits >= CACHE_PREFETCH_HITS && left < e.expire.Sub(e.stored)/10 {
+				refresh = !e.refreshing
+			}
+			c.lru.MoveToFront(elem)
+		case now.Before(e.expire.Add(CACHE_STALE_TTL * time.Second)):
+			cached, stale = e.resp, true
+			refresh = !e.refreshing
+			c.lru.MoveToFront(elem)
+		default:
+			c.lru.Remove(elem)
+			delete(c.entries, key)
+		}
+		if refresh {
+			e.refreshing = true
+		}
+	}
+	c.lock.Unlock()
+
+	if refresh {
+		go c.refresh(key, q)
+	}
+
+	if cached != nil {
+		if stale {
+			cacheCount.Inc("stale")
+			return reply(quiz, cached, 0, CACHE_STALE_ANSWER_TTL), nil
+		}
+		cacheCount.Inc("hit")
+		return reply(quiz, cached, elapsed, 0), nil
+	}
+
+	cacheCount.Inc("miss")
+	exhg, err := c.getExchanger()
+	if err != nil {
+		return
+	}
+	resp, err = exhg.Exchange(quiz)
+	if err != nil {
+		return
+	}
+	c.store(key, resp)
+	return
+}
+
+// refresh queries again, and stores the answer.
+func (c *Cache) refresh(key cacheKey, q dns.Question) {
+	cacheCount.Inc("refresh")
+	defer func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if elem, ok := c.entries[key]; ok {
+			elem.Value.(*cacheEntry).refreshing = false
+		}
+	}()
+
+	exhg, err := c.getExchanger()
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	quiz := new(dns.Msg)
+	quiz.SetQuestion(q.Name, q.Qtype)
+	quiz.Question[0].Qclass = q.Qclass
+	quiz.RecursionDesired = true
+
+	resp, err := exhg.Exchange(quiz)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	c.store(key, resp)
+}
+
+func (c *Cache) store(key cacheKey, resp *dns.Msg) {
+	if resp == nil {
+		return
+	}
+	ttl := cacheable(resp)
+	if ttl == 0 {
+		return
+	}
+	now := time.Now()
+	e := &cacheEntry{
+		key:    key,
+		resp:   resp.Copy(),
+		stored: now,
+		expire: now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		e.hits = elem.Value.(*cacheEntry).hits
+		elem.Value = e
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.lru.Len() > CACHE_SIZE {
+		elem := c.lru.Back()
+		c.lru.Remove(elem)
+		delete(c.entries, elem.Value.(*cacheEntry).key)
+	}
+}
+
+// GetSize returns how many answers cached.
+func (c *Cache) GetSize() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
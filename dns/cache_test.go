@@ -0,0 +1,212 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/shell909090/goproxy/tunnel"
+)
+
+// fakeExchanger answers A of www.example.com, NXDOMAIN for nx.example.com,
+// and SERVFAIL for others.
+type fakeExchanger struct {
+	lock    sync.Mutex
+	queries int
+	soa     bool
+}
+
+func (fe *fakeExchanger) getQueries() int {
+	fe.lock.Lock()
+	defer fe.lock.Unlock()
+	return fe.queries
+}
+
+func (fe *fakeExchanger) Exchange(quiz *dns.Msg) (resp *dns.Msg, err error) {
+	fe.lock.Lock()
+	fe.queries++
+	fe.lock.Unlock()
+
+	resp = new(dns.Msg)
+	resp.SetReply(quiz)
+	switch strings.ToLower(quiz.Question[0].Name) {
+	case "www.example.com.":
+		rr, _ := dns.NewRR("www.example.com. 300 IN A 10.0.0.1")
+		resp.Answer = append(resp.Answer, rr)
+	case "nx.example.com.":
+		resp.Rcode = dns.RcodeNameError
+		if fe.soa {
+			rr, _ := dns.NewRR("example.com. 3600 IN SOA ns.example.com. root.example.com. 1 7200 900 1209600 600")
+			resp.Ns = append(resp.Ns, rr)
+		}
+	default:
+		resp.Rcode = dns.RcodeServerFailure
+	}
+	return
+}
+
+func query(t *testing.T, c *Cache, name string) (resp *dns.Msg) {
+	quiz := new(dns.Msg)
+	quiz.SetQuestion(name, dns.TypeA)
+	resp, err := c.Exchange(quiz)
+	if err != nil {
+		t.Fatalf("exchange failed: %s", err)
+	}
+	if resp.Id != quiz.Id {
+		t.Fatalf("id of answer should be the same as quiz.")
+	}
+	return
+}
+
+// age moves entry back in time by d.
+func (c *Cache) age(name string, d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem := c.entries[cacheKey{name, dns.TypeA, dns.ClassINET}]
+	e := elem.Value.(*cacheEntry)
+	e.stored = e.stored.Add(-d)
+	e.expire = e.expire.Add(-d)
+}
+
+func waitQueries(t *testing.T, fe *fakeExchanger, n int) {
+	for i := 0; i < 100 && fe.getQueries() < n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fe.getQueries() != n {
+		t.Fatalf("queries should be %d, not %d.", n, fe.getQueries())
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	tunnel.SetLogging()
+	fe := &fakeExchanger{}
+	c := NewCache(fe)
+
+	query(t, c, "www.example.com.")
+	c.age("www.example.com.", 100*time.Second)
+	resp := query(t, c, "WWW.Example.com.")
+	if fe.getQueries() != 1 {
+		t.Fatalf("answer should be cached.")
+	}
+	if resp.Answer[0].Header().Ttl != 200 {
+		t.Fatalf("ttl should be 200, not %d.", resp.Answer[0].Header().Ttl)
+	}
+	if resp.Question[0].Name != "WWW.Example.com." {
+		t.Fatalf("question should be the one asked.")
+	}
+
+	c.age("www.example.com.", (200+CACHE_STALE_TTL)*time.Second)
+	query(t, c, "www.example.com.")
+	if fe.getQueries() != 2 {
+		t.Fatalf("answer expired too long shouldn't be used.")
+	}
+
+	ips, err := c.LookupIP("www.example.com")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("LookupIP wrong: %v %v.", ips, err)
+	}
+	if fe.getQueries() != 2 {
+		t.Fatalf("LookupIP should use cache.")
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	tunnel.SetLogging()
+	fe := &fakeExchanger{}
+	c := NewCache(fe)
+
+	// without SOA, it shouldn't be cached.
+	query(t, c, "nx.example.com.")
+	query(t, c, "nx.example.com.")
+	if fe.getQueries() != 2 {
+		t.Fatalf("negative answer without soa shouldn't be cached.")
+	}
+
+	fe.soa = true
+	query(t, c, "nx.example.com.")
+	resp := query(t, c, "nx.example.com.")
+	if fe.getQueries() != 3 {
+		t.Fatalf("negative answer should be cached.")
+	}
+	if resp.Rcode != dns.RcodeNameError {
+		t.Fatalf("rcode should be kept.")
+	}
+	// ttl is the minimum of soa.
+	c.age("nx.example.com.", 601*time.Second)
+	resp = query(t, c, "nx.example.com.")
+	if resp.Ns[0].Header().Ttl != CACHE_STALE_ANSWER_TTL {
+		t.Fatalf("negative answer should be expired after minimum of soa.")
+	}
+	waitQueries(t, fe, 4)
+
+	query(t, c, "fail.example.com.")
+	query(t, c, "fail.example.com.")
+	if fe.getQueries() != 6 {
+		t.Fatalf("servfail shouldn't be cached.")
+	}
+}
+
+func TestCacheStale(t *testing.T) {
+	tunnel.SetLogging()
+	fe := &fakeExchanger{}
+	c := NewCache(fe)
+
+	query(t, c, "www.example.com.")
+	c.age("www.example.com.", 400*time.Second)
+	resp := query(t, c, "www.example.com.")
+	if resp.Answer[0].Header().Ttl != CACHE_STALE_ANSWER_TTL {
+		t.Fatalf("stale answer should be served.")
+	}
+	waitQueries(t, fe, 2)
+
+	resp = query(t, c, "www.example.com.")
+	if resp.Answer[0].Header().Ttl != 300 {
+		t.Fatalf("answer should be refreshed.")
+	}
+}
+
+func TestCachePrefetch(t *testing.T) {
+	tunnel.SetLogging()
+	fe := &fakeExchanger{}
+	c := NewCache(fe)
+
+	query(t, c, "www.example.com.")
+	c.age("www.example.com.", 280*time.Second)
+	// not popular yet.
+	query(t, c, "www.example.com.")
+	query(t, c, "www.example.com.")
+	if fe.getQueries() != 1 {
+		t.Fatalf("answer shouldn't be prefetched.")
+	}
+	query(t, c, "www.example.com.")
+	waitQueries(t, fe, 2)
+}
+
+func TestCacheSubnet(t *testing.T) {
+	tunnel.SetLogging()
+	fe := &fakeExchanger{}
+	c := NewCache(fe)
+
+	for i := 0; i < 2; i++ {
+		quiz := new(dns.Msg)
+		quiz.SetQuestion("www.example.com.", dns.TypeA)
+		quiz.SetEdns0(4096, false)
+		opt := quiz.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: 24,
+			Address:       net.ParseIP("1.2.3.0"),
+		})
+		_, err := c.Exchange(quiz)
+		if err != nil {
+			t.Fatalf("exchange failed: %s", err)
+		}
+	}
+	if fe.getQueries() != 2 || c.GetSize() != 0 {
+		t.Fatalf("query with subnet shouldn't be cached.")
+	}
+}
@@ -3,20 +3,57 @@ package dns
 import (
 	"errors"
 	"net"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
 	logging "github.com/op/go-logging"
+
+	"github.com/shell909090/goproxy/metrics"
 )
 
 var (
-	logger   = logging.MustGetLogger("dns")
-	DEBUGDNS = true
+	logger = logging.MustGetLogger("dns")
+	// log results of dns queries, could be toggled at runtime.
+	debugDNS int32 = 1
 )
 
+func SetDebug(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&debugDNS, v)
+}
+
+func IsDebug() bool {
+	return atomic.LoadInt32(&debugDNS) != 0
+}
+
 var (
 	ErrMessageTooLarge = errors.New("message body too large")
 )
 
+var (
+	queryCount = metrics.NewCounterVec(
+		"goproxy_dns_queries_total", "DNS queries by source, type and result.",
+		"source", "type", "result")
+	querySeconds = metrics.NewHistogramVec(
+		"goproxy_dns_query_seconds", "Latency of DNS queries.",
+		nil, "source")
+)
+
+// ObserveQuery records a query started at start. source is "resolver" for
+// lookups of goproxy itself, or "server" for queries from dns server.
+func ObserveQuery(source string, t uint16, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "failed"
+	}
+	queryCount.Inc(source, dns.TypeToString[t], result)
+	querySeconds.Observe(time.Since(start).Seconds(), source)
+}
+
 type Resolver interface {
 	LookupIP(host string) (addrs []net.IP, err error)
 }
@@ -57,12 +94,14 @@ func (wrap *WrapExchanger) query(host string, t uint16, addrs *[]net.IP) (err er
 	quiz.SetQuestion(dns.Fqdn(host), t)
 	quiz.RecursionDesired = true
 
+	start := time.Now()
 	resp, err := wrap.Exchanger.Exchange(quiz)
+	ObserveQuery("resolver", t, start, err)
 	if err != nil {
 		return
 	}
 
-	if DEBUGDNS {
+	if IsDebug() {
 		DebugDNS(quiz, resp)
 	}
 
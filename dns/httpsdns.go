@@ -1,13 +1,22 @@
 package dns
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/net/http2"
 
@@ -15,6 +24,18 @@ import (
 	"github.com/shell909090/goproxy/netutil"
 )
 
+const (
+	DOH_MEDIA_TYPE = "application/dns-message"
+	// timeout of one query, in ms.
+	DOH_TIMEOUT = 5000
+	// connection without frames for it is checked by ping, in ms.
+	DOH_READ_IDLE = 15000
+)
+
+var (
+	ErrNoDohServer = errors.New("no doh server works.")
+)
+
 func ParseUint(s string) (n uint64) {
 	n, err := strconv.ParseUint(s, 10, 32)
 	if err != nil {
@@ -24,29 +45,82 @@ func ParseUint(s string) (n uint64) {
 	return
 }
 
+// DohServer is a dns over https endpoint.
+type DohServer struct {
+	Url       string
+	Format    string   // wire, rfc 8484, by default. Or json, like google.
+	Method    string   // GET by default, or POST. Only for wire format.
+	Bootstrap []string // ips of host in url, so it needn't be resolved.
+}
+
+// google json api, used if no server defined.
+var DefaultDohServer = &DohServer{
+	Url:    "https://dns.google.com/resolve",
+	Format: "json",
+}
+
 type HttpsDns struct {
 	Resolver
+	// timeout of one query, server hangs over it is failed.
+	Timeout   time.Duration
 	dialer    netutil.Dialer
-	baseurl   string
+	servers   []*DohServer
+	bootstrap map[string][]string
 	transport http.RoundTripper
+	lock      sync.Mutex
+	current   int
 }
 
-func NewHttpsDns(dialer netutil.Dialer) (httpsdns *HttpsDns, err error) {
-	transport := &http2.Transport{}
-	if dialer != nil {
-		transport.DialTLS = func(network, address string, cfg *tls.Config) (tlsconn net.Conn, err error) {
-			conn, err := dialer.Dial(network, address)
-			if err != nil {
-				return
-			}
-			return tls.Client(conn, cfg), nil
-		}
+// NewHttpsDns creates doh client with servers, they are tried one by one
+// until one works. The one works is tried first next time. Nil dialer
+// means dial directly.
+func NewHttpsDns(dialer netutil.Dialer, servers ...*DohServer) (httpsdns *HttpsDns, err error) {
+	if len(servers) == 0 {
+		servers = []*DohServer{DefaultDohServer}
+	}
+	if dialer == nil {
+		dialer = netutil.DefaultTcpDialer
 	}
 
 	httpsdns = &HttpsDns{
+		Timeout:   DOH_TIMEOUT * time.Millisecond,
 		dialer:    dialer,
-		baseurl:   "https://dns.google.com/resolve",
-		transport: transport,
+		servers:   servers,
+		bootstrap: make(map[string][]string),
+	}
+	for _, srv := range servers {
+		var u *url.URL
+		u, err = url.Parse(srv.Url)
+		if err != nil {
+			return
+		}
+		if u.Scheme != "https" {
+			return nil, fmt.Errorf("doh server should be https: %s.", srv.Url)
+		}
+		switch strings.ToLower(srv.Format) {
+		case "", "wire", "json":
+		default:
+			return nil, fmt.Errorf("unknown doh format: %s.", srv.Format)
+		}
+		switch strings.ToUpper(srv.Method) {
+		case "", "GET", "POST":
+		default:
+			return nil, fmt.Errorf("unknown doh method: %s.", srv.Method)
+		}
+		for _, ip := range srv.Bootstrap {
+			if net.ParseIP(ip) == nil {
+				return nil, fmt.Errorf("bootstrap should be ip: %s.", ip)
+			}
+		}
+		if len(srv.Bootstrap) > 0 {
+			httpsdns.bootstrap[u.Hostname()] = srv.Bootstrap
+		}
+	}
+
+	httpsdns.transport = &http2.Transport{
+		DialTLS:         httpsdns.dialTLS,
+		ReadIdleTimeout: DOH_READ_IDLE * time.Millisecond,
+		PingTimeout:     DOH_TIMEOUT * time.Millisecond,
 	}
 	httpsdns.Resolver = &WrapExchanger{
 		Exchanger: httpsdns,
@@ -54,7 +128,120 @@ func NewHttpsDns(dialer netutil.Dialer) (httpsdns *HttpsDns, err error) {
 	return
 }
 
+// dialTLS dials bootstrap ips of host if it has, tls still checks host.
+func (handler *HttpsDns) dialTLS(network, address string, cfg *tls.Config) (tlsconn net.Conn, err error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	addrs := []string{address}
+	if ips, ok := handler.bootstrap[host]; ok {
+		addrs = nil
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip, port))
+		}
+	}
+
+	var conn net.Conn
+	for _, addr := range addrs {
+		conn, err = handler.dialer.Dial(network, addr)
+		if err == nil {
+			return tls.Client(conn, cfg), nil
+		}
+		logger.Error(err.Error())
+	}
+	return
+}
+
 func (handler *HttpsDns) Exchange(quiz *dns.Msg) (resp *dns.Msg, err error) {
+	handler.lock.Lock()
+	current := handler.current
+	handler.lock.Unlock()
+
+	for i := range handler.servers {
+		idx := (current + i) % len(handler.servers)
+		srv := handler.servers[idx]
+		if strings.ToLower(srv.Format) == "json" {
+			resp, err = handler.exchangeJSON(srv, quiz)
+		} else {
+			resp, err = handler.exchangeWire(srv, quiz)
+		}
+		if err != nil {
+			logger.Errorf("doh server %s failed: %s", srv.Url, err.Error())
+			continue
+		}
+		if idx != current {
+			logger.Noticef("doh server switch to %s.", srv.Url)
+			handler.lock.Lock()
+			handler.current = idx
+			handler.lock.Unlock()
+		}
+		return
+	}
+	if err == nil {
+		err = ErrNoDohServer
+	}
+	return
+}
+
+func (handler *HttpsDns) roundTrip(req *http.Request) (body []byte, err error) {
+	ctx, cancel := context.WithTimeout(req.Context(), handler.Timeout)
+	defer cancel()
+	resp, err := handler.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh server response %s.", resp.Status)
+	}
+	// dns message is no more than 64k.
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 65536))
+}
+
+// exchangeWire queries in wire format of rfc 8484.
+func (handler *HttpsDns) exchangeWire(srv *DohServer, quiz *dns.Msg) (resp *dns.Msg, err error) {
+	// id should be 0 for http cache.
+	m := quiz.Copy()
+	m.Id = 0
+	data, err := m.Pack()
+	if err != nil {
+		return
+	}
+
+	var req *http.Request
+	if strings.ToUpper(srv.Method) == "POST" {
+		req, err = http.NewRequest("POST", srv.Url, bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		req.Header.Set("Content-Type", DOH_MEDIA_TYPE)
+	} else {
+		req, err = http.NewRequest("GET", srv.Url, nil)
+		if err != nil {
+			return
+		}
+		query := req.URL.Query()
+		query.Set("dns", base64.RawURLEncoding.EncodeToString(data))
+		req.URL.RawQuery = query.Encode()
+	}
+	req.Header.Set("Accept", DOH_MEDIA_TYPE)
+
+	body, err := handler.roundTrip(req)
+	if err != nil {
+		return
+	}
+	resp = new(dns.Msg)
+	err = resp.Unpack(body)
+	if err != nil {
+		return nil, err
+	}
+	resp.Id = quiz.Id
+	return
+}
+
+// exchangeJSON queries by json api, and translates answer to dns message.
+func (handler *HttpsDns) exchangeJSON(srv *DohServer, quiz *dns.Msg) (resp *dns.Msg, err error) {
 	var subnet string
 	for _, v := range quiz.Extra {
 		if opt, ok := v.(*dns.OPT); ok {
@@ -67,7 +254,7 @@ func (handler *HttpsDns) Exchange(quiz *dns.Msg) (resp *dns.Msg, err error) {
 		}
 	}
 
-	jsonresp, err := handler.QueryHttpsDNS(
+	jsonresp, err := handler.QueryHttpsDNS(srv.Url,
 		fmt.Sprintf("%v", quiz.Question[0].Qtype),
 		quiz.Question[0].Name,
 		subnet)
@@ -75,16 +262,11 @@ func (handler *HttpsDns) Exchange(quiz *dns.Msg) (resp *dns.Msg, err error) {
 		return
 	}
 
-	resp, err = jsonresp.TranslateAnswer(quiz)
-	if err != nil {
-		return
-	}
-
-	return
+	return jsonresp.TranslateAnswer(quiz)
 }
 
-func (handler *HttpsDns) QueryHttpsDNS(qtype, name, subnet string) (jsonresp *DNSMsg, err error) {
-	req, err := http.NewRequest("GET", handler.baseurl, nil)
+func (handler *HttpsDns) QueryHttpsDNS(baseurl, qtype, name, subnet string) (jsonresp *DNSMsg, err error) {
+	req, err := http.NewRequest("GET", baseurl, nil)
 	if err != nil {
 		logger.Error(err.Error())
 		return
@@ -98,15 +280,14 @@ func (handler *HttpsDns) QueryHttpsDNS(qtype, name, subnet string) (jsonresp *DN
 	}
 	req.URL.RawQuery = query.Encode()
 
-	resp, err := handler.transport.RoundTrip(req)
+	body, err := handler.roundTrip(req)
 	if err != nil {
 		logger.Error(err.Error())
 		return
 	}
-	defer resp.Body.Close()
 
 	jsonresp = &DNSMsg{}
-	err = json.NewDecoder(resp.Body).Decode(&jsonresp)
+	err = json.Unmarshal(body, &jsonresp)
 	if err != nil {
 		logger.Error(err.Error())
 		return
@@ -1,7 +1,17 @@
 package dns
 
 import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/http2"
 
 	"github.com/shell909090/goproxy/tunnel"
 )
@@ -23,3 +33,147 @@ func TestHttpsDns(t *testing.T) {
 		return
 	}
 }
+
+// dohHandler answers A of any name with 10.0.0.1, in wire or json format.
+func dohHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/resolve" {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"Status":0,"Question":[{"name":"%s","type":1}],`+
+				`"Answer":[{"name":"%s","type":1,"TTL":300,"data":"10.0.0.1"}]}`,
+				req.FormValue("name"), req.FormValue("name"))
+			return
+		}
+
+		var data []byte
+		var err error
+		switch req.Method {
+		case "GET":
+			data, err = base64.RawURLEncoding.DecodeString(req.FormValue("dns"))
+		case "POST":
+			if req.Header.Get("Content-Type") != DOH_MEDIA_TYPE {
+				t.Errorf("content type wrong: %s.", req.Header.Get("Content-Type"))
+			}
+			data, err = ioutil.ReadAll(req.Body)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		quiz := new(dns.Msg)
+		err = quiz.Unpack(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if quiz.Id != 0 {
+			t.Errorf("id should be 0 in doh.")
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(quiz)
+		rr, _ := dns.NewRR(quiz.Question[0].Name + " 300 IN A 10.0.0.1")
+		resp.Answer = append(resp.Answer, rr)
+		data, _ = resp.Pack()
+		w.Header().Set("Content-Type", DOH_MEDIA_TYPE)
+		w.Write(data)
+	}
+}
+
+func newDohServer(t *testing.T, handler http.Handler) (srv *httptest.Server) {
+	srv = httptest.NewUnstartedServer(handler)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	return
+}
+
+// trust cert of srv, which is for example.com and 127.0.0.1.
+func trust(httpsdns *HttpsDns, srv *httptest.Server) {
+	httpsdns.transport.(*http2.Transport).TLSClientConfig =
+		srv.Client().Transport.(*http.Transport).TLSClientConfig
+}
+
+func TestHttpsDnsWire(t *testing.T) {
+	tunnel.SetLogging()
+	srv := newDohServer(t, dohHandler(t))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	for _, method := range []string{"GET", "POST"} {
+		// example.com goes to bootstrap, and cert is checked with it.
+		httpsdns, err := NewHttpsDns(nil, &DohServer{
+			Url:       "https://example.com:" + port + "/dns-query",
+			Method:    method,
+			Bootstrap: []string{"127.0.0.1"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		trust(httpsdns, srv)
+
+		quiz := new(dns.Msg)
+		quiz.SetQuestion("www.example.com.", dns.TypeA)
+		resp, err := httpsdns.Exchange(quiz)
+		if err != nil {
+			t.Fatalf("%s failed: %s", method, err)
+		}
+		if resp.Id != quiz.Id || len(resp.Answer) != 1 {
+			t.Fatalf("%s answer wrong: %s", method, resp)
+		}
+	}
+}
+
+func TestHttpsDnsFailover(t *testing.T) {
+	tunnel.SetLogging()
+	srv := newDohServer(t, dohHandler(t))
+	defer srv.Close()
+	broken := newDohServer(t, http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			http.Error(w, "broken", http.StatusInternalServerError)
+		}))
+	defer broken.Close()
+
+	httpsdns, err := NewHttpsDns(nil,
+		&DohServer{Url: broken.URL + "/dns-query"},
+		&DohServer{Url: srv.URL + "/resolve", Format: "json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trust(httpsdns, srv)
+
+	addrs, err := httpsdns.LookupIP("www.example.com")
+	if err != nil || len(addrs) != 1 || !addrs[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("lookup wrong: %v %v", addrs, err)
+	}
+	if httpsdns.current != 1 {
+		t.Fatalf("working server should be tried first.")
+	}
+
+	// server accepts but never answers.
+	done := make(chan struct{})
+	hang := newDohServer(t, http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			<-done
+		}))
+	defer hang.Close()
+	defer close(done)
+
+	httpsdns, err = NewHttpsDns(nil,
+		&DohServer{Url: hang.URL + "/dns-query"},
+		&DohServer{Url: srv.URL + "/dns-query"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpsdns.Timeout = 200 * time.Millisecond
+	trust(httpsdns, srv)
+
+	_, err = httpsdns.LookupIP("www.example.com")
+	if err != nil || httpsdns.current != 1 {
+		t.Fatalf("hanging server should fail over: %v.", err)
+	}
+
+	_, err = NewHttpsDns(nil, &DohServer{Url: "http://127.0.0.1/dns-query"})
+	if err == nil {
+		t.Fatalf("doh server without https should be wrong.")
+	}
+}
@@ -0,0 +1,160 @@
+package dns
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// clients kept by limiter, idle ones are dropped when exceeded.
+	LIMITER_SIZE = 4096
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter limits queries of each client by token bucket, burst is the same
+// as rate.
+// use lock to protect: buckets.
+type Limiter struct {
+	rate    float64
+	lock    sync.Mutex
+	buckets map[string]*bucket
+}
+
+// NewLimiter creates limiter allows rate queries per second for each client.
+func NewLimiter(rate int) (l *Limiter) {
+	return &Limiter{
+		rate:    float64(rate),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// sweep drops buckets full already, they are the same as new ones.
+func (l *Limiter) sweep(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.rate {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// Allow takes a token of client, returns false if there is none.
+func (l *Limiter) Allow(client string) bool {
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	b, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= LIMITER_SIZE {
+			l.sweep(now)
+		}
+		b = &bucket{tokens: l.rate, last: now}
+		l.buckets[client] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.rate {
+		b.tokens = l.rate
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Server is a dns handler answers by Exchanger. Queries are refused if
+// Limiter is set and client exceeds it, and logged to QueryLog if set.
+type Server struct {
+	Exchanger
+	Limiter  *Limiter
+	QueryLog *log.Logger
+}
+
+func NewServer(exchanger Exchanger) (srv *Server) {
+	return &Server{Exchanger: exchanger}
+}
+
+func errorReply(quiz *dns.Msg, rcode int) (resp *dns.Msg) {
+	resp = new(dns.Msg)
+	resp.SetRcode(quiz, rcode)
+	return
+}
+
+// answer makes reply of quiz, it's always there even if upstream failed.
+func (srv *Server) answer(client string, quiz *dns.Msg) (resp *dns.Msg, err error) {
+	switch {
+	case quiz.Opcode != dns.OpcodeQuery:
+		return errorReply(quiz, dns.RcodeNotImplemented), nil
+	case len(quiz.Question) != 1:
+		return errorReply(quiz, dns.RcodeFormatError), nil
+	case srv.Limiter != nil && !srv.Limiter.Allow(client):
+		return errorReply(quiz, dns.RcodeRefused), nil
+	}
+
+	logger.Debugf("dns server query: %s", quiz.Question[0].Name)
+	start := time.Now()
+	resp, err = srv.Exchanger.Exchange(quiz)
+	ObserveQuery("server", quiz.Question[0].Qtype, start, err)
+	if err != nil {
+		return errorReply(quiz, dns.RcodeServerFailure), err
+	}
+	if resp == nil {
+		// Dns with no server answers nothing.
+		return errorReply(quiz, dns.RcodeServerFailure), ErrNoResolver
+	}
+	resp.Id = quiz.Id
+	return
+}
+
+// truncate reply to what client could receive by udp.
+func truncate(w dns.ResponseWriter, quiz, resp *dns.Msg) {
+	if _, ok := w.LocalAddr().(*net.UDPAddr); !ok {
+		return
+	}
+	size := dns.MinMsgSize
+	if opt := quiz.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	resp.Truncate(size)
+}
+
+func (srv *Server) ServeDNS(w dns.ResponseWriter, quiz *dns.Msg) {
+	start := time.Now()
+	client, _, err := net.SplitHostPort(w.RemoteAddr().String())
+	if err != nil {
+		client = w.RemoteAddr().String()
+	}
+
+	resp, err := srv.answer(client, quiz)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+	truncate(w, quiz, resp)
+
+	if srv.QueryLog != nil {
+		name, qtype := "-", "-"
+		if len(quiz.Question) > 0 {
+			name = quiz.Question[0].Name
+			qtype = dns.TypeToString[quiz.Question[0].Qtype]
+		}
+		srv.QueryLog.Printf("%s %s %s %s %s", client, name, qtype,
+			dns.RcodeToString[resp.Rcode], time.Since(start))
+	}
+
+	err = w.WriteMsg(resp)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	return
+}
@@ -0,0 +1,152 @@
+package dns
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/shell909090/goproxy/tunnel"
+)
+
+// recorder is a ResponseWriter keeps what is written.
+type recorder struct {
+	local net.Addr
+	resp  *dns.Msg
+}
+
+var remoteAddr = &net.UDPAddr{IP: net.ParseIP("10.0.0.9"), Port: 5353}
+
+func newRecorder(local net.Addr) *recorder {
+	return &recorder{local: local}
+}
+
+func (r *recorder) LocalAddr() net.Addr       { return r.local }
+func (r *recorder) RemoteAddr() net.Addr      { return remoteAddr }
+func (r *recorder) WriteMsg(m *dns.Msg) error { r.resp = m; return nil }
+func (r *recorder) Write([]byte) (int, error) { return 0, nil }
+func (r *recorder) Close() error              { return nil }
+func (r *recorder) TsigStatus() error         { return nil }
+func (r *recorder) TsigTimersOnly(bool)       {}
+func (r *recorder) Hijack()                   {}
+
+// bigExchanger answers A of any name with n records.
+type bigExchanger int
+
+func (n bigExchanger) Exchange(quiz *dns.Msg) (resp *dns.Msg, err error) {
+	resp = new(dns.Msg)
+	resp.SetReply(quiz)
+	for i := 0; i < int(n); i++ {
+		rr, _ := dns.NewRR(quiz.Question[0].Name + " 300 IN A 10.0.0.1")
+		rr.(*dns.A).A[3] = byte(i)
+		resp.Answer = append(resp.Answer, rr)
+	}
+	return
+}
+
+// nilExchanger answers nothing without error.
+type nilExchanger struct{}
+
+func (nilExchanger) Exchange(quiz *dns.Msg) (resp *dns.Msg, err error) {
+	return
+}
+
+var (
+	udpAddr = &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	tcpAddr = &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+)
+
+func serve(srv *Server, local net.Addr, quiz *dns.Msg) (resp *dns.Msg) {
+	w := newRecorder(local)
+	srv.ServeDNS(w, quiz)
+	return w.resp
+}
+
+func TestServerRcode(t *testing.T) {
+	tunnel.SetLogging()
+	srv := NewServer(&staticExchanger{})
+
+	quiz := new(dns.Msg)
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	resp := serve(srv, udpAddr, quiz)
+	if resp == nil || resp.Rcode != dns.RcodeServerFailure || resp.Id != quiz.Id {
+		t.Fatalf("upstream failed should be servfail: %v.", resp)
+	}
+
+	empty := new(dns.Msg)
+	empty.Id = dns.Id()
+	resp = serve(srv, udpAddr, empty)
+	if resp == nil || resp.Rcode != dns.RcodeFormatError {
+		t.Fatalf("empty question should be formerr: %v.", resp)
+	}
+
+	notify := new(dns.Msg)
+	notify.SetNotify("example.com.")
+	resp = serve(srv, udpAddr, notify)
+	if resp == nil || resp.Rcode != dns.RcodeNotImplemented {
+		t.Fatalf("notify should be notimp: %v.", resp)
+	}
+
+	srv = NewServer(nilExchanger{})
+	resp = serve(srv, udpAddr, quiz)
+	if resp == nil || resp.Rcode != dns.RcodeServerFailure || resp.Id != quiz.Id {
+		t.Fatalf("no answer should be servfail: %v.", resp)
+	}
+}
+
+func TestServerTruncate(t *testing.T) {
+	tunnel.SetLogging()
+	srv := NewServer(bigExchanger(100))
+
+	quiz := new(dns.Msg)
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	resp := serve(srv, udpAddr, quiz)
+	if !resp.Truncated || resp.Len() > dns.MinMsgSize {
+		t.Fatalf("udp answer should be truncated to 512, not %d.", resp.Len())
+	}
+
+	quiz.SetEdns0(4096, false)
+	resp = serve(srv, udpAddr, quiz)
+	if resp.Truncated || len(resp.Answer) != 100 {
+		t.Fatalf("answer should fit in edns size.")
+	}
+
+	quiz = new(dns.Msg)
+	quiz.SetQuestion("www.example.com.", dns.TypeA)
+	resp = serve(srv, tcpAddr, quiz)
+	if resp.Truncated || len(resp.Answer) != 100 {
+		t.Fatalf("tcp answer shouldn't be truncated.")
+	}
+}
+
+func TestServerLimit(t *testing.T) {
+	tunnel.SetLogging()
+	var buf bytes.Buffer
+	srv := NewServer(&staticExchanger{ip: "10.0.0.1"})
+	srv.Limiter = NewLimiter(5)
+	srv.QueryLog = log.New(&buf, "", 0)
+
+	refused := 0
+	for i := 0; i < 10; i++ {
+		quiz := new(dns.Msg)
+		quiz.SetQuestion("www.example.com.", dns.TypeA)
+		if serve(srv, udpAddr, quiz).Rcode == dns.RcodeRefused {
+			refused++
+		}
+	}
+	if refused != 5 {
+		t.Fatalf("5 queries should be refused, not %d.", refused)
+	}
+	if !srv.Limiter.Allow("10.0.0.10") {
+		t.Fatalf("other clients shouldn't be limited.")
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 10 || !strings.HasPrefix(lines[0], "10.0.0.9 www.example.com. A NOERROR ") ||
+		!strings.HasPrefix(lines[9], "10.0.0.9 www.example.com. A REFUSED ") {
+		t.Fatalf("query log wrong: %s", buf.String())
+	}
+}
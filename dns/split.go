@@ -0,0 +1,106 @@
+package dns
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+
+	"github.com/shell909090/goproxy/metrics"
+)
+
+var splitCount = metrics.NewCounterVec(
+	"goproxy_dns_split_total", "DNS answers of split resolver by upstream.", "upstream")
+
+type DomainMatcher interface {
+	Contain(host string) bool
+}
+
+type IPMatcher interface {
+	Contain(ip net.IP) bool
+}
+
+// Split is an Exchanger chooses upstream by domain. Names in Domains are
+// asked to Domestic, others to Foreign. If Routes is set, others are asked
+// to both, and the domestic answer is used only when all addresses in it
+// are in Routes, poisoned answers are out of them.
+type Split struct {
+	Resolver
+	Domestic Exchanger
+	Foreign  Exchanger
+	Domains  DomainMatcher
+	Routes   IPMatcher
+}
+
+func NewSplit(domestic, foreign Exchanger, domains DomainMatcher, routes IPMatcher) (s *Split) {
+	s = &Split{
+		Domestic: domestic,
+		Foreign:  foreign,
+		Domains:  domains,
+		Routes:   routes,
+	}
+	s.Resolver = &WrapExchanger{Exchanger: s}
+	return
+}
+
+// inRoutes tells whether answer has addresses, and all of them are in
+// routes.
+func inRoutes(resp *dns.Msg, routes IPMatcher) bool {
+	found := false
+	for _, rr := range resp.Answer {
+		var ip net.IP
+		switch ta := rr.(type) {
+		case *dns.A:
+			ip = ta.A
+		case *dns.AAAA:
+			ip = ta.AAAA
+		default:
+			continue
+		}
+		if !routes.Contain(ip) {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+func (s *Split) Exchange(quiz *dns.Msg) (resp *dns.Msg, err error) {
+	if len(quiz.Question) != 1 {
+		splitCount.Inc("foreign")
+		return s.Foreign.Exchange(quiz)
+	}
+	q := quiz.Question[0]
+
+	if s.Domains != nil && s.Domains.Contain(q.Name) {
+		splitCount.Inc("domestic")
+		return s.Domestic.Exchange(quiz)
+	}
+	if s.Routes == nil || (q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA) {
+		splitCount.Inc("foreign")
+		return s.Foreign.Exchange(quiz)
+	}
+
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+	// buffered, so foreign one won't be blocked if it's not used.
+	ch := make(chan result, 1)
+	go func() {
+		resp, err := s.Foreign.Exchange(quiz.Copy())
+		ch <- result{resp, err}
+	}()
+
+	resp, err = s.Domestic.Exchange(quiz)
+	if err == nil && resp != nil && inRoutes(resp, s.Routes) {
+		splitCount.Inc("domestic")
+		return
+	}
+	if err != nil {
+		logger.Error(err.Error())
+	}
+
+	r := <-ch
+	splitCount.Inc("foreign")
+	return r.resp, r.err
+}
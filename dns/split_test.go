@@ -0,0 +1,92 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/shell909090/goproxy/tunnel"
+)
+
+// staticExchanger answers A of any name with ip, or fails if ip is empty.
+type staticExchanger struct {
+	ip      string
+	queries int32
+}
+
+func (se *staticExchanger) Exchange(quiz *dns.Msg) (resp *dns.Msg, err error) {
+	atomic.AddInt32(&se.queries, 1)
+	if se.ip == "" {
+		return nil, ErrNoResolver
+	}
+	resp = new(dns.Msg)
+	resp.SetReply(quiz)
+	rr, _ := dns.NewRR(quiz.Question[0].Name + " 300 IN A " + se.ip)
+	resp.Answer = append(resp.Answer, rr)
+	return
+}
+
+type suffixMatcher string
+
+func (sm suffixMatcher) Contain(host string) bool {
+	return strings.HasSuffix(host, string(sm))
+}
+
+type netMatcher struct {
+	*net.IPNet
+}
+
+func (nm netMatcher) Contain(ip net.IP) bool {
+	return nm.IPNet.Contains(ip)
+}
+
+func lookup(t *testing.T, s *Split, host, expected string) {
+	addrs, err := s.LookupIP(host)
+	if err != nil || len(addrs) != 1 || !addrs[0].Equal(net.ParseIP(expected)) {
+		t.Fatalf("%s should be %s, not %v %v.", host, expected, addrs, err)
+	}
+}
+
+func TestSplitDomains(t *testing.T) {
+	tunnel.SetLogging()
+	domestic := &staticExchanger{ip: "10.0.0.1"}
+	foreign := &staticExchanger{ip: "10.0.0.2"}
+	s := NewSplit(domestic, foreign, suffixMatcher("baidu.com."), nil)
+
+	lookup(t, s, "www.baidu.com", "10.0.0.1")
+	lookup(t, s, "www.google.com", "10.0.0.2")
+	if domestic.queries != 1 || foreign.queries != 1 {
+		t.Fatalf("each name should be asked to one upstream.")
+	}
+}
+
+func TestSplitChnroutes(t *testing.T) {
+	tunnel.SetLogging()
+	_, ipnet, _ := net.ParseCIDR("10.0.0.0/24")
+	domestic := &staticExchanger{ip: "10.0.0.1"}
+	foreign := &staticExchanger{ip: "10.0.1.1"}
+	s := NewSplit(domestic, foreign, nil, netMatcher{ipnet})
+
+	// domestic answer in routes.
+	lookup(t, s, "www.baidu.com", "10.0.0.1")
+
+	// poisoned answer out of routes.
+	domestic.ip = "10.0.2.1"
+	lookup(t, s, "www.google.com", "10.0.1.1")
+
+	// domestic one failed.
+	domestic.ip = ""
+	lookup(t, s, "www.google.com", "10.0.1.1")
+
+	// only A and AAAA are asked to both.
+	quiz := new(dns.Msg)
+	quiz.SetQuestion("www.google.com.", dns.TypeMX)
+	n := atomic.LoadInt32(&domestic.queries)
+	s.Exchange(quiz)
+	if atomic.LoadInt32(&domestic.queries) != n {
+		t.Fatalf("mx shouldn't be asked to domestic.")
+	}
+}
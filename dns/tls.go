@@ -0,0 +1,245 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/shell909090/goproxy/netutil"
+)
+
+const (
+	DOT_PORT = "853"
+	// timeout of one query, in ms.
+	DOT_TIMEOUT = 5000
+	// idle connections kept for each server.
+	DOT_MAX_IDLE = 4
+)
+
+var (
+	ErrNoDotServer = errors.New("no dot server works.")
+	ErrPinMismatch = errors.New("certificate mismatch pins.")
+	ErrIdMismatch  = errors.New("id of answer mismatch.")
+)
+
+// DotServer is a dns over tls upstream.
+type DotServer struct {
+	Address    string // host:port, or just host with port 853.
+	ServerName string // for sni and verify, host of address by default.
+	// base64 of sha256 of public key, like hpkp. If set, certificate is
+	// checked by pins, not by ca.
+	Pins []string
+}
+
+type dotUpstream struct {
+	address string
+	config  *tls.Config
+	lock    sync.Mutex
+	idle    []net.Conn
+}
+
+// verifyPins returns function checks the leaf certificate matches pins.
+// Others in chain aren't checked, handshake proves only the leaf key is
+// held by server, anyone could send the rest.
+func verifyPins(pins []string) (verify func([][]byte, [][]*x509.Certificate) error, err error) {
+	var hashes [][]byte
+	for _, pin := range pins {
+		var h []byte
+		h, err = base64.StdEncoding.DecodeString(pin)
+		if err != nil {
+			return
+		}
+		if len(h) != sha256.Size {
+			return nil, fmt.Errorf("pin should be sha256: %s.", pin)
+		}
+		hashes = append(hashes, h)
+	}
+
+	verify = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return ErrPinMismatch
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, h := range hashes {
+			if bytes.Equal(sum[:], h) {
+				return nil
+			}
+		}
+		return ErrPinMismatch
+	}
+	return
+}
+
+func newDotUpstream(srv *DotServer) (u *dotUpstream, err error) {
+	address := srv.Address
+	if _, _, err = net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, DOT_PORT)
+		err = nil
+	}
+	host, _, _ := net.SplitHostPort(address)
+
+	u = &dotUpstream{
+		address: address,
+		config: &tls.Config{
+			ServerName: srv.ServerName,
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+	if u.config.ServerName == "" {
+		u.config.ServerName = host
+	}
+	if len(srv.Pins) > 0 {
+		u.config.InsecureSkipVerify = true
+		u.config.VerifyPeerCertificate, err = verifyPins(srv.Pins)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (u *dotUpstream) get(dialer netutil.Dialer) (conn net.Conn, reused bool, err error) {
+	u.lock.Lock()
+	if n := len(u.idle); n > 0 {
+		conn = u.idle[n-1]
+		u.idle = u.idle[:n-1]
+	}
+	u.lock.Unlock()
+	if conn != nil {
+		return conn, true, nil
+	}
+
+	raw, err := dialer.Dial("tcp", u.address)
+	if err != nil {
+		return
+	}
+	tlsconn := tls.Client(raw, u.config)
+	tlsconn.SetDeadline(time.Now().Add(DOT_TIMEOUT * time.Millisecond))
+	err = tlsconn.Handshake()
+	if err != nil {
+		raw.Close()
+		return
+	}
+	return tlsconn, false, nil
+}
+
+func (u *dotUpstream) put(conn net.Conn) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if len(u.idle) >= DOT_MAX_IDLE {
+		conn.Close()
+		return
+	}
+	u.idle = append(u.idle, conn)
+}
+
+func (u *dotUpstream) exchangeOnce(conn net.Conn, quiz *dns.Msg) (resp *dns.Msg, err error) {
+	conn.SetDeadline(time.Now().Add(DOT_TIMEOUT * time.Millisecond))
+	err = writeMsg(conn, quiz)
+	if err != nil {
+		return
+	}
+	resp, err = readMsg(conn)
+	if err != nil {
+		return
+	}
+	if resp.Id != quiz.Id {
+		return nil, ErrIdMismatch
+	}
+	return
+}
+
+// exchange with idle connection, or a new one. Idle one may be closed by
+// server, so it's tried again with a new one.
+func (u *dotUpstream) exchange(dialer netutil.Dialer, quiz *dns.Msg) (resp *dns.Msg, err error) {
+	for {
+		var conn net.Conn
+		var reused bool
+		conn, reused, err = u.get(dialer)
+		if err != nil {
+			return
+		}
+		resp, err = u.exchangeOnce(conn, quiz)
+		if err == nil {
+			u.put(conn)
+			return
+		}
+		conn.Close()
+		if !reused {
+			return
+		}
+	}
+}
+
+// TlsDns is a dns over tls client, servers are tried one by one until one
+// works. The one works is tried first next time.
+type TlsDns struct {
+	Resolver
+	dialer    netutil.Dialer
+	upstreams []*dotUpstream
+	lock      sync.Mutex
+	current   int
+}
+
+// NewTlsDns creates dot client, nil dialer means dial directly.
+func NewTlsDns(dialer netutil.Dialer, servers ...*DotServer) (tlsdns *TlsDns, err error) {
+	if len(servers) == 0 {
+		return nil, ErrNoDotServer
+	}
+	if dialer == nil {
+		dialer = netutil.DefaultTcpDialer
+	}
+
+	tlsdns = &TlsDns{dialer: dialer}
+	for _, srv := range servers {
+		var u *dotUpstream
+		u, err = newDotUpstream(srv)
+		if err != nil {
+			return
+		}
+		tlsdns.upstreams = append(tlsdns.upstreams, u)
+	}
+	tlsdns.Resolver = &WrapExchanger{
+		Exchanger: tlsdns,
+	}
+	return
+}
+
+func (tlsdns *TlsDns) Exchange(quiz *dns.Msg) (resp *dns.Msg, err error) {
+	tlsdns.lock.Lock()
+	current := tlsdns.current
+	tlsdns.lock.Unlock()
+
+	for i := range tlsdns.upstreams {
+		idx := (current + i) % len(tlsdns.upstreams)
+		u := tlsdns.upstreams[idx]
+		resp, err = u.exchange(tlsdns.dialer, quiz)
+		if err != nil {
+			logger.Errorf("dot server %s failed: %s", u.address, err.Error())
+			continue
+		}
+		if idx != current {
+			logger.Noticef("dot server switch to %s.", u.address)
+			tlsdns.lock.Lock()
+			tlsdns.current = idx
+			tlsdns.lock.Unlock()
+		}
+		return
+	}
+	if err == nil {
+		err = ErrNoDotServer
+	}
+	return
+}
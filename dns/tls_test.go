@@ -0,0 +1,193 @@
+package dns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/shell909090/goproxy/tunnel"
+)
+
+// dotHandler answers A of any name with 10.0.0.1, and records clients.
+type dotHandler struct {
+	lock    sync.Mutex
+	clients map[string]int
+}
+
+func (h *dotHandler) ServeDNS(w dns.ResponseWriter, quiz *dns.Msg) {
+	h.lock.Lock()
+	h.clients[w.RemoteAddr().String()]++
+	h.lock.Unlock()
+
+	resp := new(dns.Msg)
+	resp.SetReply(quiz)
+	rr, _ := dns.NewRR(quiz.Question[0].Name + " 300 IN A 10.0.0.1")
+	resp.Answer = append(resp.Answer, rr)
+	w.WriteMsg(resp)
+}
+
+// testCert returns cert of httptest, and its pin.
+func testCert() (cert tls.Certificate, pin string) {
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.StartTLS()
+	defer srv.Close()
+	sum := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	return srv.TLS.Certificates[0], base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// listenDot starts dot server with cert, returns its address. Idle
+// connections are closed after idle, if not 0.
+func listenDot(t *testing.T, h *dotHandler, cert tls.Certificate, idle time.Duration) (server *dns.Server, addr string) {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = &dns.Server{Listener: listener, Net: "tcp-tls", Handler: h}
+	if idle != 0 {
+		server.IdleTimeout = func() time.Duration { return idle }
+	}
+	go server.ActivateAndServe()
+	return server, listener.Addr().String()
+}
+
+// newDotServer starts dot server with cert of httptest, returns its
+// address and pin.
+func newDotServer(t *testing.T, h *dotHandler, idle time.Duration) (server *dns.Server, addr, pin string) {
+	cert, pin := testCert()
+	server, addr = listenDot(t, h, cert, idle)
+	return
+}
+
+func TestTlsDns(t *testing.T) {
+	tunnel.SetLogging()
+	h := &dotHandler{clients: make(map[string]int)}
+	server, addr, pin := newDotServer(t, h, 0)
+	defer server.Shutdown()
+
+	tlsdns, err := NewTlsDns(nil, &DotServer{Address: addr, Pins: []string{pin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		addrs, err := tlsdns.LookupIP("www.example.com")
+		if err != nil || len(addrs) != 1 || !addrs[0].Equal(net.ParseIP("10.0.0.1")) {
+			t.Fatalf("lookup wrong: %v %v", addrs, err)
+		}
+	}
+	if len(h.clients) != 1 {
+		t.Fatalf("connection should be reused, not %d.", len(h.clients))
+	}
+
+	// cert isn't signed by any ca.
+	tlsdns, err = NewTlsDns(nil, &DotServer{Address: addr, ServerName: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tlsdns.LookupIP("www.example.com"); err == nil {
+		t.Fatalf("cert without ca should be refused.")
+	}
+
+	wrong := sha256.Sum256([]byte("wrong"))
+	tlsdns, err = NewTlsDns(nil, &DotServer{Address: addr,
+		Pins: []string{base64.StdEncoding.EncodeToString(wrong[:])}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tlsdns.LookupIP("www.example.com"); err == nil {
+		t.Fatalf("cert mismatch pins should be refused.")
+	}
+
+	if _, err = NewTlsDns(nil, &DotServer{Address: addr, Pins: []string{"abc"}}); err == nil {
+		t.Fatalf("pin should be sha256 in base64.")
+	}
+}
+
+func TestTlsDnsForeignLeaf(t *testing.T) {
+	tunnel.SetLogging()
+	pinned, pin := testCert()
+
+	// a leaf of foreign key, with the pinned cert behind it.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{
+		Certificate: [][]byte{der, pinned.Certificate[0]},
+		PrivateKey:  key,
+	}
+
+	h := &dotHandler{clients: make(map[string]int)}
+	server, addr := listenDot(t, h, cert, 0)
+	defer server.Shutdown()
+
+	tlsdns, err := NewTlsDns(nil, &DotServer{Address: addr, Pins: []string{pin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tlsdns.LookupIP("www.example.com"); err == nil {
+		t.Fatalf("pinned cert not as leaf should be refused.")
+	}
+}
+
+func TestTlsDnsFailover(t *testing.T) {
+	tunnel.SetLogging()
+	h := &dotHandler{clients: make(map[string]int)}
+	server, addr, pin := newDotServer(t, h, 100*time.Millisecond)
+	defer server.Shutdown()
+
+	// nothing listens on it after closed.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := listener.Addr().String()
+	listener.Close()
+
+	tlsdns, err := NewTlsDns(nil,
+		&DotServer{Address: broken, Pins: []string{pin}},
+		&DotServer{Address: addr, Pins: []string{pin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tlsdns.LookupIP("www.example.com"); err != nil {
+		t.Fatalf("lookup failed: %s", err)
+	}
+	if tlsdns.current != 1 {
+		t.Fatalf("working server should be tried first.")
+	}
+
+	// idle connection closed by server, a new one should be made.
+	time.Sleep(300 * time.Millisecond)
+	if _, err = tlsdns.LookupIP("www.example.com"); err != nil {
+		t.Fatalf("lookup after idle failed: %s", err)
+	}
+	if len(h.clients) != 2 {
+		t.Fatalf("new connection should be made, not %d.", len(h.clients))
+	}
+}
@@ -3,12 +3,14 @@ package main
 import (
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/shell909090/goproxy/connpool"
 	"github.com/shell909090/goproxy/cryptconn"
 	"github.com/shell909090/goproxy/dns"
 	"github.com/shell909090/goproxy/ipfilter"
 	"github.com/shell909090/goproxy/netutil"
+	"github.com/shell909090/goproxy/passwd"
 	"github.com/shell909090/goproxy/portmapper"
 	"github.com/shell909090/goproxy/proxy"
 	"github.com/shell909090/goproxy/tunnel"
@@ -24,21 +26,42 @@ type ServerDefine struct {
 	Key         string
 	Username    string
 	Password    string
+	Weight      int
+	Group       string
 }
 
 type ClientConfig struct {
 	Config
 	Blackfile string
+	Rules     string
+	GeoIPDir  string
 
-	MinSess int
-	MaxConn int
-	Servers []*ServerDefine
+	MinSess  int
+	MaxConn  int
+	Servers  []*ServerDefine
+	Strategy string
+	MaxAge   int
+	MaxBytes uint64
 
-	HttpUser     string
-	HttpPassword string
+	HttpUser        string
+	HttpPassword    string
+	HttpAuthFile    string
+	HttpAuthCommand string
+	HttpAuthUrl     string
+	SocksListen     string
 
-	Portmaps  []portmapper.PortMap
-	DnsServer string
+	Portmaps       []portmapper.PortMap
+	DnsServer      string
+	DnsTlsListen   string
+	DnsCertFile    string
+	DnsCertKeyFile string
+	DnsRateLimit   int
+	DnsQueryLog    string
+	// split horizon, see SetSplitDns.
+	DnsDomestic     []string
+	DnsDomesticList string
+	DnsChnroutes    bool
+	Priorities      []tunnel.PriorityRule
 }
 
 func LoadClientConfig(basecfg *Config) (cfg *ClientConfig, err error) {
@@ -57,7 +80,7 @@ func httpserver(addr string, handler http.Handler) {
 	for {
 		err := http.ListenAndServe(addr, handler)
 		if err != nil {
-			logger.Error("%s", err.Error())
+			logger.Error(err.Error())
 			return
 		}
 	}
@@ -76,10 +99,10 @@ func (sd *ServerDefine) MakeDialer() (dialer netutil.Dialer, err error) {
 	return
 }
 
-func RunHttproxy(cfg *ClientConfig) (err error) {
+// MakeUpstreams by group, servers without group are in default one, "".
+func (cfg *ClientConfig) MakeUpstreams() (groups map[string][]*connpool.Upstream, err error) {
 	var dialer netutil.Dialer
-	pool := connpool.NewDialer(cfg.MinSess, cfg.MaxConn)
-
+	groups = map[string][]*connpool.Upstream{"": nil}
 	for _, srv := range cfg.Servers {
 		dialer, err = srv.MakeDialer()
 		if err != nil {
@@ -87,7 +110,99 @@ func RunHttproxy(cfg *ClientConfig) (err error) {
 		}
 		creator := tunnel.NewDialerCreator(
 			dialer, "tcp4", srv.Server, srv.Username, srv.Password)
-		pool.AddDialerCreator(creator)
+		groups[srv.Group] = append(
+			groups[srv.Group], connpool.NewUpstream(creator, srv.Weight))
+	}
+	return
+}
+
+// MakeRules from rules file, and blackfile goes direct after them.
+func (cfg *ClientConfig) MakeRules() (rules []*ipfilter.Rule, err error) {
+	loader := ipfilter.NewRuleLoader(cfg.GeoIPDir)
+	if cfg.Rules != "" {
+		rules, err = loader.ReadFile(cfg.Rules)
+		if err != nil {
+			return
+		}
+	}
+	if cfg.Blackfile != "" {
+		var rule *ipfilter.Rule
+		rule, err = loader.Parse("ip-list," + cfg.Blackfile + ",direct")
+		if err != nil {
+			return
+		}
+		rules = append(rules, rule)
+	}
+	return
+}
+
+// MakeAuthenticator for http and socks5 proxy, nil means no auth.
+func (cfg *ClientConfig) MakeAuthenticator() (author passwd.Authenticator, err error) {
+	var users map[string]string
+	if cfg.HttpUser != "" && cfg.HttpPassword != "" {
+		users = map[string]string{cfg.HttpUser: cfg.HttpPassword}
+	}
+	return passwd.New(
+		users, cfg.HttpAuthFile, cfg.HttpAuthCommand, cfg.HttpAuthUrl)
+}
+
+// Groups keeps a pool for each server group, default one is "".
+// Groups removed by reload keep their pools, without upstreams.
+type Groups struct {
+	pools  map[string]*connpool.Dialer
+	router *ipfilter.Router
+	mux    *http.ServeMux
+}
+
+// Set upstreams to pools, pools of new groups are created and added to
+// router, and their admin pages are under /groups/<name>/.
+func (g *Groups) Set(cfg *ClientConfig, groups map[string][]*connpool.Upstream, strategy int) {
+	for name, pool := range g.pools {
+		if _, ok := groups[name]; !ok {
+			pool.SetUpstreams(nil)
+		}
+	}
+	for name, ups := range groups {
+		pool, ok := g.pools[name]
+		if !ok {
+			pool = connpool.NewDialer(cfg.MinSess, cfg.MaxConn)
+			g.pools[name] = pool
+			g.router.SetGroup(name, pool)
+			if g.mux != nil {
+				mux := http.NewServeMux()
+				pool.Register(mux)
+				prefix := "/groups/" + name
+				g.mux.Handle(prefix+"/", http.StripPrefix(prefix, mux))
+			}
+		}
+		pool.SetUpstreams(ups)
+		pool.SetLimits(cfg.MinSess, cfg.MaxConn)
+		pool.SetStrategy(strategy)
+		pool.SetRotation(time.Duration(cfg.MaxAge)*time.Second, cfg.MaxBytes)
+	}
+}
+
+func RunHttproxy(cfg *ClientConfig) (err error) {
+	var dialer netutil.Dialer
+	pool := connpool.NewDialer(cfg.MinSess, cfg.MaxConn)
+
+	groups, err := cfg.MakeUpstreams()
+	if err != nil {
+		return
+	}
+	strategy, err := connpool.ParseStrategy(cfg.Strategy)
+	if err != nil {
+		return
+	}
+	rules, err := cfg.MakeRules()
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+
+	err = tunnel.SetPriorityRules(cfg.Priorities)
+	if err != nil {
+		return
 	}
 
 	dialer = pool
@@ -96,31 +211,117 @@ func RunHttproxy(cfg *ClientConfig) (err error) {
 		dns.DefaultResolver = dns.NewTcpClient(dialer)
 	}
 
-	if cfg.DnsServer != "" {
-		go RunDnsServer(cfg.DnsServer)
+	if len(cfg.DnsDomestic) > 0 {
+		err = SetSplitDns(cfg)
+		if err != nil {
+			return
+		}
+	}
+
+	if cfg.DnsServer != "" || cfg.DnsTlsListen != "" {
+		err = RunDnsServer(cfg)
+		if err != nil {
+			return
+		}
 	}
 
+	// without rules and blackfile, router just pass to default group.
+	// keep it anyway, so rules could be added by reload.
+	router := ipfilter.NewRouter(dialer)
+	g := &Groups{
+		pools:  map[string]*connpool.Dialer{"": pool},
+		router: router,
+	}
 	if cfg.AdminIface != "" {
-		mux := http.NewServeMux()
-		pool.Register(mux)
-		go httpserver(cfg.AdminIface, mux)
+		g.mux = http.NewServeMux()
+		pool.Register(g.mux)
+		g.mux.HandleFunc("/api/filter", connpool.HandlerAPIFilter(router))
+		go httpserver(cfg.AdminIface, g.mux)
 	}
+	g.Set(cfg, groups, strategy)
 
-	if cfg.Blackfile != "" {
-		fdialer := ipfilter.NewFilteredDialer(dialer)
-		err = fdialer.LoadFilter(netutil.DefaultTcpDialer, cfg.Blackfile)
+	err = router.SetRules(rules)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	dialer = router
+
+	portmaps := portmapper.NewManager(dialer)
+	portmaps.Update(cfg.Portmaps)
+
+	author, err := cfg.MakeAuthenticator()
+	if err != nil {
+		return
+	}
+	var socks *proxy.Socks5Server
+	if cfg.SocksListen != "" {
+		socks = proxy.NewSocks5Server(dialer, author)
+		go func() {
+			err := socks.ListenAndServe(cfg.SocksListen)
+			if err != nil {
+				logger.Error(err.Error())
+			}
+		}()
+	}
+	p := proxy.NewProxy(dialer, author)
+
+	WatchReload(func() (err error) {
+		basecfg, err := ReloadConfig(&cfg.Config)
+		if err != nil {
+			return
+		}
+		newcfg, err := LoadClientConfig(basecfg)
 		if err != nil {
-			logger.Error("%s", err.Error())
 			return
 		}
-		dialer = fdialer
-	}
 
-	// FIXME: port mapper?
-	for _, pm := range cfg.Portmaps {
-		go portmapper.CreatePortmap(pm, dialer)
-	}
+		groups, err := newcfg.MakeUpstreams()
+		if err != nil {
+			return
+		}
+		strategy, err := connpool.ParseStrategy(newcfg.Strategy)
+		if err != nil {
+			return
+		}
+		rules, err := newcfg.MakeRules()
+		if err != nil {
+			return
+		}
+		// check all before any applied, so a bad config changes nothing.
+		err = ipfilter.CheckRules(rules, func(name string) bool {
+			_, ok := groups[name]
+			return ok
+		})
+		if err != nil {
+			return
+		}
+		err = tunnel.CheckPriorityRules(newcfg.Priorities)
+		if err != nil {
+			return
+		}
+		author, err := newcfg.MakeAuthenticator()
+		if err != nil {
+			return
+		}
+		RestartNeeded(cfg, newcfg, "SocksListen", "DnsServer", "DnsTlsListen",
+			"DnsCertFile", "DnsCertKeyFile", "DnsRateLimit", "DnsQueryLog",
+			"DnsDomestic", "DnsDomesticList", "DnsChnroutes")
+
+		tunnel.SetPriorityRules(newcfg.Priorities)
+		g.Set(newcfg, groups, strategy)
+		err = router.SetRules(rules)
+		if err != nil {
+			return
+		}
+
+		portmaps.Update(newcfg.Portmaps)
+		p.SetAuth(author)
+		if socks != nil {
+			socks.SetAuth(author)
+		}
+		return
+	})
 
-	p := proxy.NewProxy(dialer, cfg.HttpUser, cfg.HttpPassword)
 	return http.ListenAndServe(cfg.Listen, p)
 }
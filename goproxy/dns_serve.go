@@ -1,44 +1,131 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"os"
+
 	"github.com/miekg/dns"
 	mydns "github.com/shell909090/goproxy/dns"
+	"github.com/shell909090/goproxy/ipfilter"
 )
 
-type DnsServer struct {
-	mydns.Exchanger
-}
+var (
+	ErrNotExchanger = errors.New("resolver is not exchanger.")
+	ErrNoBlackfile  = errors.New("dnschnroutes needs blackfile.")
+)
 
-func (dnssrv *DnsServer) ServeDNS(w dns.ResponseWriter, quiz *dns.Msg) {
-	logger.Debugf("dns server query: %s", quiz.Question[0].Name)
-	resp, err := dnssrv.Exchanger.Exchange(quiz)
-	if err != nil {
-		logger.Error(err.Error())
-		return
+// SetSplitDns puts split resolver before DefaultResolver, so dns server
+// and filters both use it. Names in DnsDomesticList go to DnsDomestic. With
+// DnsChnroutes, others go to both, and domestic answer is used only if it's
+// in Blackfile.
+func SetSplitDns(cfg *ClientConfig) (err error) {
+	foreign, ok := mydns.DefaultResolver.(mydns.Exchanger)
+	if !ok {
+		return ErrNotExchanger
 	}
 
-	err = w.WriteMsg(resp)
+	var addrs []string
+	for _, addr := range cfg.DnsDomestic {
+		if _, _, e := net.SplitHostPort(addr); e != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+		addrs = append(addrs, addr)
+	}
+	split := mydns.NewSplit(mydns.NewDns(addrs, "udp"), foreign, nil, nil)
+
+	if cfg.DnsDomesticList != "" {
+		var dl *ipfilter.DomainList
+		dl, err = ipfilter.ReadDomainListFile(cfg.DnsDomesticList)
+		if err != nil {
+			return
+		}
+		split.Domains = dl
+	}
+
+	if cfg.DnsChnroutes {
+		if cfg.Blackfile == "" {
+			return ErrNoBlackfile
+		}
+		var filter *ipfilter.IPFilter
+		filter, err = ipfilter.ReadIPListFile(cfg.Blackfile)
+		if err != nil {
+			return
+		}
+		split.Routes = filter
+	}
+
+	logger.Infof("split dns with domestic %v.", addrs)
+	mydns.DefaultResolver = split
+	return
+}
+
+func serveDns(server *dns.Server) {
+	err := server.ActivateAndServe()
 	if err != nil {
 		logger.Error(err.Error())
-		return
 	}
-	return
 }
 
-func RunDnsServer(addr string) {
-	handler := new(DnsServer)
-	exhg, ok := mydns.DefaultResolver.(mydns.Exchanger)
-	handler.Exchanger = exhg
-	if !ok {
-		panic("DefaultResolver not Exchanger?")
+// RunDnsServer starts udp and tcp server on DnsServer, and dot server on
+// DnsTlsListen, if they are set. Listen errors are returned.
+func RunDnsServer(cfg *ClientConfig) (err error) {
+	if _, ok := mydns.DefaultResolver.(mydns.Exchanger); !ok {
+		return ErrNotExchanger
+	}
+	// cache is shared with filters.
+	handler := mydns.NewServer(mydns.DefaultCache)
+	if cfg.DnsRateLimit > 0 {
+		handler.Limiter = mydns.NewLimiter(cfg.DnsRateLimit)
+	}
+	if cfg.DnsQueryLog != "" {
+		var file *os.File
+		file, err = os.OpenFile(cfg.DnsQueryLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return
+		}
+		handler.QueryLog = log.New(file, "", log.LstdFlags)
 	}
 
-	server := &dns.Server{
-		Addr:    addr,
-		Net:     "udp",
-		Handler: handler,
+	if cfg.DnsServer != "" {
+		var conn net.PacketConn
+		conn, err = net.ListenPacket("udp", cfg.DnsServer)
+		if err != nil {
+			return
+		}
+		var listener net.Listener
+		listener, err = net.Listen("tcp", cfg.DnsServer)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		logger.Infof("dns server start.")
+		go serveDns(&dns.Server{PacketConn: conn, Handler: handler})
+		go serveDns(&dns.Server{Listener: listener, Handler: handler})
 	}
 
-	logger.Infof("dns server start.")
-	go server.ListenAndServe()
+	if cfg.DnsTlsListen != "" {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(cfg.DnsCertFile, cfg.DnsCertKeyFile)
+		if err != nil {
+			return
+		}
+		addr := cfg.DnsTlsListen
+		if _, _, e := net.SplitHostPort(addr); e != nil {
+			addr = net.JoinHostPort(addr, mydns.DOT_PORT)
+		}
+		var listener net.Listener
+		listener, err = tls.Listen("tcp", addr, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		})
+		if err != nil {
+			return
+		}
+		logger.Infof("dns over tls server start.")
+		go serveDns(&dns.Server{Listener: listener, Net: "tcp-tls", Handler: handler})
+	}
+	return
 }
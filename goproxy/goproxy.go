@@ -25,8 +25,10 @@ type Config struct {
 	Loglevel   string
 	AdminIface string
 
-	DnsAddrs []string
-	DnsNet   string
+	DnsAddrs   []string
+	DnsNet     string
+	DohServers []*dns.DohServer
+	DotServers []*dns.DotServer
 }
 
 func init() {
@@ -94,8 +96,15 @@ func main() {
 
 	switch basecfg.DnsNet {
 	case "https":
-		dns.DefaultResolver, err = dns.NewHttpsDns(nil)
+		dns.DefaultResolver, err = dns.NewHttpsDns(nil, basecfg.DohServers...)
 		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+	case "tls":
+		dns.DefaultResolver, err = dns.NewTlsDns(nil, basecfg.DotServers...)
+		if err != nil {
+			logger.Error(err.Error())
 			return
 		}
 	case "udp", "tcp":
@@ -133,7 +142,7 @@ func main() {
 		return
 	}
 	if err != nil {
-		logger.Error("%s", err)
+		logger.Error(err.Error())
 	}
 	logger.Info("server stopped")
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+)
+
+// WatchReload calls reload each time SIGHUP received.
+func WatchReload(reload func() error) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			logger.Notice("SIGHUP received, reload config.")
+			err := reload()
+			if err != nil {
+				logger.Errorf("reload failed: %s", err.Error())
+				continue
+			}
+			logger.Notice("config reloaded.")
+		}
+	}()
+}
+
+// WatchShutdown calls shutdown when SIGINT or SIGTERM received, then exits.
+func WatchShutdown(shutdown func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-ch
+		logger.Noticef("%s received, quit.", sig.String())
+		shutdown()
+		os.Exit(0)
+	}()
+}
+
+// ReloadConfig reads config file again. Mode, listen and log settings
+// are kept, they need restart, and so do admin and dns ones.
+func ReloadConfig(basecfg *Config) (cfg *Config, err error) {
+	cfg, err = LoadConfig()
+	if err != nil {
+		return
+	}
+	RestartNeeded(basecfg, cfg, "Mode", "Listen", "Logfile", "Loglevel",
+		"AdminIface", "DnsAddrs", "DnsNet", "DohServers", "DotServers")
+	cfg.Mode = basecfg.Mode
+	cfg.Listen = basecfg.Listen
+	cfg.Logfile = basecfg.Logfile
+	cfg.Loglevel = basecfg.Loglevel
+	return
+}
+
+// RestartNeeded warns fields changed by reload, which are used only when
+// started. Old and cfg are pointers to the same type of config.
+func RestartNeeded(old, cfg interface{}, fields ...string) {
+	vold := reflect.ValueOf(old).Elem()
+	vcfg := reflect.ValueOf(cfg).Elem()
+	var changed []string
+	for _, field := range fields {
+		if !reflect.DeepEqual(vold.FieldByName(field).Interface(),
+			vcfg.FieldByName(field).Interface()) {
+			changed = append(changed, strings.ToLower(field))
+		}
+	}
+	if len(changed) > 0 {
+		logger.Warningf("%s changes need restart, ignored.",
+			strings.Join(changed, ", "))
+	}
+}
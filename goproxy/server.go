@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"net"
 	"net/http"
 	"strings"
@@ -9,6 +10,11 @@ import (
 	"github.com/shell909090/goproxy/cryptconn"
 	"github.com/shell909090/goproxy/dns"
 	"github.com/shell909090/goproxy/netutil"
+	"github.com/shell909090/goproxy/passwd"
+)
+
+var (
+	ErrLegacyFallback = errors.New("fallback needs tls or aead cipher, legacy ones have no replay protection.")
 )
 
 type ServerConfig struct {
@@ -21,6 +27,14 @@ type ServerConfig struct {
 	Cipher      string
 	Key         string
 	Auth        map[string]string
+	AuthFile    string
+	AuthCommand string
+	AuthUrl     string
+	Fallback    string
+	Decoy       string
+	Quotas      map[string]connpool.Quota
+	Acl         []connpool.AclRule
+	StateFile   string
 }
 
 func LoadServerConfig(basecfg *Config) (cfg *ServerConfig, err error) {
@@ -32,6 +46,16 @@ func LoadServerConfig(basecfg *Config) (cfg *ServerConfig, err error) {
 	if cfg.Cipher == "" {
 		cfg.Cipher = "aes"
 	}
+	fallback, err := netutil.NewFallback(cfg.Fallback, cfg.Decoy)
+	if err != nil {
+		return
+	}
+	// a prober could replay a recorded session in legacy modes, fallback
+	// won't hide anything.
+	if fallback != nil && strings.ToLower(cfg.CryptMode) != "tls" &&
+		!cryptconn.IsAead(cfg.Cipher) {
+		return nil, ErrLegacyFallback
+	}
 	return
 }
 
@@ -43,11 +67,22 @@ func RunServer(cfg *ServerConfig) (err error) {
 		return
 	}
 
+	fallback, err := netutil.NewFallback(cfg.Fallback, cfg.Decoy)
+	if err != nil {
+		return
+	}
+
 	if strings.ToLower(cfg.CryptMode) == "tls" {
 		listener, err = TlsListener(
 			listener, cfg.CertFile, cfg.CertKeyFile, cfg.RootCAs)
 	} else {
-		listener, err = cryptconn.NewListener(listener, cfg.Cipher, cfg.Key)
+		var clistener *cryptconn.Listener
+		clistener, err = cryptconn.NewListener(listener, cfg.Cipher, cfg.Key)
+		if err != nil {
+			return
+		}
+		clistener.Fallback = fallback
+		listener = clistener
 	}
 	if err != nil {
 		return
@@ -58,7 +93,57 @@ func RunServer(cfg *ServerConfig) (err error) {
 		netutil.DefaultTcpDialer = netutil.DefaultTcp4Dialer
 	}
 
-	server := connpool.NewServer(&cfg.Auth)
+	author, err := passwd.New(
+		cfg.Auth, cfg.AuthFile, cfg.AuthCommand, cfg.AuthUrl)
+	if err != nil {
+		return
+	}
+	server := connpool.NewServer(author)
+	server.Fallback = fallback
+	server.Accounting.SetQuotas(cfg.Quotas)
+	err = server.ACL.SetRules(cfg.Acl)
+	if err != nil {
+		return
+	}
+	if cfg.StateFile != "" {
+		err = server.Accounting.Load(cfg.StateFile)
+		if err != nil {
+			return
+		}
+		// usages since last saved would be lost.
+		WatchShutdown(func() {
+			err := server.Accounting.Save()
+			if err != nil {
+				logger.Error(err.Error())
+			}
+		})
+	}
+
+	WatchReload(func() (err error) {
+		basecfg, err := ReloadConfig(&cfg.Config)
+		if err != nil {
+			return
+		}
+		newcfg, err := LoadServerConfig(basecfg)
+		if err != nil {
+			return
+		}
+		author, err := passwd.New(
+			newcfg.Auth, newcfg.AuthFile, newcfg.AuthCommand, newcfg.AuthUrl)
+		if err != nil {
+			return
+		}
+		err = server.ACL.SetRules(newcfg.Acl)
+		if err != nil {
+			return
+		}
+		RestartNeeded(cfg, newcfg, "CryptMode", "RootCAs", "CertFile",
+			"CertKeyFile", "ForceIPv4", "Cipher", "Key", "Fallback", "Decoy",
+			"StateFile")
+		server.SetAuth(author)
+		server.Accounting.SetQuotas(newcfg.Quotas)
+		return
+	})
 
 	if cfg.AdminIface != "" {
 		mux := http.NewServeMux()
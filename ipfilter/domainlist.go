@@ -0,0 +1,176 @@
+package ipfilter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// DomainList matches domain and its subdomains. Exceptions, the @@ lines in
+// gfwlist, are matched before domains.
+type DomainList struct {
+	domains    map[string]struct{}
+	exceptions map[string]struct{}
+}
+
+func NewDomainList() (dl *DomainList) {
+	return &DomainList{
+		domains:    make(map[string]struct{}),
+		exceptions: make(map[string]struct{}),
+	}
+}
+
+func (dl *DomainList) GetSize() int {
+	return len(dl.domains)
+}
+
+func (dl *DomainList) Add(domain string) {
+	domain = strings.ToLower(strings.Trim(domain, "."))
+	if domain != "" {
+		dl.domains[domain] = struct{}{}
+	}
+}
+
+func (dl *DomainList) AddException(domain string) {
+	domain = strings.ToLower(strings.Trim(domain, "."))
+	if domain != "" {
+		dl.exceptions[domain] = struct{}{}
+	}
+}
+
+func matchSuffix(set map[string]struct{}, host string) bool {
+	for {
+		if _, ok := set[host]; ok {
+			return true
+		}
+		idx := strings.IndexByte(host, '.')
+		if idx == -1 {
+			return false
+		}
+		host = host[idx+1:]
+	}
+}
+
+// Contain tells whether host or its parent domains are in list.
+func (dl *DomainList) Contain(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" || matchSuffix(dl.exceptions, host) {
+		return false
+	}
+	return matchSuffix(dl.domains, host)
+}
+
+// hostOf gets host from gfwlist pattern, like ||example.com,
+// |http://example.com/path, .example.com or example.com/path.
+// Empty means no host could be used, like regex and wildcard.
+func hostOf(pattern string) string {
+	switch {
+	case strings.HasPrefix(pattern, "/"):
+		return ""
+	case strings.HasPrefix(pattern, "||"):
+		pattern = pattern[2:]
+	case strings.HasPrefix(pattern, "|"):
+		u, err := url.Parse(pattern[1:])
+		if err != nil {
+			return ""
+		}
+		pattern = u.Host
+	}
+	if idx := strings.IndexAny(pattern, "/:^"); idx != -1 {
+		pattern = pattern[:idx]
+	}
+	if strings.ContainsAny(pattern, "*%") || !strings.Contains(pattern, ".") {
+		return ""
+	}
+	if net.ParseIP(pattern) != nil {
+		return ""
+	}
+	return pattern
+}
+
+// parseLine adds one line of gfwlist, dnsmasq conf or plain domains.
+func (dl *DomainList) parseLine(line string) {
+	switch {
+	case line == "", line[0] == '!', line[0] == '#', line[0] == '[':
+	case strings.HasPrefix(line, "@@"):
+		if host := hostOf(line[2:]); host != "" {
+			dl.AddException(host)
+		}
+	case strings.Contains(line, "=/"):
+		// dnsmasq, like server=/example.com/8.8.8.8 or ipset=/a.com/b.com/set.
+		fields := strings.Split(line[strings.Index(line, "=/")+2:], "/")
+		for _, domain := range fields[:len(fields)-1] {
+			dl.Add(domain)
+		}
+	default:
+		if host := hostOf(line); host != "" {
+			dl.Add(host)
+		}
+	}
+}
+
+// isBase64 tells whether data is gfwlist encoded in base64.
+func isBase64(data []byte) bool {
+	for _, c := range data {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c == '+', c == '/', c == '=', c == '\r', c == '\n':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ReadDomainList reads gfwlist, in base64 or not, dnsmasq conf, or just
+// domains one per line.
+func ReadDomainList(f io.Reader) (dl *DomainList, err error) {
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return
+	}
+	data = bytes.TrimSpace(data)
+	if isBase64(data) {
+		data, err = ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding,
+			bytes.NewReader(bytes.Join(bytes.Fields(data), nil))))
+		if err != nil {
+			return
+		}
+	}
+
+	dl = NewDomainList()
+	for _, line := range strings.Split(string(data), "\n") {
+		dl.parseLine(strings.TrimSpace(line))
+	}
+	logger.Noticef("domain list loaded %d domain(s) and %d exception(s).",
+		len(dl.domains), len(dl.exceptions))
+	return
+}
+
+func ReadDomainListFile(filename string) (dl *DomainList, err error) {
+	logger.Infof("load domain list from file %s.", filename)
+
+	var f io.ReadCloser
+	f, err = os.Open(filename)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	defer f.Close()
+
+	if strings.HasSuffix(filename, ".gz") {
+		f, err = gzip.NewReader(f)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+	}
+
+	return ReadDomainList(f)
+}
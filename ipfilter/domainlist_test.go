@@ -0,0 +1,114 @@
+package ipfilter
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/shell909090/goproxy/tunnel"
+)
+
+const gfwlist = `[AutoProxy 0.2.9]
+! comment
+||google.com
+|http://www.example.org/path
+.twitter.com
+youtube.com/watch
+@@||cn.google.com
+/^https?:\/\/[^\/]+blogspot\.(.*)/
+*.wildcard.com
+1.2.3.4
+`
+
+const dnsmasq = `# china list
+server=/baidu.com/114.114.114.114
+ipset=/qq.com/weixin.qq.com/setname
+`
+
+func checkDomains(t *testing.T, dl *DomainList, in, out []string) {
+	for _, host := range in {
+		if !dl.Contain(host) {
+			t.Errorf("%s should be in list.", host)
+		}
+	}
+	for _, host := range out {
+		if dl.Contain(host) {
+			t.Errorf("%s should not be in list.", host)
+		}
+	}
+}
+
+func TestDomainList(t *testing.T) {
+	tunnel.SetLogging()
+	in := []string{"google.com", "www.google.com", "WWW.Google.COM.",
+		"www.example.org", "api.twitter.com", "twitter.com", "youtube.com"}
+	out := []string{"cn.google.com", "x.cn.google.com", "example.org",
+		"notgoogle.com", "blogspot.com", "wildcard.com", "1.2.3.4", "com"}
+
+	dl, err := ReadDomainList(strings.NewReader(gfwlist))
+	if err != nil {
+		t.Fatalf("read gfwlist failed: %s", err)
+	}
+	checkDomains(t, dl, in, out)
+
+	// gfwlist is in base64 with lines of 64 chars.
+	encoded := base64.StdEncoding.EncodeToString([]byte(gfwlist))
+	var buf bytes.Buffer
+	for len(encoded) > 64 {
+		buf.WriteString(encoded[:64] + "\r\n")
+		encoded = encoded[64:]
+	}
+	buf.WriteString(encoded + "\n")
+	dl, err = ReadDomainList(&buf)
+	if err != nil {
+		t.Fatalf("read base64 gfwlist failed: %s", err)
+	}
+	checkDomains(t, dl, in, out)
+
+	dl, err = ReadDomainList(strings.NewReader(dnsmasq))
+	if err != nil {
+		t.Fatalf("read dnsmasq failed: %s", err)
+	}
+	checkDomains(t, dl, []string{"www.baidu.com", "qq.com", "weixin.qq.com"},
+		[]string{"setname", "114.114.114.114", "baidu.cn"})
+}
+
+// noResolver fails the test if any domain is resolved.
+type noResolver struct {
+	t *testing.T
+}
+
+func (nr noResolver) LookupIP(host string) (addrs []net.IP, err error) {
+	nr.t.Errorf("%s should not be resolved.", host)
+	return nil, ErrDNSNotFound
+}
+
+func writeTemp(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "goproxy")
+	if err != nil {
+		t.Fatalf("create temp file failed: %s", err)
+	}
+	defer f.Close()
+	_, err = f.WriteString(content)
+	if err != nil {
+		t.Fatalf("write temp file failed: %s", err)
+	}
+	return f.Name()
+}
+
+func TestDomainListNoResolve(t *testing.T) {
+	tunnel.SetLogging()
+	filename := writeTemp(t, gfwlist)
+	defer os.Remove(filename)
+
+	r := newTestRouter(t, "domain-list,"+filename+",proxy:us\nip-cidr,10.0.0.0/8,direct")
+	r.Resolver = noResolver{t}
+	_, err := r.Dial("tcp", "www.google.com:443")
+	if err == nil || err.Error() != "us" {
+		t.Errorf("www.google.com should go us, not %v.", err)
+	}
+}
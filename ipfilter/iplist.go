@@ -5,63 +5,156 @@ import (
 	"compress/gzip"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"os"
+	"sort"
 	"strings"
 
 	logging "github.com/op/go-logging"
 	"github.com/shell909090/goproxy/dns"
-	"github.com/shell909090/goproxy/netutil"
+	"github.com/shell909090/goproxy/metrics"
 )
 
 var logger = logging.MustGetLogger("ipfilter")
 
+// filtered addresses go direct, others go by proxy.
+var filterHits = metrics.NewCounterVec(
+	"goproxy_filter_hits_total", "Dials by filter result.", "action")
+
 var ErrDNSNotFound = errors.New("dns not found")
 
+type range4 struct {
+	low, high uint32
+}
+
+type uint128 struct {
+	hi, lo uint64
+}
+
+func (a uint128) less(b uint128) bool {
+	return a.hi < b.hi || (a.hi == b.hi && a.lo < b.lo)
+}
+
+func (a uint128) next() uint128 {
+	if a.lo == ^uint64(0) {
+		return uint128{a.hi + 1, 0}
+	}
+	return uint128{a.hi, a.lo + 1}
+}
+
+type range6 struct {
+	low, high uint128
+}
+
+func toUint128(ip net.IP) uint128 {
+	return uint128{
+		binary.BigEndian.Uint64(ip[:8]),
+		binary.BigEndian.Uint64(ip[8:16]),
+	}
+}
+
+// IPFilter keeps ranges sorted and merged, and looks up by binary search.
+// Ipv4 and ipv6 are kept apart.
 type IPFilter struct {
-	rest []*net.IPNet
-	idx1 map[byte][]*net.IPNet
-	idx2 map[uint16][]*net.IPNet
+	v4 []range4
+	v6 []range6
 }
 
-func ListConatins(iplist []*net.IPNet, ip net.IP) bool {
-	for _, ipnet := range iplist {
-		if ipnet.Contains(ip) {
-			logger.Debugf("%s matched %s.", ip.String(), ipnet.String())
-			return true
-		}
+func NewIPFilter(ipnets []*net.IPNet) (filter *IPFilter) {
+	filter = &IPFilter{}
+	for _, ipnet := range ipnets {
+		filter.add(ipnet)
 	}
-	return false
+	filter.merge()
+	return
 }
 
-func (f IPFilter) Contain(ip net.IP) bool {
-	if x := ip.To4(); x != nil {
-		ip = x
+// add ipnet to filter, merge should be called after all added.
+func (f *IPFilter) add(ipnet *net.IPNet) {
+	ip, mask := ipnet.IP, ipnet.Mask
+	// ipv4 mapped in ipv6, like ::ffff:10.0.0.0/104.
+	if len(mask) == net.IPv6len && ip.To4() != nil {
+		ip, mask = ip.To4(), mask[12:]
 	}
 
-	prefix2 := binary.BigEndian.Uint16(ip[:2])
-	if iplist, ok := f.idx2[prefix2]; ok {
-		if ListConatins(iplist, ip) {
-			return true
-		}
+	if len(mask) == net.IPv4len {
+		ip = ip.To4()
+		low := binary.BigEndian.Uint32(ip) & binary.BigEndian.Uint32(mask)
+		high := low | ^binary.BigEndian.Uint32(mask)
+		f.v4 = append(f.v4, range4{low, high})
+		return
 	}
 
-	prefix1 := ip[0]
-	if iplist, ok := f.idx1[prefix1]; ok {
-		if ListConatins(iplist, ip) {
-			return true
+	ip = ip.To16()
+	m := toUint128(net.IP(mask))
+	low := toUint128(ip)
+	low = uint128{low.hi & m.hi, low.lo & m.lo}
+	high := uint128{low.hi | ^m.hi, low.lo | ^m.lo}
+	f.v6 = append(f.v6, range6{low, high})
+}
+
+// merge sorts ranges, and joins the overlapped or adjacent ones.
+func (f *IPFilter) merge() {
+	sort.Slice(f.v4, func(i, j int) bool {
+		return f.v4[i].low < f.v4[j].low
+	})
+	v4 := f.v4[:0]
+	for _, r := range f.v4 {
+		last := len(v4) - 1
+		if last >= 0 && (r.low <= v4[last].high || r.low == v4[last].high+1) {
+			if r.high > v4[last].high {
+				v4[last].high = r.high
+			}
+			continue
+		}
+		v4 = append(v4, r)
+	}
+	f.v4 = v4
+
+	sort.Slice(f.v6, func(i, j int) bool {
+		return f.v6[i].low.less(f.v6[j].low)
+	})
+	v6 := f.v6[:0]
+	for _, r := range f.v6 {
+		last := len(v6) - 1
+		if last >= 0 && (!v6[last].high.less(r.low) || r.low == v6[last].high.next()) {
+			if v6[last].high.less(r.high) {
+				v6[last].high = r.high
+			}
+			continue
 		}
+		v6 = append(v6, r)
 	}
+	f.v6 = v6
+}
+
+// GetSize returns how many ranges after merged.
+func (f *IPFilter) GetSize() int {
+	return len(f.v4) + len(f.v6)
+}
 
-	if ListConatins(f.rest, ip) {
-		return true
+func (f *IPFilter) Contain(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		x := binary.BigEndian.Uint32(ip4)
+		i := sort.Search(len(f.v4), func(i int) bool {
+			return f.v4[i].high >= x
+		})
+		return i < len(f.v4) && f.v4[i].low <= x
 	}
 
-	logger.Debugf("%s not match anything.", ip.String())
-	return false
+	if len(ip) != net.IPv6len {
+		return false
+	}
+	x := toUint128(ip)
+	i := sort.Search(len(f.v6), func(i int) bool {
+		return !f.v6[i].high.less(x)
+	})
+	return i < len(f.v6) && !x.less(f.v6[i].low)
 }
 
+// ParseLine parses cidr, ip and mask split by space, or just an ip.
 func ParseLine(line string) (ipnet *net.IPNet, err error) {
 	_, ipnet, err = net.ParseCIDR(line)
 	if err == nil {
@@ -69,29 +162,44 @@ func ParseLine(line string) (ipnet *net.IPNet, err error) {
 	}
 	err = nil
 
-	addrs := strings.Split(line, " ")
+	addrs := strings.Fields(line)
+	if len(addrs) == 0 || len(addrs) > 2 {
+		return nil, fmt.Errorf("iplist format error: %s.", line)
+	}
 
 	ip := net.ParseIP(addrs[0])
+	if ip == nil {
+		return nil, fmt.Errorf("iplist format error: %s.", line)
+	}
 	if x := ip.To4(); x != nil {
 		ip = x
 	}
 
+	if len(addrs) == 1 {
+		ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+		return
+	}
+
 	mask := net.ParseIP(addrs[1])
-	if x := mask.To4(); x != nil {
+	if mask == nil {
+		return nil, fmt.Errorf("iplist format error: %s.", line)
+	}
+	if x := mask.To4(); x != nil && len(ip) == net.IPv4len {
 		mask = x
 	}
+	if len(mask) != len(ip) {
+		return nil, fmt.Errorf("iplist format error: %s.", line)
+	}
 
 	ipnet = &net.IPNet{IP: ip, Mask: net.IPMask(mask)}
 	return
 }
 
+// ReadIPList reads one range per line, empty lines and lines start with #
+// are skipped.
 func ReadIPList(f io.Reader) (filter *IPFilter, err error) {
 	reader := bufio.NewReader(f)
-	filter = &IPFilter{
-		idx1: make(map[byte][]*net.IPNet),
-		idx2: make(map[uint16][]*net.IPNet),
-	}
-	counter := 0
+	var ipnets []*net.IPNet
 
 	var ipnet *net.IPNet
 QUIT:
@@ -108,30 +216,22 @@ QUIT:
 			return nil, err
 		}
 		line = strings.Trim(line, "\r\n ")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
 
 		ipnet, err = ParseLine(line)
 		if err != nil {
 			logger.Error(err.Error())
 			return nil, err
 		}
-
-		ones, _ := ipnet.Mask.Size()
-		switch {
-		case ones < 8:
-			filter.rest = append(filter.rest, ipnet)
-		case ones >= 8 && ones < 16:
-			prefix := ipnet.IP[0]
-			filter.idx1[prefix] = append(filter.idx1[prefix], ipnet)
-		default:
-			prefix := binary.BigEndian.Uint16(ipnet.IP[:2])
-			filter.idx2[prefix] = append(filter.idx2[prefix], ipnet)
-		}
-		counter++
+		ipnets = append(ipnets, ipnet)
 	}
 
+	filter = NewIPFilter(ipnets)
 	logger.Noticef(
-		"blacklist loaded %d record(s), %d index1, %d index2 and %d no indexed.",
-		counter, len(filter.idx1), len(filter.idx2), len(filter.rest))
+		"iplist loaded %d record(s), %d ipv4 and %d ipv6 range(s) after merged.",
+		len(ipnets), len(filter.v4), len(filter.v6))
 	return
 }
 
@@ -157,32 +257,6 @@ func ReadIPListFile(filename string) (filter *IPFilter, err error) {
 	return ReadIPList(f)
 }
 
-type FilterPair struct {
-	dialer netutil.Dialer
-	filter *IPFilter
-}
-
-type FilteredDialer struct {
-	dialer netutil.Dialer
-	dns.Resolver
-	fps []*FilterPair
-}
-
-func NewFilteredDialer(dialer netutil.Dialer) (fd *FilteredDialer) {
-	fd = &FilteredDialer{
-		dialer:   dialer,
-		Resolver: CreateDNSCache(),
-	}
-	return
-}
-
-func (fd *FilteredDialer) LoadFilter(dialer netutil.Dialer, filename string) (err error) {
-	fp := &FilterPair{dialer: dialer}
-	fp.filter, err = ReadIPListFile(filename)
-	fd.fps = append(fd.fps, fp)
-	return
-}
-
 func Getaddrs(resolver dns.Resolver, hostname string) (ips []net.IP) {
 	ip := net.ParseIP(hostname)
 	if ip != nil {
@@ -195,31 +269,3 @@ func Getaddrs(resolver dns.Resolver, hostname string) (ips []net.IP) {
 	}
 	return
 }
-
-func (fd *FilteredDialer) Dial(network, address string) (conn net.Conn, err error) {
-	logger.Infof("filter dial: %s", address)
-	if len(fd.fps) == 0 {
-		return fd.dialer.Dial(network, address)
-	}
-
-	hostname, _, err := net.SplitHostPort(address)
-	if err != nil {
-		logger.Error(err.Error())
-		return
-	}
-
-	addrs := Getaddrs(fd.Resolver, hostname)
-	if addrs == nil {
-		return nil, ErrDNSNotFound
-	}
-
-	for _, fp := range fd.fps {
-		for _, addr := range addrs {
-			if fp.filter.Contain(addr) {
-				return fp.dialer.Dial(network, address)
-			}
-		}
-	}
-
-	return fd.dialer.Dial(network, address)
-}
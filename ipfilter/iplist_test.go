@@ -2,7 +2,12 @@ package ipfilter
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"math/rand"
 	"net"
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/shell909090/goproxy/tunnel"
@@ -31,3 +36,188 @@ func TestIPList(t *testing.T) {
 		t.Fatalf("Contain wrong3.")
 	}
 }
+
+const mixedlist = `# comments and empty lines are skipped.
+
+10.0.0.0/9
+10.128.0.0/9
+10.1.0.0/16
+11.0.0.0 255.255.0.0
+11.1.0.0 255.255.0.0
+1.2.3.4
+2001:db8::/32
+2001:db9::/32
+fe80::/10
+::ffff:100.64.0.0/106
+255.255.255.255
+`
+
+func TestIPListMixed(t *testing.T) {
+	tunnel.SetLogging()
+
+	filter, err := ReadIPList(strings.NewReader(mixedlist))
+	if err != nil {
+		t.Fatalf("ReadIPList failed: %s", err)
+	}
+	// 10/9, 10.128/9, 10.1/16, 11.0/16 and 11.1/16 are merged into one.
+	// 2001:db8::/32 and 2001:db9::/32 are adjacent.
+	if len(filter.v4) != 4 || len(filter.v6) != 2 {
+		t.Fatalf("ranges not merged: %d ipv4 and %d ipv6.",
+			len(filter.v4), len(filter.v6))
+	}
+
+	for _, s := range []string{"10.0.0.0", "10.255.255.255", "11.1.2.3",
+		"1.2.3.4", "100.100.1.1", "255.255.255.255", "2001:db8::1",
+		"2001:db9:ffff::1", "fe80::1", "febf::1"} {
+		if !filter.Contain(net.ParseIP(s)) {
+			t.Errorf("%s should be in list.", s)
+		}
+	}
+	for _, s := range []string{"9.255.255.255", "11.2.0.0", "1.2.3.5",
+		"100.128.0.0", "0.0.0.0", "2001:dba::1", "fec0::1", "::1",
+		"::ffff:0:1"} {
+		if filter.Contain(net.ParseIP(s)) {
+			t.Errorf("%s should not be in list.", s)
+		}
+	}
+}
+
+func TestParseLineError(t *testing.T) {
+	for _, line := range []string{"10.0.0.0/33", "10.0.0.0 255.0.0.0 x",
+		"a.b.c.d", "10.0.0.0 mask", "10.0.0.0 ffff::"} {
+		if _, err := ParseLine(line); err == nil {
+			t.Errorf("line %s should be wrong.", line)
+		}
+	}
+}
+
+// legacyFilter is the old one, indexed by the first one or two bytes,
+// kept to compare in benchmarks.
+type legacyFilter struct {
+	rest []*net.IPNet
+	idx1 map[byte][]*net.IPNet
+	idx2 map[uint16][]*net.IPNet
+}
+
+func legacyContains(iplist []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range iplist {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *legacyFilter) Contain(ip net.IP) bool {
+	if x := ip.To4(); x != nil {
+		ip = x
+	}
+	if legacyContains(f.idx2[binary.BigEndian.Uint16(ip[:2])], ip) {
+		return true
+	}
+	if legacyContains(f.idx1[ip[0]], ip) {
+		return true
+	}
+	return legacyContains(f.rest, ip)
+}
+
+func newLegacyFilter(ipnets []*net.IPNet) (f *legacyFilter) {
+	f = &legacyFilter{
+		idx1: make(map[byte][]*net.IPNet),
+		idx2: make(map[uint16][]*net.IPNet),
+	}
+	for _, ipnet := range ipnets {
+		ones, _ := ipnet.Mask.Size()
+		switch {
+		case ones < 8:
+			f.rest = append(f.rest, ipnet)
+		case ones >= 8 && ones < 16:
+			prefix := ipnet.IP[0]
+			f.idx1[prefix] = append(f.idx1[prefix], ipnet)
+		default:
+			prefix := binary.BigEndian.Uint16(ipnet.IP[:2])
+			f.idx2[prefix] = append(f.idx2[prefix], ipnet)
+		}
+	}
+	return
+}
+
+func readRoutes(tb testing.TB) (ipnets []*net.IPNet) {
+	f, err := os.Open("../debian/routes.list.gz")
+	if err != nil {
+		tb.Skip("routes.list.gz not found.")
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var buf bytes.Buffer
+	buf.ReadFrom(r)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		ipnet, err := ParseLine(strings.TrimSpace(line))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		ipnets = append(ipnets, ipnet)
+	}
+	return
+}
+
+type container interface {
+	Contain(ip net.IP) bool
+}
+
+func randomIPs(n int) (ips []net.IP) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < n; i++ {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, rnd.Uint32())
+		ips = append(ips, ip)
+	}
+	return
+}
+
+func benchmarkContain(b *testing.B, f container) {
+	ips := randomIPs(1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.Contain(ips[i%len(ips)])
+	}
+}
+
+func BenchmarkContain(b *testing.B) {
+	benchmarkContain(b, NewIPFilter(readRoutes(b)))
+}
+
+func BenchmarkContainLegacy(b *testing.B) {
+	benchmarkContain(b, newLegacyFilter(readRoutes(b)))
+}
+
+func BenchmarkLoad(b *testing.B) {
+	ipnets := readRoutes(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewIPFilter(ipnets)
+	}
+}
+
+func BenchmarkLoadLegacy(b *testing.B) {
+	ipnets := readRoutes(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		newLegacyFilter(ipnets)
+	}
+}
+
+// both should say the same for ipv4.
+func TestLegacyCompatible(t *testing.T) {
+	tunnel.SetLogging()
+	ipnets := readRoutes(t)
+	filter, legacy := NewIPFilter(ipnets), newLegacyFilter(ipnets)
+	for _, ip := range randomIPs(100000) {
+		if filter.Contain(ip) != legacy.Contain(ip) {
+			t.Fatalf("%s matched differently.", ip)
+		}
+	}
+}
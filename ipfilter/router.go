@@ -0,0 +1,470 @@
+package ipfilter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/shell909090/goproxy/dns"
+	"github.com/shell909090/goproxy/netutil"
+)
+
+var (
+	ErrRejected = errors.New("rejected by rule.")
+	ErrNoGroup  = errors.New("server group not found.")
+)
+
+const (
+	ACT_DIRECT = iota
+	ACT_PROXY
+	ACT_REJECT
+)
+
+// target is what a rule matches.
+type target struct {
+	src      net.IP
+	host     string // lower case domain, empty if target is an ip.
+	port     int
+	ips      []net.IP
+	resolved bool
+	resolver dns.Resolver
+}
+
+// addresses of target, domain is resolved at the first call.
+func (t *target) getIPs() []net.IP {
+	if !t.resolved {
+		t.resolved = true
+		t.ips = Getaddrs(t.resolver, t.host)
+	}
+	return t.ips
+}
+
+func (t *target) matchIPs(f func(ip net.IP) bool) bool {
+	for _, ip := range t.getIPs() {
+		if f(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rule is one line of rules file, like "domain-suffix,google.com,proxy:us".
+type Rule struct {
+	Type   string
+	Value  string
+	Action string // direct, reject, proxy or proxy:<group>
+	act    int
+	group  string
+	match  func(t *target) bool
+}
+
+func (rule *Rule) String() string {
+	return fmt.Sprintf("%s,%s,%s", rule.Type, rule.Value, rule.Action)
+}
+
+func (rule *Rule) parseAction() (err error) {
+	action := strings.ToLower(rule.Action)
+	switch {
+	case action == "direct":
+		rule.act = ACT_DIRECT
+	case action == "reject":
+		rule.act = ACT_REJECT
+	case action == "proxy":
+		rule.act = ACT_PROXY
+	case strings.HasPrefix(action, "proxy:"):
+		rule.act = ACT_PROXY
+		rule.group = rule.Action[len("proxy:"):]
+	default:
+		return fmt.Errorf("unknown rule action: %s.", rule.Action)
+	}
+	return
+}
+
+func parsePortRange(s string) (low, high int, err error) {
+	pair := strings.SplitN(s, "-", 2)
+	low, err = strconv.Atoi(pair[0])
+	if err != nil {
+		return
+	}
+	high = low
+	if len(pair) == 2 {
+		high, err = strconv.Atoi(pair[1])
+		if err != nil {
+			return
+		}
+	}
+	if low < 0 || high > 65535 || low > high {
+		err = fmt.Errorf("port range error: %s.", s)
+	}
+	return
+}
+
+// RuleLoader parses rules, lists are loaded once and shared by rules.
+type RuleLoader struct {
+	// GeoIPDir has country lists, like cn.list or cn.list.gz.
+	GeoIPDir string
+	lists    map[string]*IPFilter
+	domains  map[string]*DomainList
+}
+
+func NewRuleLoader(geoipdir string) (rl *RuleLoader) {
+	return &RuleLoader{
+		GeoIPDir: geoipdir,
+		lists:    make(map[string]*IPFilter),
+		domains:  make(map[string]*DomainList),
+	}
+}
+
+func (rl *RuleLoader) loadDomains(filename string) (dl *DomainList, err error) {
+	if dl, ok := rl.domains[filename]; ok {
+		return dl, nil
+	}
+	dl, err = ReadDomainListFile(filename)
+	if err != nil {
+		return
+	}
+	rl.domains[filename] = dl
+	return
+}
+
+func (rl *RuleLoader) loadList(filename string) (filter *IPFilter, err error) {
+	if filter, ok := rl.lists[filename]; ok {
+		return filter, nil
+	}
+	filter, err = ReadIPListFile(filename)
+	if err != nil {
+		return
+	}
+	rl.lists[filename] = filter
+	return
+}
+
+func (rl *RuleLoader) loadCountry(country string) (filter *IPFilter, err error) {
+	if rl.GeoIPDir == "" {
+		return nil, fmt.Errorf("geoipdir not set for country %s.", country)
+	}
+	base := filepath.Join(rl.GeoIPDir, strings.ToLower(country)+".list")
+	for _, filename := range []string{base, base + ".gz"} {
+		if _, err = os.Stat(filename); err == nil {
+			return rl.loadList(filename)
+		}
+	}
+	return nil, fmt.Errorf("no list for country %s in %s.", country, rl.GeoIPDir)
+}
+
+// Parse one rule, "type,value,action", or "match,action".
+func (rl *RuleLoader) Parse(line string) (rule *Rule, err error) {
+	first, last := strings.Index(line, ","), strings.LastIndex(line, ",")
+	if first == -1 {
+		return nil, fmt.Errorf("rule format error: %s.", line)
+	}
+	rule = &Rule{
+		Type:   strings.ToLower(strings.TrimSpace(line[:first])),
+		Action: strings.TrimSpace(line[last+1:]),
+	}
+	if first != last {
+		rule.Value = strings.TrimSpace(line[first+1 : last])
+	}
+	err = rule.parseAction()
+	if err != nil {
+		return
+	}
+	if rule.Value == "" && rule.Type != "match" {
+		return nil, fmt.Errorf("rule without value: %s.", line)
+	}
+
+	value := strings.ToLower(strings.Trim(rule.Value, "."))
+	switch rule.Type {
+	case "domain":
+		rule.match = func(t *target) bool {
+			return t.host == value
+		}
+	case "domain-suffix":
+		rule.match = func(t *target) bool {
+			return t.host == value || strings.HasSuffix(t.host, "."+value)
+		}
+	case "domain-keyword":
+		rule.match = func(t *target) bool {
+			return t.host != "" && strings.Contains(t.host, value)
+		}
+	case "domain-regex":
+		var re *regexp.Regexp
+		re, err = regexp.Compile(rule.Value)
+		if err != nil {
+			return
+		}
+		rule.match = func(t *target) bool {
+			return t.host != "" && re.MatchString(t.host)
+		}
+	case "domain-list":
+		var dl *DomainList
+		dl, err = rl.loadDomains(rule.Value)
+		if err != nil {
+			return
+		}
+		rule.match = func(t *target) bool {
+			return t.host != "" && dl.Contain(t.host)
+		}
+	case "ip-cidr":
+		var ipnet *net.IPNet
+		_, ipnet, err = net.ParseCIDR(rule.Value)
+		if err != nil {
+			return
+		}
+		rule.match = func(t *target) bool {
+			return t.matchIPs(ipnet.Contains)
+		}
+	case "ip-list", "geoip":
+		var filter *IPFilter
+		if rule.Type == "ip-list" {
+			filter, err = rl.loadList(rule.Value)
+		} else {
+			filter, err = rl.loadCountry(rule.Value)
+		}
+		if err != nil {
+			return
+		}
+		rule.match = func(t *target) bool {
+			return t.matchIPs(filter.Contain)
+		}
+	case "port":
+		var low, high int
+		low, high, err = parsePortRange(rule.Value)
+		if err != nil {
+			return
+		}
+		rule.match = func(t *target) bool {
+			return t.port >= low && t.port <= high
+		}
+	case "src-cidr":
+		var ipnet *net.IPNet
+		_, ipnet, err = net.ParseCIDR(rule.Value)
+		if err != nil {
+			return
+		}
+		rule.match = func(t *target) bool {
+			return t.src != nil && ipnet.Contains(t.src)
+		}
+	case "match":
+		rule.match = func(t *target) bool {
+			return true
+		}
+	default:
+		return nil, fmt.Errorf("unknown rule type: %s.", rule.Type)
+	}
+	return
+}
+
+// Read rules, one per line. Empty lines and lines start with # are skipped.
+func (rl *RuleLoader) Read(r io.Reader) (rules []*Rule, err error) {
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var rule *Rule
+		rule, err = rl.Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineno, err.Error())
+		}
+		rules = append(rules, rule)
+	}
+	err = scanner.Err()
+	return
+}
+
+func (rl *RuleLoader) ReadFile(filename string) (rules []*Rule, err error) {
+	logger.Infof("load rules from file %s.", filename)
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	rules, err = rl.Read(f)
+	if err != nil {
+		return
+	}
+	logger.Noticef("rules loaded %d record(s).", len(rules))
+	return
+}
+
+// Router dials by rules, the first matched one decides. Target matched
+// nothing goes by proxy of default group.
+// use lock to protect: rules, groups, disabled.
+type Router struct {
+	dns.Resolver
+	Direct   netutil.Dialer
+	lock     sync.RWMutex
+	rules    []*Rule
+	groups   map[string]netutil.Dialer
+	disabled bool
+}
+
+// NewRouter creates a router, dialer is the default group, named "".
+func NewRouter(dialer netutil.Dialer) (r *Router) {
+	return &Router{
+		Resolver: dns.DefaultCache,
+		Direct:   netutil.DefaultTcpDialer,
+		groups:   map[string]netutil.Dialer{"": dialer},
+	}
+}
+
+// SetGroup adds or replaces dialer of server group.
+func (r *Router) SetGroup(name string, dialer netutil.Dialer) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.groups[name] = dialer
+}
+
+// CheckRules makes sure groups in rules are all in groups.
+func CheckRules(rules []*Rule, groups func(string) bool) (err error) {
+	for _, rule := range rules {
+		if rule.act == ACT_PROXY && !groups(rule.group) {
+			return fmt.Errorf("%s: %s", rule.String(), ErrNoGroup.Error())
+		}
+	}
+	return
+}
+
+// SetRules replaces rules, groups in them should be set before.
+func (r *Router) SetRules(rules []*Rule) (err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	err = CheckRules(rules, func(name string) bool {
+		_, ok := r.groups[name]
+		return ok
+	})
+	if err != nil {
+		return
+	}
+	r.rules = rules
+	return
+}
+
+// SetEnabled turns rules on or off, all goes to default group when off.
+func (r *Router) SetEnabled(on bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.disabled = !on
+	logger.Noticef("rules enabled: %t.", on)
+}
+
+func (r *Router) IsEnabled() bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return !r.disabled
+}
+
+func (r *Router) GetSize() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return len(r.rules)
+}
+
+// BySource tells whether any src-cidr rule is on.
+func (r *Router) BySource() bool {
+	for _, rule := range r.getRules() {
+		if rule.Type == "src-cidr" {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Router) getRules() []*Rule {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if r.disabled {
+		return nil
+	}
+	return r.rules
+}
+
+// Route returns the rule matched, nil means default.
+func (r *Router) Route(src, address string) (rule *Rule, err error) {
+	rules := r.getRules()
+	if len(rules) == 0 {
+		return
+	}
+
+	hostname, portstr, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	t := &target{resolver: r.Resolver}
+	t.port, err = strconv.Atoi(portstr)
+	if err != nil {
+		return
+	}
+	if ip := net.ParseIP(hostname); ip != nil {
+		t.ips, t.resolved = []net.IP{ip}, true
+	} else {
+		t.host = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	}
+	if src != "" {
+		if host, _, err := net.SplitHostPort(src); err == nil {
+			src = host
+		}
+		t.src = net.ParseIP(src)
+	}
+
+	for _, rule = range rules {
+		if rule.match(t) {
+			logger.Debugf("%s matched rule %s.", address, rule.String())
+			return
+		}
+	}
+	return nil, nil
+}
+
+// Lookup tells whether hostname goes direct with rules now.
+func (r *Router) Lookup(hostname string) (direct bool, err error) {
+	rule, err := r.Route("", net.JoinHostPort(hostname, "80"))
+	return rule != nil && rule.act == ACT_DIRECT, err
+}
+
+func (r *Router) Dial(network, address string) (conn net.Conn, err error) {
+	return r.DialFrom("", network, address)
+}
+
+func (r *Router) DialFrom(src, network, address string) (conn net.Conn, err error) {
+	logger.Infof("route dial: %s", address)
+	rule, err := r.Route(src, address)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+
+	var group string
+	if rule != nil {
+		switch rule.act {
+		case ACT_DIRECT:
+			filterHits.Inc("direct")
+			return r.Direct.Dial(network, address)
+		case ACT_REJECT:
+			filterHits.Inc("reject")
+			return nil, ErrRejected
+		}
+		group = rule.group
+	}
+
+	r.lock.RLock()
+	dialer, ok := r.groups[group]
+	r.lock.RUnlock()
+	if !ok {
+		return nil, ErrNoGroup
+	}
+	filterHits.Inc("proxy")
+	return netutil.DialFrom(dialer, src, network, address)
+}
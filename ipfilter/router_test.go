@@ -0,0 +1,149 @@
+package ipfilter
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/shell909090/goproxy/tunnel"
+)
+
+const rules = `
+# comments and empty lines are skipped.
+domain-keyword,ads,reject
+domain-regex,^cdn[0-9]+\.,proxy:us
+domain-suffix,example.com,proxy:us
+domain,www.example.org,direct
+port,6000-6010,reject
+src-cidr,192.168.2.0/24,proxy:us
+ip-cidr,10.0.0.0/8,direct
+`
+
+type fakeResolver map[string][]net.IP
+
+func (fr fakeResolver) LookupIP(host string) (addrs []net.IP, err error) {
+	addrs, ok := fr[host]
+	if !ok {
+		return nil, errors.New("not found.")
+	}
+	return
+}
+
+type nameDialer string
+
+func (nd nameDialer) Dial(network, address string) (net.Conn, error) {
+	return nil, errors.New(string(nd))
+}
+
+func newTestRouter(t *testing.T, rules string) (r *Router) {
+	tunnel.SetLogging()
+	r = NewRouter(nameDialer("default"))
+	r.Direct = nameDialer("direct")
+	r.Resolver = fakeResolver{
+		"intranet.local": []net.IP{net.ParseIP("10.1.1.1")},
+	}
+	r.SetGroup("us", nameDialer("us"))
+
+	parsed, err := NewRuleLoader("").Read(strings.NewReader(rules))
+	if err != nil {
+		t.Fatalf("read rules failed: %s", err)
+	}
+	err = r.SetRules(parsed)
+	if err != nil {
+		t.Fatalf("set rules failed: %s", err)
+	}
+	return
+}
+
+func TestRouterDial(t *testing.T) {
+	r := newTestRouter(t, rules)
+
+	cases := []struct {
+		src     string
+		address string
+		result  string
+	}{
+		{"", "ads.example.com:80", ErrRejected.Error()},
+		{"", "cdn12.example.net:443", "us"},
+		{"", "www.example.com:443", "us"},
+		{"", "example.com.:443", "us"},
+		{"", "badexample.com:443", "default"},
+		{"", "www.example.org:80", "direct"},
+		{"", "www.example.org:6005", "direct"},
+		{"", "www.example.net:6005", ErrRejected.Error()},
+		{"192.168.2.3:5000", "www.example.net:80", "us"},
+		{"192.168.3.3:5000", "www.example.net:80", "default"},
+		{"", "10.2.3.4:80", "direct"},
+		{"", "intranet.local:80", "direct"},
+		{"", "unknown.local:80", "default"},
+	}
+	for _, c := range cases {
+		_, err := r.DialFrom(c.src, "tcp", c.address)
+		if err == nil || err.Error() != c.result {
+			t.Errorf("%s from %s should go %s, not %v.",
+				c.address, c.src, c.result, err)
+		}
+	}
+
+	if !r.BySource() {
+		t.Errorf("router with src-cidr should route by source.")
+	}
+
+	r.SetEnabled(false)
+	_, err := r.Dial("tcp", "ads.example.com:80")
+	if err == nil || err.Error() != "default" {
+		t.Errorf("disabled router should go default, not %v.", err)
+	}
+	if r.BySource() {
+		t.Errorf("disabled router shouldn't route by source.")
+	}
+}
+
+func TestRouterMatch(t *testing.T) {
+	r := newTestRouter(t, "ip-cidr,10.0.0.0/8,direct\nmatch,reject")
+
+	if r.BySource() {
+		t.Fatalf("router without src-cidr shouldn't route by source.")
+	}
+	direct, err := r.Lookup("10.0.0.1")
+	if err != nil || !direct {
+		t.Fatalf("10.0.0.1 should go direct.")
+	}
+	_, err = r.Dial("tcp", "www.example.com:80")
+	if err != ErrRejected {
+		t.Fatalf("match should reject others, not %v.", err)
+	}
+}
+
+func TestRuleParse(t *testing.T) {
+	loader := NewRuleLoader("")
+	for _, line := range []string{
+		"domain-suffix,example.com",
+		"domain-suffix,example.com,forward",
+		"domain-suffix,,direct",
+		"unknown,example.com,direct",
+		"ip-cidr,10.0.0.0,direct",
+		"port,70000,direct",
+		"domain-regex,(,direct",
+		"geoip,cn,direct",
+	} {
+		if _, err := loader.Parse(line); err == nil {
+			t.Errorf("rule %s should be wrong.", line)
+		}
+	}
+
+	rule, err := loader.Parse("Domain-Regex, ^a{1,3}\\.com$ , proxy:us")
+	if err != nil {
+		t.Fatalf("parse failed: %s", err)
+	}
+	if rule.String() != "domain-regex,^a{1,3}\\.com$,proxy:us" {
+		t.Fatalf("rule parsed wrong: %s.", rule.String())
+	}
+
+	r := NewRouter(nameDialer("default"))
+	err = r.SetRules([]*Rule{rule})
+	if err == nil {
+		t.Fatalf("rule with unknown group should be wrong.")
+	}
+}
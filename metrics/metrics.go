@@ -0,0 +1,292 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// series more than this goes to label value OTHER.
+	MAX_SERIES = 1000
+	OTHER      = "other"
+)
+
+var (
+	DefBuckets = []float64{
+		.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+	escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// Metric writes itself in prometheus text format.
+type Metric interface {
+	Collect(w io.Writer)
+}
+
+var (
+	lock     sync.Mutex
+	registry []Metric
+)
+
+func Register(m Metric) {
+	lock.Lock()
+	defer lock.Unlock()
+	registry = append(registry, m)
+}
+
+type Sample struct {
+	Labels []string // name and value, one after another.
+	Value  float64
+}
+
+// WriteMetric writes metric collected by caller, like gauges read at scrape.
+func WriteMetric(w io.Writer, name, help, typ string, samples ...Sample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	for _, s := range samples {
+		writeSample(w, name, s.Labels, s.Value)
+	}
+}
+
+func writeSample(w io.Writer, name string, labels []string, v float64) {
+	var buf bytes.Buffer
+	buf.WriteString(name)
+	if len(labels) > 0 {
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(labels[i])
+			buf.WriteString("=\"")
+			buf.WriteString(escaper.Replace(labels[i+1]))
+			buf.WriteByte('"')
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(formatFloat(v))
+	buf.WriteByte('\n')
+	w.Write(buf.Bytes())
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// series keeps values of a vec by label values, no more than MAX_SERIES.
+// When exceeded, the overflow label goes to OTHER, or all of them if
+// it's not set.
+type series struct {
+	name     string
+	help     string
+	labels   []string
+	keys     map[string][]string
+	overflow int
+}
+
+func newSeries(name, help string, labels []string) series {
+	return series{
+		name:     name,
+		help:     help,
+		labels:   labels,
+		keys:     make(map[string][]string),
+		overflow: -1,
+	}
+}
+
+// SetOverflow sets the only label goes to OTHER, should be called before
+// vec used.
+func (s *series) SetOverflow(label string) {
+	for i, l := range s.labels {
+		if l == label {
+			s.overflow = i
+			return
+		}
+	}
+	panic(fmt.Sprintf("metric %s has no label %s.", s.name, label))
+}
+
+// call with lock of vec.
+func (s *series) key(values []string) (key string) {
+	if len(values) != len(s.labels) {
+		panic(fmt.Sprintf("metric %s needs %d labels.", s.name, len(s.labels)))
+	}
+	key = strings.Join(values, "\x00")
+	if _, ok := s.keys[key]; ok {
+		return
+	}
+	if len(s.keys) >= MAX_SERIES {
+		others := make([]string, len(values))
+		for i := range others {
+			others[i] = OTHER
+			if s.overflow >= 0 && i != s.overflow {
+				others[i] = values[i]
+			}
+		}
+		values = others
+		key = strings.Join(values, "\x00")
+		if _, ok := s.keys[key]; ok {
+			return
+		}
+	}
+	s.keys[key] = append([]string(nil), values...)
+	return
+}
+
+// call with lock of vec.
+func (s *series) sortedKeys() (keys []string) {
+	for k := range s.keys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
+
+// call with lock of vec.
+func (s *series) pairs(key string, extra ...string) (labels []string) {
+	for i, v := range s.keys[key] {
+		labels = append(labels, s.labels[i], v)
+	}
+	return append(labels, extra...)
+}
+
+type CounterVec struct {
+	lock sync.Mutex
+	series
+	values map[string]float64
+}
+
+// NewCounterVec creates and registers a counter.
+func NewCounterVec(name, help string, labels ...string) (c *CounterVec) {
+	c = &CounterVec{
+		series: newSeries(name, help, labels),
+		values: make(map[string]float64),
+	}
+	Register(c)
+	return
+}
+
+func (c *CounterVec) Add(v float64, values ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[c.key(values)] += v
+}
+
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) Get(values ...string) float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.values[c.key(values)]
+}
+
+func (c *CounterVec) Collect(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, k := range c.sortedKeys() {
+		writeSample(w, c.name, c.pairs(k), c.values[k])
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type HistogramVec struct {
+	lock sync.Mutex
+	series
+	buckets []float64
+	values  map[string]*histogram
+}
+
+// NewHistogramVec creates and registers a histogram, nil buckets means
+// DefBuckets.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) (h *HistogramVec) {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	h = &HistogramVec{
+		series:  newSeries(name, help, labels),
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+	Register(h)
+	return
+}
+
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	key := h.key(values)
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *HistogramVec) Collect(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, k := range h.sortedKeys() {
+		hist := h.values[k]
+		if hist == nil {
+			continue
+		}
+		for i, b := range h.buckets {
+			writeSample(w, h.name+"_bucket",
+				h.pairs(k, "le", formatFloat(b)), float64(hist.counts[i]))
+		}
+		writeSample(w, h.name+"_bucket",
+			h.pairs(k, "le", "+Inf"), float64(hist.count))
+		writeSample(w, h.name+"_sum", h.pairs(k), hist.sum)
+		writeSample(w, h.name+"_count", h.pairs(k), float64(hist.count))
+	}
+}
+
+// Handler writes all registered metrics, then the ones from collectors.
+func Handler(collectors ...func(io.Writer)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		lock.Lock()
+		metrics := registry
+		lock.Unlock()
+
+		for _, m := range metrics {
+			m.Collect(w)
+		}
+		for _, c := range collectors {
+			c(w)
+		}
+	}
+}
+
+// AuthFailures is shared by all services which auth users.
+var AuthFailures = NewCounterVec(
+	"goproxy_auth_failures_total", "Auth failures by service.", "service")
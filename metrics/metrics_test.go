@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	c := NewCounterVec("test_counter_total", "test.", "target")
+	c.Inc("a")
+	c.Add(2, "a")
+	c.Inc(`b"c`)
+	if c.Get("a") != 3 {
+		t.Fatalf("counter should be 3: %f", c.Get("a"))
+	}
+
+	var buf bytes.Buffer
+	c.Collect(&buf)
+	expected := `# HELP test_counter_total test.
+# TYPE test_counter_total counter
+test_counter_total{target="a"} 3
+test_counter_total{target="b\"c"} 1
+`
+	if buf.String() != expected {
+		t.Fatalf("counter output wrong:\n%s", buf.String())
+	}
+}
+
+func TestCounterLimit(t *testing.T) {
+	c := NewCounterVec("test_limit_total", "test.", "target")
+	for i := 0; i < MAX_SERIES+10; i++ {
+		c.Inc(fmt.Sprintf("%d", i))
+	}
+	if len(c.keys) != MAX_SERIES+1 {
+		t.Fatalf("series not limited: %d", len(c.keys))
+	}
+	if c.Get(OTHER) != 10 {
+		t.Fatalf("other should be 10: %f", c.Get(OTHER))
+	}
+}
+
+func TestCounterOverflow(t *testing.T) {
+	c := NewCounterVec("test_overflow_total", "test.", "target", "direction")
+	c.SetOverflow("target")
+	for i := 0; i < MAX_SERIES+10; i++ {
+		c.Inc(fmt.Sprintf("%d", i), "in")
+	}
+	c.Inc("new", "out")
+	if c.Get(OTHER, "in") != 10 || c.Get(OTHER, "out") != 1 {
+		t.Fatalf("only target should go to other: %f %f",
+			c.Get(OTHER, "in"), c.Get(OTHER, "out"))
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogramVec("test_seconds", "test.", []float64{0.1, 1}, "result")
+	h.Observe(0.05, "ok")
+	h.Observe(0.5, "ok")
+	h.Observe(5, "ok")
+
+	var buf bytes.Buffer
+	h.Collect(&buf)
+	expected := `# HELP test_seconds test.
+# TYPE test_seconds histogram
+test_seconds_bucket{result="ok",le="0.1"} 1
+test_seconds_bucket{result="ok",le="1"} 2
+test_seconds_bucket{result="ok",le="+Inf"} 3
+test_seconds_sum{result="ok"} 5.55
+test_seconds_count{result="ok"} 3
+`
+	if buf.String() != expected {
+		t.Fatalf("histogram output wrong:\n%s", buf.String())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	NewCounterVec("test_handler_total", "test.", "target").Inc("a")
+	handler := Handler(func(w io.Writer) {
+		WriteMetric(w, "test_gauge", "test.", "gauge", Sample{Value: 2})
+	})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	if !strings.Contains(body, `test_handler_total{target="a"} 1`) {
+		t.Fatalf("registered metric not found:\n%s", body)
+	}
+	if !strings.Contains(body, "# TYPE test_gauge gauge\ntest_gauge 2\n") {
+		t.Fatalf("collected metric not found:\n%s", body)
+	}
+}
@@ -0,0 +1,128 @@
+package netutil
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// RecordConn keeps what has been read, so a connection failed in handshake
+// can be replayed to somewhere else.
+type RecordConn struct {
+	net.Conn
+	lock      sync.Mutex
+	buf       bytes.Buffer
+	recording bool
+}
+
+func NewRecordConn(conn net.Conn) (rc *RecordConn) {
+	return &RecordConn{
+		Conn:      conn,
+		recording: true,
+	}
+}
+
+func (rc *RecordConn) Read(b []byte) (n int, err error) {
+	n, err = rc.Conn.Read(b)
+	rc.lock.Lock()
+	if rc.recording && n > 0 {
+		rc.buf.Write(b[:n])
+	}
+	rc.lock.Unlock()
+	return
+}
+
+func (rc *RecordConn) StopRecord() {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.recording = false
+	rc.buf = bytes.Buffer{}
+}
+
+func (rc *RecordConn) Recorded() []byte {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.buf.Bytes()
+}
+
+var (
+	ErrFallbackMode = errors.New("unknown fallback mode.")
+	ErrNoDecoy      = errors.New("decoy address is needed.")
+)
+
+const (
+	FALLBACK_CLOSE = "close"
+	FALLBACK_DRAIN = "drain"
+	FALLBACK_DECOY = "decoy"
+)
+
+// Fallback handles connections failed in auth or decryption, so a prober
+// can't tell the server from its behaviour. Close closes it right now,
+// drain holds it and reads everything until peer closed, decoy forwards it
+// (with data already read) to the decoy address.
+type Fallback struct {
+	Mode   string
+	Decoy  string
+	Dialer Dialer
+}
+
+// NewFallback returns nil for close, which is the default.
+func NewFallback(mode, decoy string) (fb *Fallback, err error) {
+	switch mode {
+	case "", FALLBACK_CLOSE:
+		return nil, nil
+	case FALLBACK_DRAIN:
+	case FALLBACK_DECOY:
+		if decoy == "" {
+			return nil, ErrNoDecoy
+		}
+	default:
+		return nil, ErrFallbackMode
+	}
+	fb = &Fallback{
+		Mode:   mode,
+		Decoy:  decoy,
+		Dialer: DefaultTcpDialer,
+	}
+	return
+}
+
+// Drain reads everything until peer closed, and closes conn.
+func Drain(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+	logger.Infof("drain %s.", conn.RemoteAddr())
+	io.Copy(ioutil.Discard, conn)
+}
+
+// Handle will block until conn closed.
+func (fb *Fallback) Handle(conn net.Conn, consumed []byte) {
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+
+	switch fb.Mode {
+	case FALLBACK_DRAIN:
+		Drain(conn)
+
+	case FALLBACK_DECOY:
+		logger.Infof("forward %s to decoy %s.", conn.RemoteAddr(), fb.Decoy)
+		dconn, err := fb.Dialer.Dial("tcp", fb.Decoy)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+
+		_, err = io.Copy(dconn, bytes.NewReader(consumed))
+		if err != nil {
+			logger.Error(err.Error())
+			dconn.Close()
+			return
+		}
+		CopyLink(dconn, conn)
+	}
+	return
+}
@@ -44,6 +44,30 @@ type TimeoutDialer interface {
 	DialTimeout(string, string, time.Duration) (net.Conn, error)
 }
 
+// SourceDialer dials for a client, src is address of it, like RemoteAddr.
+// BySource tells whether route depends on src now, connections dialed then
+// shouldn't be shared by clients.
+type SourceDialer interface {
+	DialFrom(src, network, address string) (net.Conn, error)
+	BySource() bool
+}
+
+// DialFrom dials with src if dialer could, otherwise src is ignored.
+func DialFrom(dialer Dialer, src, network, address string) (net.Conn, error) {
+	if sd, ok := dialer.(SourceDialer); ok {
+		return sd.DialFrom(src, network, address)
+	}
+	return dialer.Dial(network, address)
+}
+
+// BySource tells whether dialer routes by src now.
+func BySource(dialer Dialer) bool {
+	if sd, ok := dialer.(SourceDialer); ok {
+		return sd.BySource()
+	}
+	return false
+}
+
 type TcpDialer struct {
 }
 
@@ -0,0 +1,85 @@
+package passwd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	EXTERNAL_TIMEOUT = 5000
+)
+
+var (
+	ErrEmptyCommand = errors.New("auth command is empty.")
+)
+
+// Command runs an external program, with username and password in stdin,
+// one in a line. User passes if it exits with 0.
+type Command struct {
+	args []string
+}
+
+func NewCommand(command string) (c *Command, err error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, ErrEmptyCommand
+	}
+	return &Command{args: args}, nil
+}
+
+func (c *Command) AuthPass(username, password string) bool {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), EXTERNAL_TIMEOUT*time.Millisecond)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, c.args[0], c.args[1:]...)
+	cmd.Stdin = strings.NewReader(username + "\n" + password + "\n")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		logger.Infof("auth command for user %s: %s %s",
+			username, err.Error(), strings.TrimSpace(stderr.String()))
+		return false
+	}
+	return true
+}
+
+// Http posts username and password as form to url.
+// User passes if it returns 2xx.
+type Http struct {
+	url    string
+	client *http.Client
+}
+
+func NewHttp(u string) (h *Http) {
+	return &Http{
+		url: u,
+		client: &http.Client{
+			Timeout: EXTERNAL_TIMEOUT * time.Millisecond,
+		},
+	}
+}
+
+func (h *Http) AuthPass(username, password string) bool {
+	resp, err := h.client.PostForm(h.url, url.Values{
+		"username": {username},
+		"password": {password},
+	})
+	if err != nil {
+		logger.Error(err.Error())
+		return false
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		logger.Infof("auth url for user %s: %s", username, resp.Status)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+package passwd
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FILE_CHECK_INTERVAL = 5
+)
+
+// File is a htpasswd style file, one "username:password" in a line, and
+// lines start with # are comments. It's reloaded when modified.
+// use lock to protect: users, mtime, checked.
+type File struct {
+	filename string
+	lock     sync.Mutex
+	users    Users
+	mtime    time.Time
+	checked  time.Time
+}
+
+func NewFile(filename string) (f *File, err error) {
+	f = &File{filename: filename}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return
+	}
+	f.users, err = ReadUsers(filename)
+	if err != nil {
+		return
+	}
+	f.mtime = fi.ModTime()
+	f.checked = time.Now()
+	logger.Infof("%d user(s) loaded from %s.", len(f.users), filename)
+	return
+}
+
+func ReadUsers(filename string) (users Users, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	users = make(Users)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pair := strings.SplitN(line, ":", 2)
+		if len(pair) != 2 {
+			logger.Errorf("format error in %s: %s.", filename, pair[0])
+			continue
+		}
+		users[pair[0]] = pair[1]
+	}
+	err = scanner.Err()
+	return
+}
+
+// Reload reads file again if it's modified, checked no more than once in
+// FILE_CHECK_INTERVAL. If failed, old users are kept.
+func (f *File) Reload() (reloaded bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	now := time.Now()
+	if now.Sub(f.checked) < FILE_CHECK_INTERVAL*time.Second {
+		return
+	}
+	f.checked = now
+
+	fi, err := os.Stat(f.filename)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	if fi.ModTime().Equal(f.mtime) {
+		return
+	}
+
+	users, err := ReadUsers(f.filename)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	f.users = users
+	f.mtime = fi.ModTime()
+	logger.Noticef("%d user(s) reloaded from %s.", len(users), f.filename)
+	return true
+}
+
+func (f *File) getUsers() Users {
+	f.Reload()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.users
+}
+
+func (f *File) AuthPass(username, password string) bool {
+	return f.getUsers().AuthPass(username, password)
+}
@@ -0,0 +1,252 @@
+package passwd
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	logging "github.com/op/go-logging"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	CACHE_TTL = 60
+	// users kept in cache at most.
+	CACHE_SIZE = 4096
+)
+
+var (
+	ErrArgon2Format = errors.New("argon2 hash format error.")
+)
+
+var (
+	logger = logging.MustGetLogger("passwd")
+)
+
+// Authenticator is the same as tunnel.PasswordAuthenticator.
+type Authenticator interface {
+	AuthPass(username, password string) bool
+}
+
+// Reloader is an authenticator reloads by itself, like File. Reload returns
+// true if users changed, so cached results should be dropped.
+type Reloader interface {
+	Reload() bool
+}
+
+// New makes an authenticator from all the sources given, user passes if
+// any of them passes. Nil returned if nothing given, means no auth.
+// Passed users are cached, so slow hash or external ones won't be called
+// on each request.
+func New(users map[string]string, file, command, url string) (a Authenticator, err error) {
+	var chain Chain
+	if len(users) > 0 {
+		chain = append(chain, Users(users))
+	}
+	if file != "" {
+		var f *File
+		f, err = NewFile(file)
+		if err != nil {
+			return
+		}
+		chain = append(chain, f)
+	}
+	if command != "" {
+		var c *Command
+		c, err = NewCommand(command)
+		if err != nil {
+			return
+		}
+		chain = append(chain, c)
+	}
+	if url != "" {
+		chain = append(chain, NewHttp(url))
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	return NewCache(chain, CACHE_TTL*time.Second), nil
+}
+
+type Chain []Authenticator
+
+func (chain Chain) AuthPass(username, password string) bool {
+	for _, a := range chain {
+		if a.AuthPass(username, password) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload all reloaders in chain.
+func (chain Chain) Reload() (reloaded bool) {
+	for _, a := range chain {
+		if r, ok := a.(Reloader); ok && r.Reload() {
+			reloaded = true
+		}
+	}
+	return
+}
+
+// Users maps username to password, which could be hashed.
+type Users map[string]string
+
+func (users Users) AuthPass(username, password string) bool {
+	stored, ok := users[username]
+	if !ok {
+		return false
+	}
+	return CheckPassword(stored, password)
+}
+
+// CheckPassword checks password with stored one. Stored could be:
+//
+//	bcrypt: $2a$, $2b$ or $2y$, like htpasswd -B.
+//	argon2: $argon2id$v=19$m=65536,t=3,p=4$salt$hash, base64 without padding.
+//	sha1: {SHA}base64, like htpasswd -s.
+//	others are taken as plain text, including unknown ones begin with $,
+//	passwords like "$ecret" in old configs still work.
+func CheckPassword(stored, password string) bool {
+	switch {
+	case strings.HasPrefix(stored, "$2a$"), strings.HasPrefix(stored, "$2b$"),
+		strings.HasPrefix(stored, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	case strings.HasPrefix(stored, "$argon2"):
+		ok, err := checkArgon2(stored, password)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+		return ok
+	case strings.HasPrefix(stored, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		hashed := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(hashed)) == 1
+	case strings.HasPrefix(stored, "$"):
+		logger.Warningf("unknown password hash %s, taken as plain text.",
+			strings.SplitN(stored[1:], "$", 2)[0])
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
+func checkArgon2(stored, password string) (ok bool, err error) {
+	// "", algorithm, version, params, salt, hash
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return false, ErrArgon2Format
+	}
+
+	var version int
+	_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil {
+		return
+	}
+	if version != argon2.Version {
+		return false, fmt.Errorf("argon2 version %d not supported.", version)
+	}
+
+	var memory, time uint32
+	var threads uint8
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+	if err != nil {
+		return
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return
+	}
+
+	var key []byte
+	switch parts[1] {
+	case "argon2id":
+		key = argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(hash)))
+	case "argon2i":
+		key = argon2.Key([]byte(password), salt, time, memory, threads, uint32(len(hash)))
+	default:
+		return false, ErrArgon2Format
+	}
+	return subtle.ConstantTimeCompare(key, hash) == 1, nil
+}
+
+// Cache keeps passed users for ttl, so slow hash or external ones won't be
+// called on each login. Failed ones aren't kept, or guesses fill it. No more
+// than CACHE_SIZE users are kept, others are checked each time.
+// Password is kept in sha256 only.
+// use lock to protect: entries.
+type Cache struct {
+	Authenticator
+	ttl     time.Duration
+	lock    sync.Mutex
+	entries map[string]time.Time
+}
+
+func NewCache(a Authenticator, ttl time.Duration) (c *Cache) {
+	return &Cache{
+		Authenticator: a,
+		ttl:           ttl,
+		entries:       make(map[string]time.Time),
+	}
+}
+
+// Flush drops all users kept.
+func (c *Cache) Flush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = make(map[string]time.Time)
+}
+
+// sweep drops expired users, called only when full.
+func (c *Cache) sweep(now time.Time) {
+	for k, expire := range c.entries {
+		if now.After(expire) {
+			delete(c.entries, k)
+		}
+	}
+}
+
+func (c *Cache) AuthPass(username, password string) bool {
+	// users removed from file shouldn't pass by cache.
+	if r, ok := c.Authenticator.(Reloader); ok && r.Reload() {
+		c.Flush()
+	}
+
+	sum := sha256.Sum256([]byte(username + "\x00" + password))
+	key := string(sum[:])
+	now := time.Now()
+
+	c.lock.Lock()
+	expire, ok := c.entries[key]
+	if ok && now.After(expire) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.lock.Unlock()
+	if ok {
+		return true
+	}
+
+	if !c.Authenticator.AuthPass(username, password) {
+		return false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.entries) >= CACHE_SIZE {
+		c.sweep(now)
+	}
+	if len(c.entries) < CACHE_SIZE {
+		c.entries[key] = now.Add(c.ttl)
+	}
+	return true
+}
@@ -0,0 +1,197 @@
+package passwd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCheckPassword(t *testing.T) {
+	bhash, err := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("saltsaltsalt")
+	key := argon2.IDKey([]byte("pass"), salt, 1, 1024, 1, 32)
+	ahash := fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+
+	for _, stored := range []string{
+		string(bhash),
+		ahash,
+		"{SHA}nU4eI71bcnBGqeO0t9tXvY1u5oQ=",
+		"pass",
+	} {
+		if !CheckPassword(stored, "pass") {
+			t.Fatalf("password should pass: %s.", stored)
+		}
+		if CheckPassword(stored, "wrong") {
+			t.Fatalf("wrong password passed: %s.", stored)
+		}
+	}
+	// unknown hash is plain text, for old configs.
+	if !CheckPassword("$ecret", "$ecret") || CheckPassword("$apr1$salt$hash", "pass") {
+		t.Fatal("unknown hash should be taken as plain text.")
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "htpasswd")
+
+	err = ioutil.WriteFile(filename, []byte("# comment\nuser:pass\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.AuthPass("user", "pass") || f.AuthPass("user2", "pass2") {
+		t.Fatal("users in file wrong.")
+	}
+
+	err = ioutil.WriteFile(filename, []byte("user2:pass2\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// make it looks modified and checked long ago.
+	os.Chtimes(filename, time.Now(), time.Now().Add(time.Minute))
+	f.checked = time.Time{}
+	if f.AuthPass("user", "pass") || !f.AuthPass("user2", "pass2") {
+		t.Fatal("file not reloaded.")
+	}
+}
+
+func TestCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "auth.sh")
+	err = ioutil.WriteFile(script, []byte(
+		"read u\nread p\n[ \"$u:$p\" = \"user:pass\" ]\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewCommand("sh " + script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.AuthPass("user", "pass") || c.AuthPass("user", "wrong") {
+		t.Fatal("command auth wrong.")
+	}
+
+	if _, err = NewCommand(" \t"); err != ErrEmptyCommand {
+		t.Fatalf("empty command should be refused: %v.", err)
+	}
+	if _, err = New(nil, "", " ", ""); err != ErrEmptyCommand {
+		t.Fatalf("blank command should be refused: %v.", err)
+	}
+}
+
+func TestHttp(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if req.FormValue("username") != "user" || req.FormValue("password") != "pass" {
+				w.WriteHeader(403)
+			}
+		}))
+	defer srv.Close()
+
+	h := NewHttp(srv.URL)
+	if !h.AuthPass("user", "pass") || h.AuthPass("user", "wrong") {
+		t.Fatal("http auth wrong.")
+	}
+}
+
+type countAuth int
+
+func (c *countAuth) AuthPass(username, password string) bool {
+	*c++
+	return password == "pass"
+}
+
+func TestCache(t *testing.T) {
+	var count countAuth
+	c := NewCache(&count, time.Minute)
+	for i := 0; i < 3; i++ {
+		if !c.AuthPass("user", "pass") || c.AuthPass("user", "wrong") {
+			t.Fatal("cache auth wrong.")
+		}
+	}
+	// one for pass, wrong ones each time.
+	if count != 4 || len(c.entries) != 1 {
+		t.Fatalf("only passed should be cached: %d %d.", count, len(c.entries))
+	}
+
+	for i := 0; i < CACHE_SIZE+10; i++ {
+		c.AuthPass(fmt.Sprintf("user%d", i), "pass")
+	}
+	if len(c.entries) != CACHE_SIZE {
+		t.Fatalf("cache over size: %d.", len(c.entries))
+	}
+
+	// expired.
+	c = NewCache(&count, 0)
+	count = 0
+	c.AuthPass("user", "pass")
+	c.AuthPass("user", "pass")
+	if count != 2 {
+		t.Fatalf("passed result should be expired: %d.", count)
+	}
+
+	a, err := New(nil, "", "", "")
+	if err != nil || a != nil {
+		t.Fatal("nothing given should be no auth.")
+	}
+}
+
+func TestCacheReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "htpasswd")
+
+	err = ioutil.WriteFile(filename, []byte("user:pass\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCache(Chain{f}, time.Minute)
+	if !c.AuthPass("user", "pass") {
+		t.Fatal("user in file should pass.")
+	}
+
+	// user removed from file.
+	err = ioutil.WriteFile(filename, []byte("user2:pass2\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(filename, time.Now(), time.Now().Add(time.Minute))
+	f.checked = time.Time{}
+	if c.AuthPass("user", "pass") {
+		t.Fatal("user removed shouldn't pass by cache.")
+	}
+}
@@ -0,0 +1,78 @@
+package portmapper
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// Manager keeps port maps running, and could start/stop them by config.
+type Manager struct {
+	lock    sync.Mutex
+	dialer  netutil.Dialer
+	running map[PortMap]io.Closer
+}
+
+func NewManager(dialer netutil.Dialer) (m *Manager) {
+	m = &Manager{
+		dialer:  dialer,
+		running: make(map[PortMap]io.Closer, 0),
+	}
+	return
+}
+
+// Update stops port maps not in pms, and starts new ones.
+func (m *Manager) Update(pms []PortMap) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	wanted := make(map[PortMap]struct{}, len(pms))
+	for _, pm := range pms {
+		wanted[pm] = struct{}{}
+	}
+
+	for pm, closer := range m.running {
+		if _, ok := wanted[pm]; ok {
+			continue
+		}
+		logger.Noticef("stop port map %s:%s => %s.", pm.Net, pm.Src, pm.Dst)
+		closer.Close()
+		delete(m.running, pm)
+	}
+
+	for pm := range wanted {
+		if _, ok := m.running[pm]; ok {
+			continue
+		}
+		closer, err := m.start(pm)
+		if err != nil {
+			logger.Error(err.Error())
+			continue
+		}
+		m.running[pm] = closer
+	}
+}
+
+func (m *Manager) start(pm PortMap) (closer io.Closer, err error) {
+	if strings.HasPrefix(pm.Net, "udp") {
+		var sconn *net.UDPConn
+		sconn, err = ListenUdp(pm)
+		if err != nil {
+			return
+		}
+		upm := NewUdpPortMapper()
+		go upm.Serve(sconn, pm, m.dialer)
+		return sconn, nil
+	}
+
+	lsock, err := net.Listen(pm.Net, pm.Src)
+	if err != nil {
+		return
+	}
+	logger.Infof("tcp listening in %s", pm.Src)
+	go ServeTcp(lsock, pm, m.dialer)
+	return lsock, nil
+}
@@ -45,27 +45,39 @@ func (upm *UdpPortMapper) RemovePorts(addr net.Addr) {
 
 	_, ok := upm.ports[addr]
 	if !ok {
-		logger.Error("remove a port not exits: %s.", addr.String())
+		logger.Errorf("remove a port not exits: %s.", addr.String())
 		return
 	}
 	delete(upm.ports, addr)
-	logger.Debug("remove port %s.", addr.String())
+	logger.Debugf("remove port %s.", addr.String())
 	return
 }
 
-func (upm *UdpPortMapper) UdpPortmap(pm PortMap, dialer netutil.Dialer) (err error) {
+func ListenUdp(pm PortMap) (sconn *net.UDPConn, err error) {
 	laddr, err := net.ResolveUDPAddr(pm.Net, pm.Src)
 	if err != nil {
 		return
 	}
-	sconn, err := net.ListenUDP(pm.Net, laddr)
+	sconn, err = net.ListenUDP(pm.Net, laddr)
 	if err != nil {
 		return
 	}
-	defer sconn.Close()
 	sconn.SetReadBuffer(UDP_READBUFFER)
-	logger.Info("udp listening in %s", pm.Src)
+	logger.Infof("udp listening in %s", pm.Src)
+	return
+}
+
+func (upm *UdpPortMapper) UdpPortmap(pm PortMap, dialer netutil.Dialer) (err error) {
+	sconn, err := ListenUdp(pm)
+	if err != nil {
+		return
+	}
+	return upm.Serve(sconn, pm, dialer)
+}
 
+// Serve returns when sconn closed.
+func (upm *UdpPortMapper) Serve(sconn *net.UDPConn, pm PortMap, dialer netutil.Dialer) (err error) {
+	defer sconn.Close()
 	for {
 		up := NewUdpPackage()
 		nr, addr, err := sconn.ReadFrom(up.buf)
@@ -74,19 +86,22 @@ func (upm *UdpPortMapper) UdpPortmap(pm PortMap, dialer netutil.Dialer) (err err
 		case io.EOF:
 			return nil
 		default:
-			logger.Error("%s", err.Error())
-			continue
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				logger.Error(err.Error())
+				continue
+			}
+			return err
 		}
 		up.nr = nr
 
 		upm.lock.Lock()
 		umc, ok := upm.ports[addr]
 		if !ok {
-			logger.Info("udp forward got new addr %s.", addr)
+			logger.Infof("udp forward got new addr %s.", addr)
 			dconn, err := dialer.Dial(pm.Net, pm.Dst)
 			if err != nil {
 				upm.lock.Unlock()
-				logger.Error("%s", err.Error())
+				logger.Error(err.Error())
 				continue
 			}
 			umc = NewUdpMapperConn(upm, sconn, dconn, addr, pm.Dst)
@@ -141,7 +156,7 @@ func NewUdpMapperConn(upm *UdpPortMapper, sconn *net.UDPConn,
 }
 
 func (umc *UdpMapperConn) Close() {
-	logger.Notice("udp redirect %s closed.", umc.addr.String())
+	logger.Noticef("udp redirect %s closed.", umc.addr.String())
 	umc.dconn.Close()
 	close(umc.ch)
 	umc.upm.RemovePorts(umc.addr)
@@ -171,7 +186,7 @@ func (umc *UdpMapperConn) RecvHandler() {
 		case io.EOF:
 			return
 		default:
-			logger.Error("%s", err.Error())
+			logger.Error(err.Error())
 			continue
 		}
 
@@ -181,12 +196,12 @@ func (umc *UdpMapperConn) RecvHandler() {
 		case io.EOF:
 			return
 		default:
-			logger.Error("%s", err.Error())
+			logger.Error(err.Error())
 			continue
 		}
 
 		atomic.StoreInt32(&umc.cnt, 0)
-		logger.Debug("udp package recved %s <=> %s.", umc.addr.String(), umc.dst)
+		logger.Debugf("udp package recved %s <=> %s.", umc.addr.String(), umc.dst)
 	}
 }
 
@@ -204,13 +219,13 @@ func (umc *UdpMapperConn) SendHandler() {
 		case io.EOF:
 			return
 		default:
-			logger.Error("%s", err.Error())
+			logger.Error(err.Error())
 			continue
 		}
 		up.Free()
 
 		atomic.StoreInt32(&umc.cnt, 0)
-		logger.Debug("udp package sent %s <=> %s.", umc.addr.String(), umc.dst)
+		logger.Debugf("udp package sent %s <=> %s.", umc.addr.String(), umc.dst)
 	}
 }
 
@@ -219,16 +234,24 @@ func TcpPortmap(pm PortMap, dialer netutil.Dialer) (err error) {
 	if err != nil {
 		return
 	}
-	logger.Info("tcp listening in %s", pm.Src)
+	logger.Infof("tcp listening in %s", pm.Src)
+	return ServeTcp(lsock, pm, dialer)
+}
 
+// ServeTcp returns when lsock closed.
+func ServeTcp(lsock net.Listener, pm PortMap, dialer netutil.Dialer) (err error) {
+	defer lsock.Close()
 	for {
 		var sconn, dconn net.Conn
 
 		sconn, err = lsock.Accept()
 		if err != nil {
-			continue
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
 		}
-		logger.Info("accept in %s:%s, try to dial %s.", pm.Net, pm.Src, pm.Dst)
+		logger.Infof("accept in %s:%s, try to dial %s.", pm.Net, pm.Src, pm.Dst)
 
 		dconn, err = dialer.Dial(pm.Net, pm.Dst)
 		if err != nil {
@@ -249,7 +272,7 @@ func CreatePortmap(pm PortMap, dialer netutil.Dialer) {
 		err = TcpPortmap(pm, dialer)
 	}
 	if err != nil {
-		logger.Error("%s", err.Error())
+		logger.Error(err.Error())
 	}
 	return
 }
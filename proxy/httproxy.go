@@ -1,12 +1,21 @@
 package proxy
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
 
 	logging "github.com/op/go-logging"
+	"github.com/shell909090/goproxy/ipfilter"
+	"github.com/shell909090/goproxy/metrics"
 	"github.com/shell909090/goproxy/netutil"
+	"github.com/shell909090/goproxy/passwd"
+	"github.com/shell909090/goproxy/tunnel"
 )
 
 var logger = logging.MustGetLogger("logger")
@@ -22,24 +31,54 @@ var hopHeaders = []string{
 	"Upgrade",
 }
 
+// key of client address in context of request.
+type srcKey struct{}
+
+// denied tells whether err means target is not allowed, by server or rules.
+func denied(err error) bool {
+	return errors.Is(err, tunnel.ErrDenied) || errors.Is(err, ipfilter.ErrRejected)
+}
+
+// use alock to protect: author.
 type Proxy struct {
 	transport http.Transport
-	dialer    netutil.Dialer
-	username  string
-	password  string
+	// no keep-alive, used when dialer routes by client.
+	oneshot http.Transport
+	dialer  netutil.Dialer
+	alock   sync.RWMutex
+	author  passwd.Authenticator
 }
 
-func NewProxy(dialer netutil.Dialer, username string, password string) (p *Proxy) {
-	p = &Proxy{
-		username:  username,
-		password:  password,
-		dialer:    dialer,
-		transport: http.Transport{Dial: dialer.Dial},
-	}
-	if username != "" && password != "" {
+// NewProxy creates a http proxy, nil author means no auth.
+func NewProxy(dialer netutil.Dialer, author passwd.Authenticator) (p *Proxy) {
+	p = &Proxy{dialer: dialer}
+	p.transport.DialContext = p.dialContext
+	p.oneshot.DialContext = p.dialContext
+	p.oneshot.DisableKeepAlives = true
+	p.SetAuth(author)
+	return
+}
+
+// SetAuth replaces authenticator, nil means no auth.
+func (p *Proxy) SetAuth(author passwd.Authenticator) {
+	p.alock.Lock()
+	defer p.alock.Unlock()
+	p.author = author
+	if author != nil {
 		logger.Info("proxy-auth required")
 	}
-	return
+}
+
+func (p *Proxy) getAuth() passwd.Authenticator {
+	p.alock.RLock()
+	defer p.alock.RUnlock()
+	return p.author
+}
+
+// dialContext dials with client address in ctx.
+func (p *Proxy) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	src, _ := ctx.Value(srcKey{}).(string)
+	return netutil.DialFrom(p.dialer, src, network, address)
 }
 
 func copyHeader(dst, src http.Header) {
@@ -53,9 +92,13 @@ func copyHeader(dst, src http.Header) {
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	logger.Infof("http: %s %s", req.Method, req.URL)
 
-	if p.username != "" && p.password != "" {
-		if !BasicAuth(w, req, p.username, p.password) {
+	if author := p.getAuth(); author != nil {
+		if !BasicAuth(w, req, author) {
 			logger.Error("Http Auth Required")
+			// the first request without credentials is just a challenge.
+			if req.Header.Get("Proxy-Authorization") != "" {
+				metrics.AuthFailures.Inc("http")
+			}
 			w.Header().Set("Proxy-Authenticate", "Basic realm=\"GoProxy\"")
 			http.Error(w, http.StatusText(407), 407)
 			return
@@ -74,9 +117,22 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	resp, err := p.transport.RoundTrip(req)
+	req = req.WithContext(
+		context.WithValue(req.Context(), srcKey{}, req.RemoteAddr))
+	// connections kept alive are shared by clients, the first one would
+	// decide the route of others.
+	transport := &p.transport
+	if netutil.BySource(p.dialer) {
+		transport = &p.oneshot
+	}
+	resp, err := transport.RoundTrip(req)
 	if err != nil {
 		logger.Error(err.Error())
+		if denied(err) {
+			http.Error(w, fmt.Sprintf("%s: %s", req.URL.Host, err.Error()),
+				http.StatusForbidden)
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -112,9 +168,14 @@ func (p *Proxy) Connect(w http.ResponseWriter, r *http.Request) {
 	if !strings.Contains(host, ":") {
 		host += ":80"
 	}
-	dstconn, err := p.dialer.Dial("tcp", host)
+	dstconn, err := netutil.DialFrom(p.dialer, r.RemoteAddr, "tcp", host)
 	if err != nil {
 		logger.Errorf("dial failed: %s", err.Error())
+		if denied(err) {
+			fmt.Fprintf(srcconn,
+				"HTTP/1.0 403 Forbidden\r\n\r\n%s: %s\n", host, err.Error())
+			return
+		}
 		srcconn.Write([]byte("HTTP/1.0 502 OK\r\n\r\n"))
 		return
 	}
@@ -4,9 +4,11 @@ import (
 	"encoding/base64"
 	"net/http"
 	"strings"
+
+	"github.com/shell909090/goproxy/passwd"
 )
 
-func BasicAuth(w http.ResponseWriter, r *http.Request, username string, password string) bool {
+func BasicAuth(w http.ResponseWriter, r *http.Request, author passwd.Authenticator) bool {
 	pheader := r.Header["Proxy-Authorization"]
 	if pheader == nil || len(pheader) == 0 {
 		return false
@@ -22,5 +24,5 @@ func BasicAuth(w http.ResponseWriter, r *http.Request, username string, password
 	if len(pair) != 2 {
 		return false
 	}
-	return pair[0] == username && pair[1] == password
+	return author.AuthPass(pair[0], pair[1])
 }
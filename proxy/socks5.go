@@ -0,0 +1,361 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shell909090/goproxy/metrics"
+	"github.com/shell909090/goproxy/netutil"
+	"github.com/shell909090/goproxy/passwd"
+)
+
+const (
+	SOCKS5_VERSION  = 0x05
+	SOCKS5_AUTH_VER = 0x01
+	SOCKS5_TIMEOUT  = 30 * time.Second
+)
+
+const (
+	SOCKS5_METHOD_NONE     = 0x00
+	SOCKS5_METHOD_PASSWORD = 0x02
+	SOCKS5_METHOD_REJECT   = 0xff
+)
+
+const (
+	SOCKS5_CMD_CONNECT      = 0x01
+	SOCKS5_CMD_BIND         = 0x02
+	SOCKS5_CMD_UDPASSOCIATE = 0x03
+)
+
+const (
+	SOCKS5_ATYP_IPV4   = 0x01
+	SOCKS5_ATYP_DOMAIN = 0x03
+	SOCKS5_ATYP_IPV6   = 0x04
+)
+
+const (
+	SOCKS5_REP_SUCCEEDED = iota
+	SOCKS5_REP_FAILURE
+	SOCKS5_REP_NOTALLOWED
+	SOCKS5_REP_NETUNREACH
+	SOCKS5_REP_HOSTUNREACH
+	SOCKS5_REP_REFUSED
+	SOCKS5_REP_TTLEXPIRED
+	SOCKS5_REP_CMDUNSUPPORTED
+	SOCKS5_REP_ATYPUNSUPPORTED
+)
+
+var (
+	ErrSocksVersion  = errors.New("socks version not supported.")
+	ErrSocksMethod   = errors.New("no acceptable socks auth method.")
+	ErrSocksAuth     = errors.New("socks auth failed.")
+	ErrSocksCommand  = errors.New("socks command not supported.")
+	ErrSocksAddrType = errors.New("socks address type not supported.")
+)
+
+// use alock to protect: author.
+type Socks5Server struct {
+	dialer netutil.Dialer
+	alock  sync.RWMutex
+	author passwd.Authenticator
+}
+
+// NewSocks5Server creates a socks5 server, nil author means no auth.
+func NewSocks5Server(dialer netutil.Dialer, author passwd.Authenticator) (s *Socks5Server) {
+	s = &Socks5Server{dialer: dialer}
+	s.SetAuth(author)
+	return
+}
+
+// SetAuth replaces authenticator, nil means no auth.
+func (s *Socks5Server) SetAuth(author passwd.Authenticator) {
+	s.alock.Lock()
+	defer s.alock.Unlock()
+	s.author = author
+	if author != nil {
+		logger.Info("socks5 auth required")
+	}
+}
+
+func (s *Socks5Server) getAuth() passwd.Authenticator {
+	s.alock.RLock()
+	defer s.alock.RUnlock()
+	return s.author
+}
+
+func (s *Socks5Server) ListenAndServe(addr string) (err error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+	logger.Infof("socks5 listening in %s", addr)
+	return s.Serve(listener)
+}
+
+func (s *Socks5Server) Serve(listener net.Listener) (err error) {
+	var conn net.Conn
+	for {
+		conn, err = listener.Accept()
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		go s.Handle(conn)
+	}
+}
+
+func (s *Socks5Server) Handle(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(SOCKS5_TIMEOUT))
+	err := s.handshake(conn)
+	if err != nil {
+		logger.Errorf("socks5 handshake from %s failed: %s.",
+			conn.RemoteAddr(), err.Error())
+		return
+	}
+
+	cmd, address, err := ReadSocks5Request(conn)
+	if err != nil {
+		logger.Error(err.Error())
+		switch err {
+		case ErrSocksAddrType:
+			WriteSocks5Reply(conn, SOCKS5_REP_ATYPUNSUPPORTED, "")
+		}
+		return
+	}
+
+	switch cmd {
+	case SOCKS5_CMD_CONNECT:
+		s.Connect(conn, address)
+	case SOCKS5_CMD_UDPASSOCIATE:
+		s.UdpAssociate(conn)
+	default:
+		logger.Errorf("socks5 command %d not supported.", cmd)
+		WriteSocks5Reply(conn, SOCKS5_REP_CMDUNSUPPORTED, "")
+	}
+	return
+}
+
+func (s *Socks5Server) handshake(conn net.Conn) (err error) {
+	var hdr [2]byte
+	_, err = io.ReadFull(conn, hdr[:])
+	if err != nil {
+		return
+	}
+	if hdr[0] != SOCKS5_VERSION {
+		return ErrSocksVersion
+	}
+
+	methods := make([]byte, hdr[1])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return
+	}
+
+	author := s.getAuth()
+	var method byte = SOCKS5_METHOD_NONE
+	if author != nil {
+		method = SOCKS5_METHOD_PASSWORD
+	}
+
+	found := false
+	for _, m := range methods {
+		if m == method {
+			found = true
+			break
+		}
+	}
+	if !found {
+		conn.Write([]byte{SOCKS5_VERSION, SOCKS5_METHOD_REJECT})
+		return ErrSocksMethod
+	}
+
+	_, err = conn.Write([]byte{SOCKS5_VERSION, method})
+	if err != nil {
+		return
+	}
+
+	if method == SOCKS5_METHOD_PASSWORD {
+		err = s.auth(conn, author)
+	}
+	return
+}
+
+// username/password sub negotiation, rfc1929.
+func (s *Socks5Server) auth(conn net.Conn, author passwd.Authenticator) (err error) {
+	var ver [1]byte
+	_, err = io.ReadFull(conn, ver[:])
+	if err != nil {
+		return
+	}
+	if ver[0] != SOCKS5_AUTH_VER {
+		return ErrSocksVersion
+	}
+
+	username, err := readSocks5String(conn)
+	if err != nil {
+		return
+	}
+	password, err := readSocks5String(conn)
+	if err != nil {
+		return
+	}
+
+	if !author.AuthPass(username, password) {
+		conn.Write([]byte{SOCKS5_AUTH_VER, 0x01})
+		logger.Errorf("socks5 user %s auth failed.", username)
+		metrics.AuthFailures.Inc("socks5")
+		return ErrSocksAuth
+	}
+
+	_, err = conn.Write([]byte{SOCKS5_AUTH_VER, 0x00})
+	return
+}
+
+func (s *Socks5Server) Connect(conn net.Conn, address string) {
+	logger.Infof("socks5: connect %s", address)
+
+	dstconn, err := netutil.DialFrom(
+		s.dialer, conn.RemoteAddr().String(), "tcp", address)
+	if err != nil {
+		logger.Errorf("dial failed: %s", err.Error())
+		if denied(err) {
+			WriteSocks5Reply(conn, SOCKS5_REP_NOTALLOWED, "")
+			return
+		}
+		WriteSocks5Reply(conn, SOCKS5_REP_HOSTUNREACH, "")
+		return
+	}
+
+	err = WriteSocks5Reply(conn, SOCKS5_REP_SUCCEEDED, "")
+	if err != nil {
+		logger.Error(err.Error())
+		dstconn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	netutil.CopyLink(conn, dstconn)
+	return
+}
+
+func readSocks5String(r io.Reader) (s string, err error) {
+	var size [1]byte
+	_, err = io.ReadFull(r, size[:])
+	if err != nil {
+		return
+	}
+	buf := make([]byte, size[0])
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return
+	}
+	s = string(buf)
+	return
+}
+
+// ReadSocks5Addr reads ATYP, DST.ADDR and DST.PORT, returns host:port.
+func ReadSocks5Addr(r io.Reader) (address string, err error) {
+	var atyp [1]byte
+	_, err = io.ReadFull(r, atyp[:])
+	if err != nil {
+		return
+	}
+
+	var host string
+	switch atyp[0] {
+	case SOCKS5_ATYP_IPV4:
+		var ip [net.IPv4len]byte
+		_, err = io.ReadFull(r, ip[:])
+		if err != nil {
+			return
+		}
+		host = net.IP(ip[:]).String()
+	case SOCKS5_ATYP_IPV6:
+		var ip [net.IPv6len]byte
+		_, err = io.ReadFull(r, ip[:])
+		if err != nil {
+			return
+		}
+		host = net.IP(ip[:]).String()
+	case SOCKS5_ATYP_DOMAIN:
+		host, err = readSocks5String(r)
+		if err != nil {
+			return
+		}
+	default:
+		return "", ErrSocksAddrType
+	}
+
+	var port [2]byte
+	_, err = io.ReadFull(r, port[:])
+	if err != nil {
+		return
+	}
+
+	address = net.JoinHostPort(
+		host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+	return
+}
+
+// AppendSocks5Addr appends ATYP, ADDR and PORT of host:port to b.
+// empty address will be encoded as 0.0.0.0:0.
+func AppendSocks5Addr(b []byte, address string) []byte {
+	if address == "" {
+		return append(b, SOCKS5_ATYP_IPV4, 0, 0, 0, 0, 0, 0)
+	}
+
+	host, strport, err := net.SplitHostPort(address)
+	if err != nil {
+		return append(b, SOCKS5_ATYP_IPV4, 0, 0, 0, 0, 0, 0)
+	}
+	port, _ := strconv.Atoi(strport)
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		b = append(b, SOCKS5_ATYP_DOMAIN, byte(len(host)))
+		b = append(b, host...)
+	case ip.To4() != nil:
+		b = append(b, SOCKS5_ATYP_IPV4)
+		b = append(b, ip.To4()...)
+	default:
+		b = append(b, SOCKS5_ATYP_IPV6)
+		b = append(b, ip.To16()...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+func ReadSocks5Request(r io.Reader) (cmd byte, address string, err error) {
+	var hdr [3]byte
+	_, err = io.ReadFull(r, hdr[:])
+	if err != nil {
+		return
+	}
+	if hdr[0] != SOCKS5_VERSION {
+		err = ErrSocksVersion
+		return
+	}
+	cmd = hdr[1]
+
+	address, err = ReadSocks5Addr(r)
+	return
+}
+
+func WriteSocks5Reply(w io.Writer, rep byte, bind string) (err error) {
+	b := AppendSocks5Addr([]byte{SOCKS5_VERSION, rep, 0x00}, bind)
+	n, err := w.Write(b)
+	if err != nil {
+		return
+	}
+	if n != len(b) {
+		return io.ErrShortWrite
+	}
+	return
+}
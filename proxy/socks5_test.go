@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/shell909090/goproxy/netutil"
+	"github.com/shell909090/goproxy/passwd"
+	"github.com/shell909090/goproxy/tunnel"
+)
+
+const (
+	PAYLOAD = "foobar"
+)
+
+func runEcho(t *testing.T) (addr string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestSocks5(t *testing.T) {
+	tunnel.SetLogging()
+	echoaddr := runEcho(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	s := NewSocks5Server(netutil.DefaultTcpDialer, passwd.Users{"user": "pass"})
+	go s.Serve(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var resp [10]byte
+	conn.Write([]byte{SOCKS5_VERSION, 2, SOCKS5_METHOD_NONE, SOCKS5_METHOD_PASSWORD})
+	_, err = io.ReadFull(conn, resp[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp[1] != SOCKS5_METHOD_PASSWORD {
+		t.Fatalf("method wrong: %d.", resp[1])
+	}
+
+	conn.Write([]byte{SOCKS5_AUTH_VER, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's'})
+	_, err = io.ReadFull(conn, resp[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp[1] != 0 {
+		t.Fatalf("auth failed: %d.", resp[1])
+	}
+
+	req := AppendSocks5Addr(
+		[]byte{SOCKS5_VERSION, SOCKS5_CMD_CONNECT, 0}, echoaddr)
+	conn.Write(req)
+	_, err = io.ReadFull(conn, resp[:10])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp[1] != SOCKS5_REP_SUCCEEDED {
+		t.Fatalf("connect failed: %d.", resp[1])
+	}
+
+	conn.Write([]byte(PAYLOAD))
+	buf := make([]byte, len(PAYLOAD))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, []byte(PAYLOAD)) {
+		t.Fatalf("data not match.")
+	}
+}
+
+func TestSocks5AuthFailed(t *testing.T) {
+	tunnel.SetLogging()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	s := NewSocks5Server(netutil.DefaultTcpDialer, passwd.Users{"user": "pass"})
+	go s.Serve(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var resp [2]byte
+	conn.Write([]byte{SOCKS5_VERSION, 1, SOCKS5_METHOD_NONE})
+	_, err = io.ReadFull(conn, resp[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp[1] != SOCKS5_METHOD_REJECT {
+		t.Fatalf("no auth method should be rejected: %d.", resp[1])
+	}
+}
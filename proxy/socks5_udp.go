@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+const (
+	SOCKS5_UDP_BUFFER = 1<<16 - 1
+)
+
+// UdpAssociate holds the association until the control connection closed.
+func (s *Socks5Server) UdpAssociate(conn net.Conn) {
+	var ip net.IP
+	if taddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		ip = taddr.IP
+	}
+
+	uconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		logger.Error(err.Error())
+		WriteSocks5Reply(conn, SOCKS5_REP_FAILURE, "")
+		return
+	}
+
+	err = WriteSocks5Reply(conn, SOCKS5_REP_SUCCEEDED, uconn.LocalAddr().String())
+	if err != nil {
+		logger.Error(err.Error())
+		uconn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	logger.Infof("socks5: udp associate %s for %s",
+		uconn.LocalAddr(), conn.RemoteAddr())
+
+	relay := NewUdpRelay(s.dialer, uconn)
+	go relay.Loop()
+
+	io.Copy(ioutil.Discard, conn)
+	relay.Close()
+	return
+}
+
+type UdpRelay struct {
+	dialer  netutil.Dialer
+	uconn   *net.UDPConn
+	lock    sync.Mutex
+	client  *net.UDPAddr
+	targets map[string]net.Conn
+	closed  bool
+}
+
+func NewUdpRelay(dialer netutil.Dialer, uconn *net.UDPConn) (relay *UdpRelay) {
+	relay = &UdpRelay{
+		dialer:  dialer,
+		uconn:   uconn,
+		targets: make(map[string]net.Conn, 0),
+	}
+	return
+}
+
+func (relay *UdpRelay) Close() (err error) {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	relay.closed = true
+	for address, tconn := range relay.targets {
+		tconn.Close()
+		delete(relay.targets, address)
+	}
+	return relay.uconn.Close()
+}
+
+func (relay *UdpRelay) Loop() {
+	buf := make([]byte, SOCKS5_UDP_BUFFER)
+	for {
+		n, addr, err := relay.uconn.ReadFromUDP(buf)
+		if err != nil {
+			logger.Info(err.Error())
+			return
+		}
+
+		relay.lock.Lock()
+		if relay.client == nil {
+			relay.client = addr
+		}
+		client := relay.client
+		relay.lock.Unlock()
+
+		if !client.IP.Equal(addr.IP) || client.Port != addr.Port {
+			logger.Errorf("udp package from unknown client %s.", addr)
+			continue
+		}
+
+		// RSV(2), FRAG(1), ATYP, DST.ADDR, DST.PORT, DATA
+		if n < 4 || buf[2] != 0 {
+			logger.Error("udp package fragmented or too short, drop.")
+			continue
+		}
+
+		r := bytes.NewReader(buf[3:n])
+		address, err := ReadSocks5Addr(r)
+		if err != nil {
+			logger.Error(err.Error())
+			continue
+		}
+
+		tconn, err := relay.getTarget(address)
+		if err != nil {
+			logger.Error(err.Error())
+			continue
+		}
+
+		_, err = tconn.Write(buf[n-r.Len() : n])
+		if err != nil {
+			logger.Error(err.Error())
+			continue
+		}
+	}
+}
+
+// getTarget dials without lock, dial over tunnel may be slow and it
+// shouldn't block others.
+func (relay *UdpRelay) getTarget(address string) (tconn net.Conn, err error) {
+	relay.lock.Lock()
+	tconn, ok := relay.targets[address]
+	client := relay.client
+	relay.lock.Unlock()
+	if ok {
+		return
+	}
+
+	tconn, err = netutil.DialFrom(
+		relay.dialer, client.String(), "udp", address)
+	if err != nil {
+		return
+	}
+
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	if relay.closed {
+		tconn.Close()
+		return nil, io.ErrClosedPipe
+	}
+	if exist, ok := relay.targets[address]; ok {
+		tconn.Close()
+		return exist, nil
+	}
+	relay.targets[address] = tconn
+	go relay.recv(address, tconn)
+	return
+}
+
+func (relay *UdpRelay) recv(address string, tconn net.Conn) {
+	defer func() {
+		relay.lock.Lock()
+		if relay.targets[address] == tconn {
+			delete(relay.targets, address)
+		}
+		relay.lock.Unlock()
+		tconn.Close()
+	}()
+
+	hdr := AppendSocks5Addr([]byte{0, 0, 0}, address)
+	buf := make([]byte, SOCKS5_UDP_BUFFER)
+	copy(buf, hdr)
+	for {
+		n, err := tconn.Read(buf[len(hdr):])
+		if err != nil {
+			return
+		}
+
+		relay.lock.Lock()
+		client := relay.client
+		relay.lock.Unlock()
+
+		_, err = relay.uconn.WriteToUDP(buf[:len(hdr)+n], client)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+	}
+}
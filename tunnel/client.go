@@ -3,6 +3,7 @@ package tunnel
 import (
 	"fmt"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/shell909090/goproxy/netutil"
@@ -26,6 +27,21 @@ func NewDialerCreator(raw netutil.Dialer, network, serveraddr, username, passwor
 	}
 }
 
+func (dc *DialerCreator) String() string {
+	return fmt.Sprintf("%s@%s", dc.username, dc.serveraddr)
+}
+
+// Probe creates a tunnel and closes it, returns the auth round trip.
+func (dc *DialerCreator) Probe() (rtt time.Duration, err error) {
+	client, err := dc.Create()
+	if err != nil {
+		return
+	}
+	rtt = client.RTT()
+	client.Close()
+	return
+}
+
 func (dc *DialerCreator) Create() (client *Client, err error) {
 	logger.Noticef("msocks try to connect %s.", dc.serveraddr)
 
@@ -41,14 +57,15 @@ func (dc *DialerCreator) Create() (client *Client, err error) {
 	defer ti.Stop()
 
 	if dc.username != "" || dc.password != "" {
-		logger.Noticef("auth with username: %s, password: %s.",
-			dc.username, dc.password)
+		logger.Noticef("auth with username: %s.", dc.username)
 	}
 
 	auth := Auth{
 		Username: dc.username,
 		Password: dc.password,
+		Flags:    FLAG_SUPPORTED,
 	}
+	start := time.Now()
 	err = WriteFrame(conn, MSG_AUTH, 0, &auth)
 	if err != nil {
 		return
@@ -68,8 +85,12 @@ func (dc *DialerCreator) Create() (client *Client, err error) {
 		return nil, fmt.Errorf("create connection failed with code: %d.", errno)
 	}
 
-	logger.Notice("auth passed.")
-	client = NewClient(conn)
+	flags := frslt.Header.Streamid & FLAG_SUPPORTED
+
+	logger.Noticef("auth passed, flags %d.", flags)
+	client = NewClient(conn, flags)
+	// the first guess of rtt, auth round trip.
+	client.SetRTT(time.Since(start))
 	return
 }
 
@@ -77,16 +98,20 @@ type Client struct {
 	*Fabric
 }
 
-func NewClient(conn net.Conn) (client *Client) {
+func NewClient(conn net.Conn, flags uint16) (client *Client) {
 	client = &Client{
-		Fabric: NewFabric(conn, 0),
+		Fabric: NewFabric(conn, 0, flags),
 	}
 	client.dft_fiber = client
 	return
 }
 
 func (client *Client) Dial(network, address string) (conn net.Conn, err error) {
+	if client.IsDraining() {
+		return nil, ErrDraining
+	}
 	c := NewConn(client.Fabric)
+	c.priority = GetPriority(address)
 	c.streamid, err = client.Fabric.PutIntoNextId(c)
 	if err != nil {
 		return
@@ -94,12 +119,19 @@ func (client *Client) Dial(network, address string) (conn net.Conn, err error) {
 
 	logger.Debugf("%s try to dial %s:%s.", client.String(), network, address)
 
+	start := time.Now()
 	err = c.Connect(network, address)
 	if err != nil {
+		dialSeconds.Observe(time.Since(start).Seconds(), "failed")
 		logger.Error(err.Error())
+		return
 	}
+	dialSeconds.Observe(time.Since(start).Seconds(), "ok")
 	logger.Infof("%s connected.", c.String())
 	conn = c
+	if strings.HasPrefix(network, "udp") {
+		conn = NewDatagramConn(c)
+	}
 	return
 }
 
@@ -5,6 +5,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/shell909090/goproxy/netutil"
@@ -33,13 +34,19 @@ func RecvWithTimeout(ch chan uint32, t time.Duration) (errno uint32) {
 	return
 }
 
-// use lock to protect: status, window.
+// use lock to protect: status, window, rwindow, unacked.
 // SendFrame are not included.
 type Conn struct {
+	sent      uint64
+	recvd     uint64
+	metered   int32
+	counted   int32
+	created   time.Time
 	fab       *Fabric
 	lock      sync.Mutex
 	status    uint8
 	streamid  uint16
+	priority  uint8
 	ch_syn    chan uint32
 	t_closing *time.Timer
 
@@ -48,21 +55,45 @@ type Conn struct {
 	window int32
 	wev    *sync.Cond
 
+	// receive window, and bytes readed but not acked yet.
+	rwindow  uint32
+	unacked  uint32
+	lastWnd  time.Time
+	lastRead time.Time
+
 	Network string
 	Address string
+	// host of Address, label of metrics.
+	target string
+	// addresses checked by server, dialed instead of Address.
+	dialaddrs []string
 }
 
 func NewConn(fab *Fabric) (c *Conn) {
 	c = &Conn{
-		status: ST_UNKNOWN,
-		fab:    fab,
-		rqueue: NewQueue(),
-		window: WINDOWSIZE,
+		created: time.Now(),
+		status:  ST_UNKNOWN,
+		fab:     fab,
+		rqueue:  NewQueue(),
+		window:  WINDOWSIZE,
+	}
+	if fab.FlowControl() {
+		c.window = INIT_WINDOW
+		c.rwindow = INIT_WINDOW
 	}
+	c.lastWnd = time.Now()
+	c.lastRead = c.lastWnd
 	c.wev = sync.NewCond(&c.lock)
 	return
 }
 
+func (c *Conn) GetWindowString() string {
+	// used by manager
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return fmt.Sprintf("%d/%d", c.window, c.rwindow)
+}
+
 func (c *Conn) String() (s string) {
 	return fmt.Sprintf("%s(%d)", c.fab.String(), c.streamid)
 }
@@ -84,16 +115,47 @@ func (c *Conn) GetStatusString() (st string) {
 	return
 }
 
+func (c *Conn) GetPriorityString() string {
+	// used by manager
+	return PriorityText[c.priority]
+}
+
+func (c *Conn) GetBytes() (sent, recvd uint64) {
+	// used by manager
+	return atomic.LoadUint64(&c.sent), atomic.LoadUint64(&c.recvd)
+}
+
+func (c *Conn) Age() time.Duration {
+	// used by manager
+	return time.Since(c.created)
+}
+
 func (c *Conn) GetTarget() (s string) {
 	// used by manager
 	return fmt.Sprintf("%s:%s", c.Network, c.Address)
 }
 
-func (c *Conn) Connect(network, address string) (err error) {
+func (c *Conn) DialAddresses() []string {
+	if len(c.dialaddrs) != 0 {
+		return c.dialaddrs
+	}
+	return []string{c.Address}
+}
+
+func (c *Conn) setAddress(network, address string) {
 	c.Network = network
 	c.Address = address
+	c.target = address
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		c.target = host
+	}
+}
+
+func (c *Conn) Connect(network, address string) (err error) {
+	c.setAddress(network, address)
 
-	c.ch_syn = make(chan uint32, 0)
+	// result may come before waiting for it, like denied by checker.
+	c.ch_syn = make(chan uint32, 1)
 	defer func() {
 		c.ch_syn = nil
 	}()
@@ -107,6 +169,9 @@ func (c *Conn) Connect(network, address string) (err error) {
 		Network: network,
 		Address: address,
 	}
+	if c.fab.flags&FLAG_PRIORITY != 0 {
+		syn.Priority = c.priority
+	}
 	err = SendFrame(c.fab, MSG_SYN, c.streamid, &syn)
 	if err != nil {
 		logger.Error(err.Error())
@@ -121,9 +186,13 @@ func (c *Conn) Connect(network, address string) (err error) {
 		if !ok {
 			errtxt = "unknown"
 		}
-		logger.Errorf(
-			"%s connect %s:%s failed for %s",
+		err = fmt.Errorf("%s connect %s:%s failed for %s.",
 			c.String(), network, address, errtxt)
+		if errno == ERR_DENIED {
+			// caller could tell it, like http 403.
+			logger.Error(err.Error())
+			err = ErrDenied
+		}
 		c.Final()
 		return
 	}
@@ -139,7 +208,7 @@ func (c *Conn) Accept() (err error) {
 	}
 
 	err = SendFrame(
-		c.fab, MSG_RESULT, c.streamid, ERR_NONE)
+		c.fab, MSG_RESULT, c.streamid, Result(ERR_NONE))
 	if err != nil {
 		logger.Error(err.Error())
 		return
@@ -150,7 +219,7 @@ func (c *Conn) Accept() (err error) {
 func (c *Conn) Deny() (err error) {
 	defer c.Final()
 	err = SendFrame(
-		c.fab, MSG_RESULT, c.streamid, ERR_CONNFAILED)
+		c.fab, MSG_RESULT, c.streamid, Result(ERR_CONNFAILED))
 	if err != nil {
 		logger.Error(err.Error())
 		return
@@ -203,6 +272,19 @@ func (c *Conn) Read(data []byte) (n int, err error) {
 	}
 
 	logger.Debugf("%s readed %d bytes.", c.String(), n)
+	atomic.AddUint64(&c.recvd, uint64(n))
+	if atomic.LoadInt32(&c.metered) != 0 {
+		// delay of rate limit here delays wnd, so peer slows down.
+		// window of fabric is released after it, so all streams of the
+		// tunnel are slowed down too.
+		err = c.fab.meter.Transfer(n)
+		if err != nil {
+			logger.Errorf("%s read: %s", c.String(), err.Error())
+			c.fab.releaseWindow(uint32(n))
+			return
+		}
+	}
+	c.fab.releaseWindow(uint32(n))
 
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -213,7 +295,15 @@ func (c *Conn) Read(data []byte) (n int, err error) {
 		return
 	}
 
-	err = SendFrame(c.fab, MSG_WND, c.streamid, uint32(n))
+	grant := uint32(n)
+	if c.fab.FlowControl() {
+		grant = c.tuneWindow(uint32(n))
+	}
+	if grant == 0 {
+		return
+	}
+
+	err = SendFrame(c.fab, MSG_WND, c.streamid, Wnd(grant))
 	if err != nil {
 		logger.Error(err.Error())
 		return
@@ -221,6 +311,49 @@ func (c *Conn) Read(data []byte) (n int, err error) {
 	return
 }
 
+// tuneWindow returns how many bytes should be acked, 0 for not yet.
+// Acks are sent when half of window readed. If that happened in 2 rtt,
+// window is the limit of speed, so window doubles. If reader has been idle
+// for a while, window halves by holding back part of the ack.
+// Call with c.lock.
+func (c *Conn) tuneWindow(n uint32) (grant uint32) {
+	now := time.Now()
+	idle := now.Sub(c.lastRead)
+	c.lastRead = now
+
+	c.unacked += n
+	if c.unacked < c.rwindow/2 {
+		return 0
+	}
+	grant = c.unacked
+	c.unacked = 0
+
+	switch {
+	case now.Sub(c.lastWnd) < 2*c.fab.RTT() && c.rwindow < MAX_WINDOW:
+		inc := c.rwindow
+		if c.rwindow+inc > MAX_WINDOW {
+			inc = MAX_WINDOW - c.rwindow
+		}
+		grant += inc
+		c.rwindow += inc
+		logger.Debugf("%s window grow to %d.", c.String(), c.rwindow)
+	case idle > WINDOW_IDLE*time.Millisecond && c.rwindow > MIN_WINDOW:
+		dec := c.rwindow / 2
+		if c.rwindow-dec < MIN_WINDOW {
+			dec = c.rwindow - MIN_WINDOW
+		}
+		if dec > grant {
+			dec = grant
+		}
+		grant -= dec
+		c.rwindow -= dec
+		logger.Debugf("%s window shrink to %d.", c.String(), c.rwindow)
+	}
+
+	c.lastWnd = now
+	return
+}
+
 func (c *Conn) Write(data []byte) (n int, err error) {
 	for len(data) > 0 {
 		size := uint16(len(data))
@@ -250,28 +383,44 @@ func (c *Conn) Write(data []byte) (n int, err error) {
 }
 
 func (c *Conn) writeSlice(data []byte) (err error) {
+	size := int32(len(data))
+	if atomic.LoadInt32(&c.metered) != 0 {
+		err = c.fab.meter.Transfer(len(data))
+		if err != nil {
+			logger.Errorf("%s write: %s", c.String(), err.Error())
+			return
+		}
+	}
+
 	c.lock.Lock()
-	defer c.lock.Unlock()
+	logger.Debugf("write data len: %d, window: %d", len(data), c.window)
+	for c.status == ST_EST && c.window-size < 0 {
+		// just one goroutine could wait here.
+		c.wev.Wait()
+	}
 	if c.status != ST_EST {
+		c.lock.Unlock()
 		return io.ErrClosedPipe
 	}
+	c.window -= size
+	c.lock.Unlock()
+
+	// don't hold c.lock here, fabric window comes from Fabric.Loop,
+	// which may be blocked by c.lock.
+	err = c.fab.acquireWindow(size)
+	if err != nil {
+		return
+	}
 
 	fdata := NewFrame(MSG_DATA, c.streamid)
 	fdata.Data = data
 	fdata.Header.Length = uint16(len(data))
 
-	logger.Debugf("write data len: %d, window: %d", len(data), c.window)
-	for c.window-int32(len(data)) < 0 {
-		// just one goroutine could wait here.
-		c.wev.Wait()
-	}
-
-	err = c.fab.SendFrame(fdata)
+	err = c.fab.sched.Send(c.priority, fdata)
 	if err != nil {
 		return
 	}
-
-	c.window -= int32(len(data))
+	atomic.AddUint64(&c.sent, uint64(size))
 	return
 }
 
@@ -282,15 +431,45 @@ func (c *Conn) Close() (err error) {
 func (c *Conn) Reset() {
 	c.lock.Lock()
 	c.status = ST_UNKNOWN
+	c.wev.Broadcast()
 	c.lock.Unlock()
 	c.Final()
 	err := c.rqueue.Close()
 	if err != nil {
 		panic(err.Error())
 	}
+	// data will never be readed, give fabric window back.
+	c.fab.releaseWindow(c.rqueue.Drain())
+}
+
+// Abort tells peer to reset the stream, and resets it here.
+func (c *Conn) Abort() (err error) {
+	c.lock.Lock()
+	status := c.status
+	c.lock.Unlock()
+	if status == ST_UNKNOWN {
+		return ErrState
+	}
+
+	logger.Noticef("%s abort.", c.String())
+	err = SendFrame(c.fab, MSG_RST, c.streamid, nil)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+	c.Reset()
+	return
 }
 
 func (c *Conn) Final() {
+	if atomic.CompareAndSwapInt32(&c.metered, 1, 0) {
+		c.fab.meter.Close()
+	}
+	// bytes go to metric once, not in each read and write.
+	if atomic.CompareAndSwapInt32(&c.counted, 0, 1) {
+		sent, recvd := c.GetBytes()
+		targetBytes.Add(float64(recvd), c.target, "in")
+		targetBytes.Add(float64(sent), c.target, "out")
+	}
 	err := c.fab.CloseFiber(c.streamid)
 	if err != nil {
 		logger.Error(err.Error())
@@ -315,7 +494,8 @@ func (c *Conn) closeWrite() (err error) {
 		c.status = ST_UNKNOWN
 		c.t_closing.Stop()
 		c.t_closing = nil
-		c.Final()
+		// after fin sent, a draining fabric may close when stream removed.
+		defer c.Final()
 	case ST_UNKNOWN:
 		return
 	default:
@@ -399,15 +579,15 @@ func (c *Conn) SendFrame(f *Frame) (err error) {
 		}
 		c.lock.Unlock()
 
-		var errno uint32
-		err = f.Unmarshal(&errno)
+		var errno Result
+		err = f.Decode(c.fab.encoding, &errno)
 		if err != nil {
 			logger.Error(err.Error())
 			return
 		}
 
 		select {
-		case c.ch_syn <- errno:
+		case c.ch_syn <- uint32(errno):
 		default:
 		}
 
@@ -418,6 +598,7 @@ func (c *Conn) SendFrame(f *Frame) (err error) {
 			return
 		case io.ErrClosedPipe:
 			// Drop data here
+			c.fab.releaseWindow(uint32(len(f.Data)))
 			err = nil
 		case nil:
 		}
@@ -425,7 +606,7 @@ func (c *Conn) SendFrame(f *Frame) (err error) {
 
 	case MSG_WND:
 		var window Wnd
-		err = f.Unmarshal(&window)
+		err = f.Decode(c.fab.encoding, &window)
 		if err != nil {
 			return
 		}
@@ -433,8 +614,8 @@ func (c *Conn) SendFrame(f *Frame) (err error) {
 		c.lock.Lock()
 		c.window += int32(window)
 		c.wev.Signal()
-		c.lock.Unlock()
 		logger.Debugf("%s window + %d = %d.", c.String(), window, c.window)
+		c.lock.Unlock()
 
 	case MSG_FIN:
 		logger.Debugf("%s read close.", c.String())
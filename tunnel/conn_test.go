@@ -0,0 +1,342 @@
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTuneWindow(t *testing.T) {
+	SetLogging()
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go io.Copy(ioutil.Discard, c2)
+
+	fab := NewFabric(c1, 0, FLAG_SUPPORTED)
+	fab.SetRTT(time.Hour)
+	c := NewConn(fab)
+
+	if c.tuneWindow(INIT_WINDOW/4) != 0 {
+		t.Fatal("ack before half window readed")
+	}
+	grant := c.tuneWindow(INIT_WINDOW / 4)
+	if c.rwindow != 2*INIT_WINDOW || grant != INIT_WINDOW/2+INIT_WINDOW {
+		t.Fatalf("window not grow, rwindow %d, grant %d", c.rwindow, grant)
+	}
+
+	for i := 0; i < 10; i++ {
+		c.tuneWindow(c.rwindow)
+	}
+	if c.rwindow != MAX_WINDOW {
+		t.Fatalf("window over max: %d", c.rwindow)
+	}
+
+	fab.SetRTT(0)
+	c.lastRead = time.Now().Add(-2 * WINDOW_IDLE * time.Millisecond)
+	grant = c.tuneWindow(MAX_WINDOW / 2)
+	if c.rwindow != MAX_WINDOW/2 || grant != 0 {
+		t.Fatalf("window not shrink, rwindow %d, grant %d", c.rwindow, grant)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	SetLogging()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	c1, c2 := net.Pipe()
+	client := NewClient(c1, FLAG_SUPPORTED)
+	server := NewTunnelServer(c2, FLAG_SUPPORTED)
+	defer client.Close()
+	defer server.Close()
+	go client.Loop()
+	go server.Loop()
+
+	conn, err := client.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte(PAYLOAD))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [100]byte
+	_, err = io.ReadFull(conn, buf[:len(PAYLOAD)])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := conn.(*Conn)
+	sent, recvd := c.GetBytes()
+	if sent != uint64(len(PAYLOAD)) || recvd != uint64(len(PAYLOAD)) {
+		t.Fatalf("bytes of stream wrong: %d/%d.", sent, recvd)
+	}
+	if client.GetConnection(c.GetStreamId()) != c {
+		t.Fatal("stream not found in fabric.")
+	}
+
+	err = c.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Read(buf[:]); err == nil {
+		t.Fatal("read after abort should failed.")
+	}
+	for i := 0; server.GetSize() != 0; i++ {
+		if i > 1000 {
+			t.Fatal("stream not reset in peer.")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if c.Abort() != ErrState {
+		t.Fatal("abort twice should failed.")
+	}
+}
+
+// windowLeft is window of server, with bytes not granted back by client.
+func windowLeft(client *Client, server *TunnelServer) int64 {
+	server.wndlock.Lock()
+	window := int64(server.window)
+	server.wndlock.Unlock()
+	client.wndlock.Lock()
+	defer client.wndlock.Unlock()
+	return window + int64(client.unacked)
+}
+
+func TestAbortWindow(t *testing.T) {
+	SetLogging()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// target keeps sending, so data is in flight when aborted.
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 64*1024)
+				for {
+					if _, err := conn.Write(buf); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	c1, c2 := net.Pipe()
+	client := NewClient(c1, FLAG_SUPPORTED)
+	server := NewTunnelServer(c2, FLAG_SUPPORTED)
+	defer client.Close()
+	defer server.Close()
+	go client.Loop()
+	go server.Loop()
+
+	for i := 0; i < 8; i++ {
+		conn, err := client.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// reading, so stream window isn't full.
+		go io.Copy(ioutil.Discard, conn)
+		time.Sleep(20 * time.Millisecond)
+		err = conn.(*Conn).Abort()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; server.GetSize() != 0 || windowLeft(client, server) != FABRIC_WINDOW; i++ {
+		if i > 1000 {
+			t.Fatalf("fabric window not recovered: %d.", windowLeft(client, server))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type denyMeter struct{}
+
+func (m denyMeter) Open() error          { return ErrQuotaExceeded }
+func (m denyMeter) Close()               {}
+func (m denyMeter) Transfer(n int) error { return nil }
+
+func TestMeterDeny(t *testing.T) {
+	SetLogging()
+	c1, c2 := net.Pipe()
+	client := NewClient(c1, FLAG_SUPPORTED)
+	server := NewTunnelServer(c2, FLAG_SUPPORTED)
+	server.SetMeter(denyMeter{})
+	defer client.Close()
+	defer server.Close()
+	go client.Loop()
+	go server.Loop()
+
+	_, err := client.Dial("tcp", "127.0.0.1:1")
+	if err == nil || !strings.Contains(err.Error(), ErrnoText[ERR_QUOTA]) {
+		t.Fatalf("dial should be denied by quota: %v.", err)
+	}
+	if server.GetSize() != 0 {
+		t.Fatal("denied stream left in server.")
+	}
+}
+
+// addrChecker allows all targets, dialed as addrs.
+type addrChecker []string
+
+func (c addrChecker) Check(network, address string) ([]string, error) {
+	return c, nil
+}
+
+// errChecker fails all targets with the error.
+type errChecker struct {
+	err error
+}
+
+func (c errChecker) Check(network, address string) ([]string, error) {
+	return nil, c.err
+}
+
+func TestCheckerDeny(t *testing.T) {
+	SetLogging()
+	c1, c2 := net.Pipe()
+	client := NewClient(c1, FLAG_SUPPORTED)
+	server := NewTunnelServer(c2, FLAG_SUPPORTED)
+	checker := &errChecker{err: ErrDenied}
+	server.SetChecker(checker)
+	defer client.Close()
+	defer server.Close()
+	go client.Loop()
+	go server.Loop()
+
+	_, err := client.Dial("tcp", "127.0.0.1:1")
+	if err != ErrDenied {
+		t.Fatalf("dial should be denied: %v.", err)
+	}
+
+	// lookup failed isn't denied.
+	checker.err = errors.New("no such host.")
+	_, err = client.Dial("tcp", "example.invalid:80")
+	if err == nil || err == ErrDenied ||
+		!strings.Contains(err.Error(), ErrnoText[ERR_CONNFAILED]) {
+		t.Fatalf("dial should be failed: %v.", err)
+	}
+}
+
+func TestCheckerFallback(t *testing.T) {
+	SetLogging()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	c1, c2 := net.Pipe()
+	client := NewClient(c1, FLAG_SUPPORTED)
+	server := NewTunnelServer(c2, FLAG_SUPPORTED)
+	server.SetChecker(addrChecker{
+		closed.Addr().String(), listener.Addr().String()})
+	defer client.Close()
+	defer server.Close()
+	go client.Loop()
+	go server.Loop()
+
+	conn, err := client.Dial("tcp", "www.example.com:80")
+	if err != nil {
+		t.Fatalf("next address should be dialed: %v.", err)
+	}
+	defer conn.Close()
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+}
+
+// countMeter counts streams opened and closed.
+type countMeter struct {
+	opened, closed int32
+}
+
+func (m *countMeter) Open() error          { atomic.AddInt32(&m.opened, 1); return nil }
+func (m *countMeter) Close()               { atomic.AddInt32(&m.closed, 1) }
+func (m *countMeter) Transfer(n int) error { return nil }
+
+// waitChecker allows targets after released.
+type waitChecker struct {
+	started, release chan struct{}
+}
+
+func (c *waitChecker) Check(network, address string) ([]string, error) {
+	close(c.started)
+	<-c.release
+	return []string{address}, nil
+}
+
+func TestCheckerClosed(t *testing.T) {
+	SetLogging()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	c1, c2 := net.Pipe()
+	client := NewClient(c1, FLAG_SUPPORTED)
+	server := NewTunnelServer(c2, FLAG_SUPPORTED)
+	meter := &countMeter{}
+	checker := &waitChecker{
+		started: make(chan struct{}), release: make(chan struct{})}
+	server.SetMeter(meter)
+	server.SetChecker(checker)
+	defer client.Close()
+	go client.Loop()
+	go server.Loop()
+
+	go client.Dial("tcp", listener.Addr().String())
+	<-checker.started
+	// fabric closed while checking.
+	server.Close()
+	close(checker.release)
+
+	for i := 0; atomic.LoadInt32(&meter.opened) != atomic.LoadInt32(&meter.closed) ||
+		atomic.LoadInt32(&meter.opened) == 0; i++ {
+		if i > 1000 {
+			t.Fatalf("stream leaked in meter: %d/%d.", meter.opened, meter.closed)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if server.GetSize() != 0 {
+		t.Fatal("stream left in closed fabric.")
+	}
+}
@@ -0,0 +1,64 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+)
+
+// DatagramConn keeps message boundaries over a stream connection.
+// Each datagram is sent as a 2 bytes length (big endian) and the payload.
+type DatagramConn struct {
+	net.Conn
+	rlock sync.Mutex
+	wlock sync.Mutex
+}
+
+func NewDatagramConn(conn net.Conn) (dc *DatagramConn) {
+	return &DatagramConn{Conn: conn}
+}
+
+// Read one datagram. If b is shorter than the datagram, the rest is
+// discarded, the same as what udp socket does.
+func (dc *DatagramConn) Read(b []byte) (n int, err error) {
+	dc.rlock.Lock()
+	defer dc.rlock.Unlock()
+
+	var hdr [2]byte
+	_, err = io.ReadFull(dc.Conn, hdr[:])
+	if err != nil {
+		return
+	}
+	size := int(binary.BigEndian.Uint16(hdr[:]))
+
+	if size <= len(b) {
+		return io.ReadFull(dc.Conn, b[:size])
+	}
+
+	n, err = io.ReadFull(dc.Conn, b)
+	if err != nil {
+		return
+	}
+	_, err = io.CopyN(ioutil.Discard, dc.Conn, int64(size-n))
+	return
+}
+
+func (dc *DatagramConn) Write(b []byte) (n int, err error) {
+	if len(b) > (1<<16 - 1) {
+		return 0, ErrFrameOverFlow
+	}
+
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+
+	dc.wlock.Lock()
+	defer dc.wlock.Unlock()
+	_, err = dc.Conn.Write(buf)
+	if err != nil {
+		return
+	}
+	return len(b), nil
+}
@@ -6,28 +6,60 @@ import (
 	"net"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// use wndlock to protect: window, unacked, wclosed.
 type Fabric struct {
 	net.Conn
 	startTime time.Time
+	flags     uint16
+	encoding  uint8
+	rtt       int64
+	sent      uint64
+	recvd     uint64
+	draining  int32
 	wlock     sync.Mutex
 	closed    bool
 	plock     sync.RWMutex
 	next_id   uint16
 	weaves    map[uint16]Fiber
 	dft_fiber Fiber
+	sched     *Scheduler
+	ch_closed chan struct{}
+	meter     Meter
+
+	pinglock sync.Mutex
+	lost     int
+	pongs    int
+
+	wndlock sync.Mutex
+	wndev   *sync.Cond
+	window  int32
+	unacked uint32
+	wclosed bool
 }
 
-func NewFabric(conn net.Conn, next_id uint16) (fab *Fabric) {
+func NewFabric(conn net.Conn, next_id uint16, flags uint16) (fab *Fabric) {
 	fab = &Fabric{
 		Conn:      conn,
 		startTime: time.Now(),
+		flags:     flags,
+		encoding:  ENC_JSON,
+		rtt:       int64(DEFAULT_RTT * time.Millisecond),
 		closed:    false,
 		next_id:   next_id,
 		weaves:    make(map[uint16]Fiber, 0),
+		window:    FABRIC_WINDOW,
+		sched:     NewScheduler(),
+		ch_closed: make(chan struct{}),
 	}
+	if flags&FLAG_BINARY != 0 {
+		fab.encoding = ENC_BINARY
+	}
+	fab.wndev = sync.NewCond(&fab.wndlock)
+	go fab.sendLoop()
 	return
 }
 
@@ -43,6 +75,186 @@ func (fab *Fabric) Uptime() (d time.Duration) {
 	return d
 }
 
+func (fab *Fabric) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&fab.rtt))
+}
+
+func (fab *Fabric) SetRTT(d time.Duration) {
+	atomic.StoreInt64(&fab.rtt, int64(d))
+}
+
+// GetBytes returns bytes sent and received in fabric, headers included.
+func (fab *Fabric) GetBytes() (sent, recvd uint64) {
+	return atomic.LoadUint64(&fab.sent), atomic.LoadUint64(&fab.recvd)
+}
+
+// SetMeter should be called before Loop.
+func (fab *Fabric) SetMeter(meter Meter) {
+	fab.meter = meter
+}
+
+func (fab *Fabric) IsDraining() bool {
+	return atomic.LoadInt32(&fab.draining) != 0
+}
+
+// Drain stops new streams, and closes fabric after all streams finished.
+// Peer will be told by GOAWAY, so it won't start new streams either.
+func (fab *Fabric) Drain() (err error) {
+	if !atomic.CompareAndSwapInt32(&fab.draining, 0, 1) {
+		return
+	}
+	logger.Noticef("%s draining.", fab.String())
+
+	if fab.flags&FLAG_GOAWAY != 0 {
+		err = SendFrame(fab, MSG_GOAWAY, 0, nil)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+	}
+	if fab.GetSize() == 0 {
+		fab.Close()
+	}
+	return
+}
+
+func (fab *Fabric) onGoaway(f *Frame) (err error) {
+	if !atomic.CompareAndSwapInt32(&fab.draining, 0, 1) {
+		return
+	}
+	logger.Noticef("%s peer going away.", fab.String())
+	if fab.GetSize() == 0 {
+		fab.Close()
+	}
+	return
+}
+
+// updateRTT smooths rtt like tcp does, first pong is taken as it is.
+func (fab *Fabric) updateRTT(sample time.Duration) {
+	fab.pinglock.Lock()
+	defer fab.pinglock.Unlock()
+	if fab.pongs > 0 {
+		sample = (7*fab.RTT() + sample) / 8
+	}
+	fab.pongs++
+	fab.lost = 0
+	fab.SetRTT(sample)
+}
+
+// keepalive sends ping every interval. Fabric will be closed after
+// PING_MAXLOST pings lost, so a half dead connection won't be used any more.
+func (fab *Fabric) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-fab.ch_closed:
+			return
+		case <-ticker.C:
+		}
+
+		fab.pinglock.Lock()
+		lost := fab.lost
+		fab.lost++
+		fab.pinglock.Unlock()
+
+		if lost >= PING_MAXLOST {
+			logger.Errorf("%s lost %d pings, close it.", fab.String(), lost)
+			fab.Close()
+			return
+		}
+
+		err := SendFrame(fab, MSG_PING, 0, Ping(time.Now().UnixNano()))
+		if err != nil {
+			logger.Error(err.Error())
+			fab.Close()
+			return
+		}
+	}
+}
+
+func (fab *Fabric) onPing(f *Frame) (err error) {
+	// echo it back as it is.
+	fpong := NewFrame(MSG_PONG, f.Header.Streamid)
+	fpong.Data = f.Data
+	fpong.Header.Length = f.Header.Length
+	return fab.SendFrame(fpong)
+}
+
+func (fab *Fabric) onPong(f *Frame) (err error) {
+	var p Ping
+	err = f.Decode(fab.encoding, &p)
+	if err != nil {
+		return
+	}
+	sample := time.Since(time.Unix(0, int64(p)))
+	if sample < 0 {
+		return ErrFrameFormat
+	}
+	fab.updateRTT(sample)
+	logger.Debugf("%s rtt %s.", fab.String(), fab.RTT())
+	return
+}
+
+// FlowControl tells if window of streams are tuned, and data in the whole
+// fabric are limited by FABRIC_WINDOW. Or every stream has a fixed window.
+func (fab *Fabric) FlowControl() bool {
+	return fab.flags&FLAG_WINDOW != 0
+}
+
+// acquireWindow blocks until n bytes could be sent in fabric window.
+func (fab *Fabric) acquireWindow(n int32) (err error) {
+	if !fab.FlowControl() {
+		return
+	}
+	fab.wndlock.Lock()
+	defer fab.wndlock.Unlock()
+	for !fab.wclosed && fab.window < n {
+		fab.wndev.Wait()
+	}
+	if fab.wclosed {
+		return io.ErrClosedPipe
+	}
+	fab.window -= n
+	return
+}
+
+// releaseWindow tells the peer n bytes are consumed (or dropped),
+// in batch of half window.
+func (fab *Fabric) releaseWindow(n uint32) {
+	if !fab.FlowControl() || n == 0 {
+		return
+	}
+	fab.wndlock.Lock()
+	fab.unacked += n
+	if fab.wclosed || fab.unacked < FABRIC_WINDOW/2 {
+		fab.wndlock.Unlock()
+		return
+	}
+	grant := fab.unacked
+	fab.unacked = 0
+	fab.wndlock.Unlock()
+
+	err := SendFrame(fab, MSG_FWND, 0, Wnd(grant))
+	if err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+func (fab *Fabric) onWindow(f *Frame) (err error) {
+	var window Wnd
+	err = f.Decode(fab.encoding, &window)
+	if err != nil {
+		return
+	}
+
+	fab.wndlock.Lock()
+	fab.window += int32(window)
+	fab.wndev.Broadcast()
+	fab.wndlock.Unlock()
+	logger.Debugf("%s fabric window + %d.", fab.String(), window)
+	return
+}
+
 func (fab *Fabric) GetSize() int {
 	fab.plock.Lock()
 	defer fab.plock.Unlock()
@@ -71,6 +283,13 @@ func (fab *Fabric) GetConnections() (conns ConnSlice) {
 	return
 }
 
+func (fab *Fabric) GetConnection(streamid uint16) (c *Conn) {
+	fab.plock.RLock()
+	defer fab.plock.RUnlock()
+	c, _ = fab.weaves[streamid].(*Conn)
+	return
+}
+
 func (fab *Fabric) PutIntoNextId(f Fiber) (id uint16, err error) {
 	fab.plock.Lock()
 	defer fab.plock.Unlock()
@@ -92,10 +311,15 @@ func (fab *Fabric) PutIntoNextId(f Fiber) (id uint16, err error) {
 	return
 }
 
+// PutIntoId fails if fabric closed, streams put after Close would never
+// be closed.
 func (fab *Fabric) PutIntoId(id uint16, f Fiber) (err error) {
 	fab.plock.Lock()
 	defer fab.plock.Unlock()
 
+	if fab.closed {
+		return io.ErrClosedPipe
+	}
 	_, ok := fab.weaves[id]
 	if ok {
 		return ErrIdExist
@@ -120,6 +344,7 @@ func (fab *Fabric) SendFrame(f *Frame) (err error) {
 	if err != nil {
 		return
 	}
+	atomic.AddUint64(&fab.sent, uint64(n))
 	if n != len(b) {
 		return io.ErrShortWrite
 	}
@@ -127,27 +352,53 @@ func (fab *Fabric) SendFrame(f *Frame) (err error) {
 	return
 }
 
+// sendLoop writes data frames in order of scheduler.
+// Other frames are small, they go through SendFrame directly.
+func (fab *Fabric) sendLoop() {
+	for {
+		req := fab.sched.next()
+		if req == nil {
+			return
+		}
+		req.done <- fab.SendFrame(req.f)
+	}
+}
+
 func (fab *Fabric) CloseFiber(streamid uint16) (err error) {
 	fab.plock.Lock()
-	defer fab.plock.Unlock()
 	if _, ok := fab.weaves[streamid]; !ok {
+		fab.plock.Unlock()
 		return fmt.Errorf("streamid(%d) not exist.", streamid)
 	}
 	delete(fab.weaves, streamid)
+	size := len(fab.weaves)
+	fab.plock.Unlock()
 
 	logger.Infof("%s remove port %d.", fab.String(), streamid)
+
+	if size == 0 && fab.IsDraining() {
+		logger.Noticef("%s drained.", fab.String())
+		fab.Close()
+	}
 	return
 }
 
 func (fab *Fabric) Close() (err error) {
 	defer fab.Conn.Close()
 
-	fab.plock.RLock()
-	defer fab.plock.RUnlock()
+	fab.plock.Lock()
+	defer fab.plock.Unlock()
 	if fab.closed {
 		return
 	}
 	fab.closed = true
+	close(fab.ch_closed)
+
+	fab.wndlock.Lock()
+	fab.wclosed = true
+	fab.wndev.Broadcast()
+	fab.wndlock.Unlock()
+	fab.sched.Close()
 
 	logger.Warningf(
 		"%s close all connects (%d).", fab.String(), len(fab.weaves))
@@ -169,6 +420,10 @@ func (fab *Fabric) Close() (err error) {
 func (fab *Fabric) Loop() {
 	defer fab.Close()
 
+	if fab.flags&FLAG_PING != 0 {
+		go fab.keepalive(PING_INTERVAL * time.Millisecond)
+	}
+
 	for {
 		f, err := ReadFrame(fab.Conn, nil)
 		switch err {
@@ -182,15 +437,21 @@ func (fab *Fabric) Loop() {
 		}
 
 		logger.Debugf("recv %s", f.Debug())
+		atomic.AddUint64(&fab.recvd, uint64(5+len(f.Data)))
 
-		fab.plock.RLock()
-		fiber, ok := fab.weaves[f.Header.Streamid]
-		fab.plock.RUnlock()
-		if !ok || fiber == nil {
-			fiber = fab.dft_fiber
+		// frames for the whole fabric, others go to fibers.
+		switch f.Header.Type {
+		case MSG_FWND:
+			err = fab.onWindow(f)
+		case MSG_PING:
+			err = fab.onPing(f)
+		case MSG_PONG:
+			err = fab.onPong(f)
+		case MSG_GOAWAY:
+			err = fab.onGoaway(f)
+		default:
+			err = fab.dispatch(f)
 		}
-
-		err = fiber.SendFrame(f)
 		if err != nil {
 			logger.Errorf("send %s => %s(%d) failed, err: %s.",
 				f.Debug(), fab.String(),
@@ -200,3 +461,18 @@ func (fab *Fabric) Loop() {
 	}
 	return
 }
+
+func (fab *Fabric) dispatch(f *Frame) (err error) {
+	fab.plock.RLock()
+	fiber, ok := fab.weaves[f.Header.Streamid]
+	fab.plock.RUnlock()
+	if !ok || fiber == nil {
+		// stream removed already, like aborted, data in flight will never
+		// be read, give fabric window back.
+		if f.Header.Type == MSG_DATA {
+			fab.releaseWindow(uint32(len(f.Data)))
+		}
+		fiber = fab.dft_fiber
+	}
+	return fiber.SendFrame(f)
+}
@@ -0,0 +1,109 @@
+package tunnel
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKeepalive(t *testing.T) {
+	SetLogging()
+	c1, c2 := net.Pipe()
+	fab1 := NewFabric(c1, 0, FLAG_SUPPORTED)
+	fab2 := NewFabric(c2, 1, FLAG_SUPPORTED)
+	defer fab1.Close()
+	defer fab2.Close()
+	go fab1.Loop()
+	go fab2.Loop()
+	go fab1.keepalive(10 * time.Millisecond)
+
+	time.Sleep(100 * time.Millisecond)
+	fab1.pinglock.Lock()
+	pongs := fab1.pongs
+	fab1.pinglock.Unlock()
+	if pongs == 0 {
+		t.Fatal("no pong received.")
+	}
+	if fab1.RTT() >= DEFAULT_RTT*time.Millisecond {
+		t.Fatalf("rtt not measured: %s.", fab1.RTT())
+	}
+}
+
+func TestKeepaliveLost(t *testing.T) {
+	SetLogging()
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	// peer reads everything, but never answers.
+	go io.Copy(ioutil.Discard, c2)
+
+	fab := NewFabric(c1, 0, FLAG_SUPPORTED)
+	go fab.keepalive(10 * time.Millisecond)
+
+	select {
+	case <-fab.ch_closed:
+	case <-time.After(time.Second):
+		t.Fatal("fabric not closed after pings lost.")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	SetLogging()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	c1, c2 := net.Pipe()
+	client := NewClient(c1, FLAG_SUPPORTED)
+	server := NewTunnelServer(c2, FLAG_SUPPORTED)
+	defer server.Close()
+	go client.Loop()
+	go server.Loop()
+
+	conn, err := client.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.Drain()
+	_, err = client.Dial("tcp", ln.Addr().String())
+	if err != ErrDraining {
+		t.Fatalf("dial on draining tunnel should failed: %v.", err)
+	}
+	for !server.IsDraining() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// streams already in it still work.
+	_, err = conn.Write([]byte(PAYLOAD))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [100]byte
+	n, err := conn.Read(buf[:])
+	if err != nil || string(buf[:n]) != PAYLOAD {
+		t.Fatalf("data not match: %v.", err)
+	}
+	conn.Close()
+
+	select {
+	case <-client.ch_closed:
+	case <-time.After(time.Second):
+		t.Fatal("fabric not closed after drained.")
+	}
+}
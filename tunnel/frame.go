@@ -2,6 +2,7 @@ package tunnel
 
 import (
 	"bytes"
+	"encoding"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -19,21 +20,150 @@ func (hdr *Header) Debug() string {
 		hdr.Type, hdr.Streamid, hdr.Length)
 }
 
+// Control payloads are json encoded by default. A client asks for optional
+// features, like binary encoding, by setting bits in Auth.Flags, and a server
+// answers the auth with the bits it accepted in the stream id of the result
+// frame. Old servers echo stream id 0, old clients never ask for anything.
+// The auth frame and its result are always json.
+
 type Result uint32
 
+func (r Result) MarshalBinary() (data []byte, err error) {
+	data = make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(r))
+	return
+}
+
+func (r *Result) UnmarshalBinary(data []byte) (err error) {
+	if len(data) != 4 {
+		return ErrFrameFormat
+	}
+	*r = Result(binary.BigEndian.Uint32(data))
+	return
+}
+
 type Auth struct {
 	Username string
 	Password string
+	Flags    uint16 `json:",omitempty"`
+}
+
+func (a *Auth) MarshalBinary() (data []byte, err error) {
+	return marshalStrings(a.Username, a.Password)
 }
 
+func (a *Auth) UnmarshalBinary(data []byte) (err error) {
+	return unmarshalStrings(data, &a.Username, &a.Password)
+}
+
+// Priority is sent only if peer accepted FLAG_PRIORITY.
+// In binary, it's an optional byte after strings.
 type Syn struct {
-	Network string
-	Address string
+	Network  string
+	Address  string
+	Priority uint8 `json:",omitempty"`
+}
+
+func (syn *Syn) MarshalBinary() (data []byte, err error) {
+	data, err = marshalStrings(syn.Network, syn.Address)
+	if err != nil {
+		return
+	}
+	if syn.Priority != PRI_NORMAL {
+		data = append(data, syn.Priority)
+	}
+	return
+}
+
+func (syn *Syn) UnmarshalBinary(data []byte) (err error) {
+	data, err = readStrings(data, &syn.Network, &syn.Address)
+	if err != nil {
+		return
+	}
+	switch len(data) {
+	case 0:
+		syn.Priority = PRI_NORMAL
+	case 1:
+		syn.Priority = data[0]
+	default:
+		return ErrFrameFormat
+	}
+	return
 }
 
-// TODO: use json in wnd may cause performance problem.
 type Wnd uint32
 
+func (w Wnd) MarshalBinary() (data []byte, err error) {
+	return Result(w).MarshalBinary()
+}
+
+func (w *Wnd) UnmarshalBinary(data []byte) (err error) {
+	return (*Result)(w).UnmarshalBinary(data)
+}
+
+// Ping carries the time sent, in UnixNano of sender. Pong echoes it.
+type Ping uint64
+
+func (p Ping) MarshalBinary() (data []byte, err error) {
+	data = make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(p))
+	return
+}
+
+func (p *Ping) UnmarshalBinary(data []byte) (err error) {
+	if len(data) != 8 {
+		return ErrFrameFormat
+	}
+	*p = Ping(binary.BigEndian.Uint64(data))
+	return
+}
+
+// each string is encoded as 2 bytes length and the content.
+func marshalStrings(strs ...string) (data []byte, err error) {
+	size := 0
+	for _, s := range strs {
+		if len(s) > (1<<16 - 1) {
+			return nil, ErrFrameOverFlow
+		}
+		size += 2 + len(s)
+	}
+
+	data = make([]byte, 0, size)
+	for _, s := range strs {
+		data = append(data, byte(len(s)>>8), byte(len(s)))
+		data = append(data, s...)
+	}
+	return
+}
+
+func unmarshalStrings(data []byte, strs ...*string) (err error) {
+	data, err = readStrings(data, strs...)
+	if err != nil {
+		return
+	}
+	if len(data) != 0 {
+		return ErrFrameFormat
+	}
+	return
+}
+
+// readStrings returns the data left after strings.
+func readStrings(data []byte, strs ...*string) (rest []byte, err error) {
+	for _, s := range strs {
+		if len(data) < 2 {
+			return nil, ErrFrameFormat
+		}
+		size := int(binary.BigEndian.Uint16(data))
+		data = data[2:]
+		if len(data) < size {
+			return nil, ErrFrameFormat
+		}
+		*s = string(data[:size])
+		data = data[size:]
+	}
+	return data, nil
+}
+
 type Frame struct {
 	Header
 	Data []byte
@@ -62,15 +192,15 @@ func ReadFrame(r io.Reader, v interface{}) (f *Frame, err error) {
 	return
 }
 
-func SendFrame(fiber Fiber, tp uint8, streamid uint16, v interface{}) (err error) {
+func SendFrame(fab *Fabric, tp uint8, streamid uint16, v interface{}) (err error) {
 	f := NewFrame(tp, streamid)
 	if v != nil {
-		err = f.Marshal(v)
+		err = f.Encode(fab.encoding, v)
 		if err != nil {
 			return
 		}
 	}
-	err = fiber.SendFrame(f)
+	err = fab.SendFrame(f)
 	return
 }
 
@@ -117,6 +247,38 @@ func (f *Frame) Unmarshal(v interface{}) (err error) {
 	return
 }
 
+// Encode v with encoding negotiated. Types without binary form use json.
+func (f *Frame) Encode(enc uint8, v interface{}) (err error) {
+	m, ok := v.(encoding.BinaryMarshaler)
+	if enc != ENC_BINARY || !ok {
+		return f.Marshal(v)
+	}
+
+	f.Data, err = m.MarshalBinary()
+	if err != nil {
+		return
+	}
+	if len(f.Data) > (1<<16 - 1) {
+		return ErrFrameOverFlow
+	}
+	f.Header.Length = uint16(len(f.Data))
+	return
+}
+
+func (f *Frame) Decode(enc uint8, v interface{}) (err error) {
+	u, ok := v.(encoding.BinaryUnmarshaler)
+	if enc != ENC_BINARY || !ok {
+		return f.Unmarshal(v)
+	}
+
+	err = u.UnmarshalBinary(f.Data)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	return
+}
+
 func (f *Frame) Pack() (b []byte) {
 	var buf bytes.Buffer
 	buf.Grow(int(5 + f.Header.Length))
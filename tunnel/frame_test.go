@@ -0,0 +1,116 @@
+package tunnel
+
+import (
+	"testing"
+)
+
+func TestFrameBinary(t *testing.T) {
+	f := NewFrame(MSG_SYN, 1)
+	syn := Syn{Network: "tcp", Address: "www.example.com:443"}
+	err := f.Encode(ENC_BINARY, &syn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var syn2 Syn
+	err = f.Decode(ENC_BINARY, &syn2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if syn != syn2 {
+		t.Fatalf("syn not match: %v.", syn2)
+	}
+
+	syn.Priority = PRI_BULK
+	err = f.Encode(ENC_BINARY, &syn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Decode(ENC_BINARY, &syn2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if syn != syn2 {
+		t.Fatalf("syn with priority not match: %v.", syn2)
+	}
+
+	f = NewFrame(MSG_WND, 1)
+	err = f.Encode(ENC_BINARY, Wnd(65536))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Header.Length != 4 {
+		t.Fatalf("wnd length wrong: %d.", f.Header.Length)
+	}
+
+	var wnd Wnd
+	err = f.Decode(ENC_BINARY, &wnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wnd != 65536 {
+		t.Fatalf("wnd not match: %d.", wnd)
+	}
+
+	f.Data = f.Data[:3]
+	if f.Decode(ENC_BINARY, &wnd) == nil {
+		t.Fatalf("short wnd should failed.")
+	}
+}
+
+func benchmarkWnd(b *testing.B, enc uint8) {
+	var size int
+	var wnd Wnd
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		f := NewFrame(MSG_WND, 1)
+		err := f.Encode(enc, Wnd(i))
+		if err != nil {
+			b.Fatal(err)
+		}
+		size += len(f.Pack())
+
+		err = f.Decode(enc, &wnd)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(size)/float64(b.N), "bytes/frame")
+}
+
+func BenchmarkWndJSON(b *testing.B) {
+	benchmarkWnd(b, ENC_JSON)
+}
+
+func BenchmarkWndBinary(b *testing.B) {
+	benchmarkWnd(b, ENC_BINARY)
+}
+
+func benchmarkSyn(b *testing.B, enc uint8) {
+	var size int
+	var syn2 Syn
+	syn := Syn{Network: "tcp", Address: "www.example.com:443"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		f := NewFrame(MSG_SYN, 1)
+		err := f.Encode(enc, &syn)
+		if err != nil {
+			b.Fatal(err)
+		}
+		size += len(f.Pack())
+
+		err = f.Decode(enc, &syn2)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(size)/float64(b.N), "bytes/frame")
+}
+
+func BenchmarkSynJSON(b *testing.B) {
+	benchmarkSyn(b, ENC_JSON)
+}
+
+func BenchmarkSynBinary(b *testing.B) {
+	benchmarkSyn(b, ENC_BINARY)
+}
@@ -0,0 +1,119 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"sync"
+)
+
+// PRI_NORMAL is zero, so syn from old clients goes normal.
+const (
+	PRI_NORMAL = iota
+	PRI_INTERACTIVE
+	PRI_BULK
+	PRI_MAX
+)
+
+var PriorityText = map[uint8]string{
+	PRI_NORMAL:      "normal",
+	PRI_INTERACTIVE: "interactive",
+	PRI_BULK:        "bulk",
+}
+
+// bytes could be sent in one round, times SCHED_QUANTUM.
+var PriorityWeight = [PRI_MAX]int{
+	PRI_NORMAL:      4,
+	PRI_INTERACTIVE: 16,
+	PRI_BULK:        1,
+}
+
+// the order to pick data frames in one round.
+var priorityOrder = [PRI_MAX]uint8{PRI_INTERACTIVE, PRI_NORMAL, PRI_BULK}
+
+// Target is a pattern of path.Match. With a port, it matches host:port,
+// like "*:22". Otherwise it matches host only, like "*.example.com".
+type PriorityRule struct {
+	Target   string
+	Priority string
+}
+
+type priorityRule struct {
+	target   string
+	withport bool
+	priority uint8
+}
+
+var (
+	prilock  sync.RWMutex
+	prirules []priorityRule
+)
+
+func ParsePriority(s string) (priority uint8, err error) {
+	for p, text := range PriorityText {
+		if strings.ToLower(s) == text {
+			return p, nil
+		}
+	}
+	return PRI_NORMAL, fmt.Errorf("unknown priority: %s.", s)
+}
+
+// SetPriorityRules replaces rules used by GetPriority. First match wins.
+// CheckPriorityRules makes sure rules could be set.
+func CheckPriorityRules(rules []PriorityRule) (err error) {
+	_, err = parsePriorityRules(rules)
+	return
+}
+
+func SetPriorityRules(rules []PriorityRule) (err error) {
+	newrules, err := parsePriorityRules(rules)
+	if err != nil {
+		return
+	}
+	prilock.Lock()
+	prirules = newrules
+	prilock.Unlock()
+	return
+}
+
+func parsePriorityRules(rules []PriorityRule) (newrules []priorityRule, err error) {
+	for _, rule := range rules {
+		var r priorityRule
+		r.priority, err = ParsePriority(rule.Priority)
+		if err != nil {
+			return
+		}
+		r.target = strings.ToLower(rule.Target)
+		_, err = path.Match(r.target, "")
+		if err != nil {
+			return
+		}
+		_, _, err = net.SplitHostPort(r.target)
+		r.withport = (err == nil)
+		err = nil
+		newrules = append(newrules, r)
+	}
+	return
+}
+
+func GetPriority(address string) (priority uint8) {
+	address = strings.ToLower(address)
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+
+	prilock.RLock()
+	defer prilock.RUnlock()
+	for _, r := range prirules {
+		s := host
+		if r.withport {
+			s = address
+		}
+		if ok, _ := path.Match(r.target, s); ok {
+			return r.priority
+		}
+	}
+	return PRI_NORMAL
+}
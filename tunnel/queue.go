@@ -64,3 +64,16 @@ func (q *Queue) Close() (err error) {
 	q.ev.Broadcast()
 	return
 }
+
+// Drain removes everything in queue, returns size of []byte dropped.
+func (q *Queue) Drain() (n uint32) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for e := q.queue.Front(); e != nil; e = q.queue.Front() {
+		if b, ok := e.Value.([]byte); ok {
+			n += uint32(len(b))
+		}
+		q.queue.Remove(e)
+	}
+	return
+}
@@ -0,0 +1,141 @@
+package tunnel
+
+import (
+	"container/list"
+	"io"
+	"sync"
+)
+
+type sendReq struct {
+	f    *Frame
+	done chan error
+}
+
+type sendQueue struct {
+	streamid uint16
+	priority uint8
+	reqs     []*sendReq
+}
+
+// Scheduler decides which data frame goes next. Priority classes share the
+// fabric by deficit round robin, in bytes of PriorityWeight*SCHED_QUANTUM
+// each round. Streams in the same class take turns.
+// A queue is in queues if and only if it is in ready, and not empty.
+type Scheduler struct {
+	lock    sync.Mutex
+	ev      *sync.Cond
+	closed  bool
+	queues  map[uint16]*sendQueue
+	ready   [PRI_MAX]*list.List
+	deficit [PRI_MAX]int
+}
+
+func NewScheduler() (s *Scheduler) {
+	s = &Scheduler{
+		queues: make(map[uint16]*sendQueue),
+	}
+	for i := range s.ready {
+		s.ready[i] = list.New()
+	}
+	s.ev = sync.NewCond(&s.lock)
+	return
+}
+
+// Send blocks until the frame has been written, or scheduler closed.
+func (s *Scheduler) Send(priority uint8, f *Frame) (err error) {
+	if priority >= PRI_MAX {
+		priority = PRI_NORMAL
+	}
+	req := &sendReq{
+		f:    f,
+		done: make(chan error, 1),
+	}
+
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return io.ErrClosedPipe
+	}
+	streamid := f.Header.Streamid
+	q, ok := s.queues[streamid]
+	if !ok {
+		q = &sendQueue{
+			streamid: streamid,
+			priority: priority,
+		}
+		s.queues[streamid] = q
+		s.ready[priority].PushBack(q)
+	}
+	q.reqs = append(q.reqs, req)
+	s.ev.Signal()
+	s.lock.Unlock()
+
+	return <-req.done
+}
+
+// next blocks until a frame should be sent, returns nil after closed.
+func (s *Scheduler) next() (req *sendReq) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for !s.closed {
+		req = s.pick()
+		if req != nil {
+			return
+		}
+		s.ev.Wait()
+	}
+	return nil
+}
+
+// call with s.lock.
+func (s *Scheduler) pick() (req *sendReq) {
+	for round := 0; round < 2; round++ {
+		for _, pri := range priorityOrder {
+			l := s.ready[pri]
+			if l.Len() == 0 || s.deficit[pri] <= 0 {
+				continue
+			}
+
+			q := l.Remove(l.Front()).(*sendQueue)
+			req = q.reqs[0]
+			q.reqs = q.reqs[1:]
+			if len(q.reqs) > 0 {
+				l.PushBack(q)
+			} else {
+				delete(s.queues, q.streamid)
+			}
+
+			s.deficit[pri] -= len(req.f.Data)
+			return
+		}
+
+		// all deficit used, start a new round.
+		for pri, l := range s.ready {
+			if l.Len() == 0 {
+				s.deficit[pri] = 0
+			} else {
+				s.deficit[pri] += PriorityWeight[pri] * SCHED_QUANTUM
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Scheduler) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for _, q := range s.queues {
+		for _, req := range q.reqs {
+			req.done <- io.ErrClosedPipe
+		}
+	}
+	s.queues = nil
+	for _, l := range s.ready {
+		l.Init()
+	}
+	s.ev.Broadcast()
+}
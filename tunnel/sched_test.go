@@ -0,0 +1,94 @@
+package tunnel
+
+import (
+	"testing"
+)
+
+func TestScheduler(t *testing.T) {
+	SetLogging()
+	s := NewScheduler()
+
+	queue := func(streamid uint16, priority uint8, n int) {
+		for i := 0; i < n; i++ {
+			f := NewFrame(MSG_DATA, streamid)
+			f.Data = make([]byte, SCHED_QUANTUM)
+			go s.Send(priority, f)
+		}
+	}
+	queue(1, PRI_BULK, 10)
+	queue(3, PRI_BULK, 10)
+	queue(5, PRI_INTERACTIVE, 20)
+
+	// wait for all senders queued.
+	for total := 0; total != 40; {
+		s.lock.Lock()
+		total = 0
+		for _, q := range s.queues {
+			total += len(q.reqs)
+		}
+		s.lock.Unlock()
+	}
+
+	// interactive goes first, but bulk still gets its share.
+	var order, bulk []uint16
+	for i := 0; i < 40; i++ {
+		req := s.next()
+		order = append(order, req.f.Header.Streamid)
+		req.done <- nil
+		if req.f.Header.Streamid != 5 {
+			bulk = append(bulk, req.f.Header.Streamid)
+		}
+	}
+	for _, id := range order[:PriorityWeight[PRI_INTERACTIVE]] {
+		if id != 5 {
+			t.Fatalf("bulk frame before interactive: %v.", order)
+		}
+	}
+	if order[PriorityWeight[PRI_INTERACTIVE]] == 5 {
+		t.Fatalf("bulk stream starved: %v.", order)
+	}
+	for i := 1; i < len(bulk); i++ {
+		if bulk[i] == bulk[i-1] {
+			t.Fatalf("bulk streams should take turns: %v.", order)
+		}
+	}
+
+	s.Close()
+	if s.next() != nil {
+		t.Fatal("scheduler should return nil after closed.")
+	}
+}
+
+func TestPriorityRules(t *testing.T) {
+	err := SetPriorityRules([]PriorityRule{
+		{Target: "*:22", Priority: "interactive"},
+		{Target: "*.example.com", Priority: "bulk"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetPriorityRules(nil)
+
+	cases := map[string]uint8{
+		"github.com:22":        PRI_INTERACTIVE,
+		"dl.example.com:443":   PRI_BULK,
+		"WWW.Example.com:80":   PRI_BULK,
+		"www.google.com:443":   PRI_NORMAL,
+		"dl.example.com:22":    PRI_INTERACTIVE,
+		"[2001:db8::1]:22":     PRI_INTERACTIVE,
+		"192.168.1.1:8080":     PRI_NORMAL,
+		"badaddress":           PRI_NORMAL,
+		"example.com.cn:443":   PRI_NORMAL,
+		"www.example.com:8443": PRI_BULK,
+	}
+	for address, pri := range cases {
+		if GetPriority(address) != pri {
+			t.Errorf("priority of %s should be %s.", address, PriorityText[pri])
+		}
+	}
+
+	err = SetPriorityRules([]PriorityRule{{Target: "*", Priority: "urgent"}})
+	if err == nil {
+		t.Fatal("unknown priority should failed.")
+	}
+}
@@ -4,56 +4,84 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
+
+	"github.com/shell909090/goproxy/metrics"
 )
 
 type PasswordAuthenticator interface {
 	AuthPass(string, string) bool
 }
 
-func AuthConn(auth PasswordAuthenticator, conn net.Conn) (err error) {
-	ti := time.AfterFunc(AUTH_TIMEOUT*time.Millisecond, func() {
-		logger.Errorf("auth timeout %s.", conn.RemoteAddr())
-		conn.Close()
-	})
+// Meter accounts and limits streams of a user.
+// Open is called before a stream accepted, and Close after it finished.
+// Transfer is called with bytes read or written, it could block for rate
+// limit, and returns error when quota exhausted.
+type Meter interface {
+	Open() error
+	Close()
+	Transfer(n int) error
+}
+
+// Checker decides whether a target of tcp or udp could be connected.
+// Addresses to dial are returned, resolved if it's a domain, so the checked
+// ones are dialed, not the ones resolved again. They are tried in order. ErrDenied should be returned
+// if target isn't allowed, other errors are taken as connect failed.
+type Checker interface {
+	Check(network, address string) (dialaddrs []string, err error)
+}
 
-	err = onAuth(auth, conn)
+// AuthConn returns the auth request, with Flags set to the ones accepted.
+// In silent mode, failed auth gets no answer, caller should pass the conn
+// to a fallback, so it looks the same as anything else failed.
+// Replayed connections are rejected by tls or aead handshake before this.
+// Legacy ciphers have no replay protection, their iv is sent in cleartext,
+// a recorded session could be replayed with the same keystream.
+func AuthConn(author PasswordAuthenticator, conn net.Conn, silent bool) (auth *Auth, err error) {
+	conn.SetReadDeadline(time.Now().Add(AUTH_TIMEOUT * time.Millisecond))
+
+	auth, err = onAuth(author, conn, silent)
 	if err != nil {
-		logger.Error(err.Error())
+		logger.Errorf("auth %s failed: %s.", conn.RemoteAddr(), err.Error())
 		return
 	}
 
-	ti.Stop()
+	conn.SetReadDeadline(time.Time{})
 	return
 }
 
-func onAuth(author PasswordAuthenticator, stream io.ReadWriteCloser) (err error) {
-	var auth Auth
-	fauth, err := ReadFrame(stream, &auth)
+func onAuth(author PasswordAuthenticator, stream io.ReadWriteCloser, silent bool) (auth *Auth, err error) {
+	auth = new(Auth)
+	fauth, err := ReadFrame(stream, auth)
 	if err != nil {
 		logger.Error(err.Error())
 		return
 	}
 
 	if fauth.Header.Type != MSG_AUTH {
-		return ErrUnexpectedPkg
+		return nil, ErrUnexpectedPkg
 	}
 
 	if !author.AuthPass(auth.Username, auth.Password) {
-		logger.Errorf("user %s auth failed with password: %s.",
-			auth.Username, auth.Password)
-		err = WriteFrame(
-			stream, MSG_RESULT, fauth.Header.Streamid, ERR_AUTH)
-		if err != nil {
-			return
+		metrics.AuthFailures.Inc("tunnel")
+		logger.Errorf("user %s auth failed.", auth.Username)
+		if !silent {
+			err = WriteFrame(
+				stream, MSG_RESULT, fauth.Header.Streamid, Result(ERR_AUTH))
+			if err != nil {
+				return
+			}
 		}
-		err = fmt.Errorf("user %s auth failed, password:%s.",
-			auth.Username, auth.Password)
+		err = fmt.Errorf("user %s auth failed.", auth.Username)
 		return
 	}
 
+	auth.Flags &= FLAG_SUPPORTED
+
+	// stream id of the result carries the flags accepted.
 	err = WriteFrame(
-		stream, MSG_RESULT, fauth.Header.Streamid, ERR_NONE)
+		stream, MSG_RESULT, auth.Flags, Result(ERR_NONE))
 	if err != nil {
 		logger.Error(err.Error())
 		return
@@ -71,10 +99,14 @@ var ProtocolHandlers map[string]Handler
 
 func init() {
 	p := new(TcpProxy)
+	u := new(UdpProxy)
 	ProtocolHandlers = map[string]Handler{
 		"tcp":  p,
 		"tcp4": p,
 		"tcp6": p,
+		"udp":  u,
+		"udp4": u,
+		"udp6": u,
 	}
 }
 
@@ -113,26 +145,35 @@ func (server *Server) Serve(listener net.Listener) (err error) {
 
 type TunnelServer struct {
 	*Fabric
+	checker Checker
 }
 
-func NewTunnelServer(conn net.Conn) (s *TunnelServer) {
+func NewTunnelServer(conn net.Conn, flags uint16) (s *TunnelServer) {
 	s = &TunnelServer{
-		Fabric: NewFabric(conn, 1),
+		Fabric: NewFabric(conn, 1, flags),
 	}
 	s.Fabric.dft_fiber = s
 	return
 }
 
+// SetChecker should be called before Loop.
+func (s *TunnelServer) SetChecker(checker Checker) {
+	s.checker = checker
+}
+
 func (s *TunnelServer) SendFrame(f *Frame) (err error) {
 	switch f.Header.Type {
 	case MSG_SYN:
 		var syn Syn
-		err = f.Unmarshal(&syn)
+		err = f.Decode(s.encoding, &syn)
 		if err != nil {
 			logger.Error(err.Error())
 			return
 		}
 		err = s.onSyn(f.Header.Streamid, &syn)
+	case MSG_DATA, MSG_WND, MSG_FIN, MSG_RST:
+		// frames in flight of stream removed, like aborted.
+		logger.Infof("%s drop frame of stream gone: %s.", s.String(), f.Debug())
 	default:
 		err = ErrUnexpectedPkg
 		logger.Infof(f.Debug())
@@ -142,12 +183,22 @@ func (s *TunnelServer) SendFrame(f *Frame) (err error) {
 }
 
 func (s *TunnelServer) onSyn(streamid uint16, syn *Syn) (err error) {
-	var c *Conn
+	if s.IsDraining() {
+		logger.Errorf("%s draining, syn %d denied.", s.String(), streamid)
+		err = SendFrame(
+			s.Fabric, MSG_RESULT, streamid, Result(ERR_GOAWAY))
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		return
+	}
+
 	handler, ok := ProtocolHandlers[syn.Network]
 	if !ok {
 		logger.Errorf("unknown network: %s.", syn.Network)
 		err = SendFrame(
-			s.Fabric, MSG_RESULT, streamid, ERR_UNKNOWN_PROTOCOL)
+			s.Fabric, MSG_RESULT, streamid, Result(ERR_UNKNOWN_PROTOCOL))
 		if err != nil {
 			logger.Error(err.Error())
 			return
@@ -155,10 +206,63 @@ func (s *TunnelServer) onSyn(streamid uint16, syn *Syn) (err error) {
 		return
 	}
 
-	c, err = s.accept(streamid, syn)
+	// only targets from clients are checked, not services like dns.
+	switch handler.(type) {
+	case *TcpProxy, *UdpProxy:
+		if s.checker != nil {
+			// checker may resolve, Loop shouldn't wait for it.
+			go s.check(streamid, syn, handler)
+			return
+		}
+	}
+	return s.open(streamid, syn, nil, handler)
+}
+
+func (s *TunnelServer) check(streamid uint16, syn *Syn, handler Handler) {
+	dialaddrs, err := s.checker.Check(syn.Network, syn.Address)
 	if err != nil {
+		logger.Errorf("%s syn %d to %s check failed: %s",
+			s.String(), streamid, syn.Address, err.Error())
+		errno := ERR_CONNFAILED
+		if err == ErrDenied {
+			errno = ERR_DENIED
+		}
+		err = SendFrame(
+			s.Fabric, MSG_RESULT, streamid, Result(errno))
+		if err != nil {
+			logger.Error(err.Error())
+		}
+		return
+	}
+	s.open(streamid, syn, dialaddrs, handler)
+}
+
+func (s *TunnelServer) open(streamid uint16, syn *Syn, dialaddrs []string, handler Handler) (err error) {
+	if s.meter != nil {
+		err = s.meter.Open()
+		if err != nil {
+			logger.Errorf("%s syn %d denied: %s", s.String(), streamid, err.Error())
+			err = SendFrame(
+				s.Fabric, MSG_RESULT, streamid, Result(ERR_QUOTA))
+			if err != nil {
+				logger.Error(err.Error())
+				return
+			}
+			return
+		}
+	}
+
+	c, err := s.accept(streamid, syn)
+	if err != nil {
+		if s.meter != nil {
+			s.meter.Close()
+		}
 		return
 	}
+	c.dialaddrs = dialaddrs
+	if s.meter != nil {
+		atomic.StoreInt32(&c.metered, 1)
+	}
 	go handler.Handle(c)
 	return
 }
@@ -171,18 +275,23 @@ func (s *TunnelServer) accept(streamid uint16, syn *Syn) (c *Conn, err error) {
 		return
 	}
 	c.streamid = streamid
-	c.Network = syn.Network
-	c.Address = syn.Address
+	c.setAddress(syn.Network, syn.Address)
+	if syn.Priority < PRI_MAX {
+		c.priority = syn.Priority
+	}
 
+	// fabric may be closed while checking.
 	err = s.Fabric.PutIntoId(streamid, c)
 	if err != nil {
 		logger.Error(err.Error())
-		err = SendFrame(
-			s.Fabric, MSG_RESULT, streamid, ERR_IDEXIST)
-		if err != nil {
-			logger.Error(err.Error())
-			return
+		if err == ErrIdExist {
+			e := SendFrame(
+				s.Fabric, MSG_RESULT, streamid, Result(ERR_IDEXIST))
+			if e != nil {
+				logger.Error(e.Error())
+			}
 		}
+		return
 	}
 	return
 }
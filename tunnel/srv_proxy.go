@@ -30,15 +30,22 @@ func (p *TcpProxy) Handle(fabconn net.Conn) (err error) {
 	logger.Debugf("%s try to connect %s:%s.",
 		c.String(), c.Network, c.Address)
 
-	conn, err = p.DialMaybeTimeout(c.Network, c.Address)
-	if err != nil {
+	for _, addr := range c.DialAddresses() {
+		conn, err = p.DialMaybeTimeout(c.Network, addr)
+		if err == nil {
+			break
+		}
 		logger.Error(err.Error())
+	}
+	if err != nil {
 		c.Deny()
 		return
 	}
 
 	err = c.Accept()
 	if err != nil {
+		conn.Close()
+		c.Final()
 		return
 	}
 
@@ -47,3 +54,81 @@ func (p *TcpProxy) Handle(fabconn net.Conn) (err error) {
 		c.String(), c.Network, c.Address)
 	return
 }
+
+type UdpProxy struct {
+}
+
+func (p *UdpProxy) Handle(fabconn net.Conn) (err error) {
+	c, ok := fabconn.(*Conn)
+	if !ok {
+		panic("proxy with no fab conn.")
+	}
+
+	logger.Debugf("%s try to connect %s:%s.",
+		c.String(), c.Network, c.Address)
+
+	var conn net.Conn
+	for _, addr := range c.DialAddresses() {
+		conn, err = net.Dial(c.Network, addr)
+		if err == nil {
+			break
+		}
+		logger.Error(err.Error())
+	}
+	if err != nil {
+		c.Deny()
+		return
+	}
+
+	err = c.Accept()
+	if err != nil {
+		conn.Close()
+		c.Final()
+		return
+	}
+
+	dc := NewDatagramConn(c)
+	go p.recv(conn, dc)
+	go p.send(conn, dc)
+	logger.Noticef("%s associated to %s:%s.",
+		c.String(), c.Network, c.Address)
+	return
+}
+
+// udp socket => tunnel. quit when socket idle for UDP_TIMEOUT.
+func (p *UdpProxy) recv(conn net.Conn, dc *DatagramConn) {
+	defer dc.Close()
+	buf := make([]byte, 1<<16-1)
+	for {
+		conn.SetReadDeadline(time.Now().Add(UDP_TIMEOUT * time.Millisecond))
+		n, err := conn.Read(buf)
+		if err != nil {
+			logger.Info(err.Error())
+			return
+		}
+
+		_, err = dc.Write(buf[:n])
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+	}
+}
+
+// tunnel => udp socket.
+func (p *UdpProxy) send(conn net.Conn, dc *DatagramConn) {
+	defer conn.Close()
+	buf := make([]byte, 1<<16-1)
+	for {
+		n, err := dc.Read(buf)
+		if err != nil {
+			return
+		}
+
+		_, err = conn.Write(buf[:n])
+		if err != nil {
+			logger.Error(err.Error())
+			continue
+		}
+	}
+}
@@ -31,19 +31,26 @@ func (m *MockServer) AuthPass(username, password string) bool {
 }
 
 func (m *MockServer) Handle(conn net.Conn) (err error) {
-	err = AuthConn(m, conn)
+	auth, err := AuthConn(m, conn, false)
 	if err != nil {
 		logger.Error(err.Error())
 		return
 	}
 
-	tun := NewTunnelServer(conn)
+	tun := NewTunnelServer(conn, auth.Flags)
 	tun.Loop()
 	logger.Warning("server loop quit")
 	return
 }
 
+var logonce sync.Once
+
+// SetLogging could be called in each test, only the first one works.
 func SetLogging() {
+	logonce.Do(setLogging)
+}
+
+func setLogging() {
 	logBackend := logging.NewLogBackend(os.Stderr, "",
 		stdlog.Ltime|stdlog.Lmicroseconds|stdlog.Lshortfile)
 	logging.SetBackend(logBackend)
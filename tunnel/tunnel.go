@@ -2,8 +2,11 @@ package tunnel
 
 import (
 	"errors"
+	"time"
 
 	logging "github.com/op/go-logging"
+
+	"github.com/shell909090/goproxy/metrics"
 )
 
 const (
@@ -11,8 +14,21 @@ const (
 	DIAL_TIMEOUT  = 20000
 	WRITE_TIMEOUT = 10000
 	CLOSE_TIMEOUT = 30000
+	UDP_TIMEOUT   = 60000
 	WINDOWSIZE    = 4 * 1024 * 1024
 	// WINDOWSIZE = 100
+	// window of streams tuned between MIN_WINDOW and MAX_WINDOW.
+	// one stream can't take the whole FABRIC_WINDOW from others.
+	INIT_WINDOW   = 256 * 1024
+	MIN_WINDOW    = 64 * 1024
+	MAX_WINDOW    = WINDOWSIZE
+	FABRIC_WINDOW = 4 * MAX_WINDOW
+	WINDOW_IDLE   = 10000
+	DEFAULT_RTT   = 100
+	SCHED_QUANTUM = 8 * 1024
+	PING_INTERVAL = 15000
+	// fabric closed after PING_MAXLOST pings without pong.
+	PING_MAXLOST = 3
 )
 
 const (
@@ -24,6 +40,24 @@ const (
 	MSG_WND
 	MSG_FIN
 	MSG_RST
+	MSG_FWND
+	MSG_PING
+	MSG_PONG
+	MSG_GOAWAY
+)
+
+const (
+	ENC_JSON = iota
+	ENC_BINARY
+)
+
+const (
+	FLAG_BINARY = 1 << iota
+	FLAG_WINDOW
+	FLAG_PRIORITY
+	FLAG_PING
+	FLAG_GOAWAY
+	FLAG_SUPPORTED = FLAG_BINARY | FLAG_WINDOW | FLAG_PRIORITY | FLAG_PING | FLAG_GOAWAY
 )
 
 const (
@@ -52,6 +86,9 @@ const (
 	ERR_TIMEOUT
 	ERR_CLOSED
 	ERR_UNKNOWN_PROTOCOL
+	ERR_GOAWAY
+	ERR_QUOTA
+	ERR_DENIED
 )
 
 var ErrnoText = map[uint32]string{
@@ -61,24 +98,51 @@ var ErrnoText = map[uint32]string{
 	ERR_CONNFAILED: "connected failed",
 	ERR_TIMEOUT:    "timeout",
 	ERR_CLOSED:     "connect closed",
+	ERR_GOAWAY:     "tunnel going away",
+	ERR_QUOTA:      "quota exceeded",
+	ERR_DENIED:     "access denied",
 }
 
 var (
 	ErrFrameOverFlow  = errors.New("marshal overflow in frame")
+	ErrFrameFormat    = errors.New("frame format error.")
 	ErrUnknownNetwork = errors.New("unknown network.")
 	ErrStreamOutOfID  = errors.New("stream out of id.")
 	ErrUnexpectedPkg  = errors.New("unexpected package.")
 	ErrIdExist        = errors.New("frame sync stream id exist.")
 	ErrState          = errors.New("status error.")
+	ErrDraining       = errors.New("tunnel is draining.")
+	ErrQuotaExceeded  = errors.New("quota exceeded.")
+	ErrDenied         = errors.New("access denied by server.")
 )
 
 var (
 	logger = logging.MustGetLogger("msocks")
 )
 
+var (
+	targetBytes = metrics.NewCounterVec(
+		"goproxy_target_bytes_total", "Bytes of streams by target host.",
+		"target", "direction")
+	dialSeconds = metrics.NewHistogramVec(
+		"goproxy_dial_seconds", "Latency of dials in tunnels.",
+		nil, "result")
+)
+
+func init() {
+	targetBytes.SetOverflow("target")
+}
+
 type Tunnel interface {
 	String() string
 	GetSize() int
+	Uptime() time.Duration
+	RTT() time.Duration
+	GetBytes() (uint64, uint64)
+	GetConnections() ConnSlice
+	GetConnection(uint16) *Conn
+	Drain() error
+	IsDraining() bool
 	Loop()
 	Close() error
 }
@@ -3,6 +3,8 @@ package tunnel
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"sync"
 	"testing"
@@ -69,6 +71,82 @@ func multi_client(t *testing.T, client *Client, wg *sync.WaitGroup) {
 	}
 }
 
+func udp_echo(t *testing.T) (addr string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer conn.Close()
+		var buf [1024]byte
+		for {
+			n, addr, err := conn.ReadFrom(buf[:])
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func udp_client(t *testing.T, client *Client, addr string) {
+	conn, err := client.Dial("udp", addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	for i := 0; i < 10; i++ {
+		b := []byte(fmt.Sprintf("%s%d", PAYLOAD, i))
+		_, err = conn.Write(b)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		var readbuf [100]byte
+		n, err := conn.Read(readbuf[:])
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if bytes.Compare(b, readbuf[:n]) != 0 {
+			t.Error("datagram not match")
+			return
+		}
+	}
+}
+
+func bulk_client(t *testing.T, client *Client, size int) {
+	conn, err := client.Dial("tcp", "127.0.0.1:14756")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	defer conn.Close()
+
+	// don't close in writer, proxy drops echo back after half closed.
+	go func() {
+		b := bytes.Repeat([]byte(PAYLOAD), 1024)
+		for n := 0; n < size; n += len(b) {
+			_, err := conn.Write(b)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	_, err = io.CopyN(ioutil.Discard, conn, int64(size))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
 // func get_myip(t *testing.T, client *Client, wg *sync.WaitGroup) {
 // 	conn, err := client.Dial("myip", "")
 // 	if err != nil {
@@ -118,6 +196,11 @@ func TestTunnel(t *testing.T) {
 	multi_client(t, client, &wg)
 	wg.Wait()
 
+	udp_client(t, client, udp_echo(t))
+
+	// more than fabric window, both stream and fabric window should be renewed.
+	bulk_client(t, client, 2*FABRIC_WINDOW)
+
 	multi_client(t, client, &wg)
 	client.Close()
 	wg.Wait()